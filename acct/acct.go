@@ -0,0 +1,276 @@
+package acct
+
+import (
+	"cmp"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+func New(conf *Config) *Accountant {
+	if conf == nil {
+		conf = &Config{}
+	}
+
+	if conf.Interval <= 0 {
+		conf.Interval = DEFAULT_INTERVAL
+	}
+
+	return &Accountant{
+		conf:    conf,
+		users:   map[string]*user{},
+		conns:   map[uint64]*Conn{},
+		flushed: map[string]Bytes{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Open registers a connection, it must be closed once the relay ends.
+func (a *Accountant) Open(userID string, session uint64, network string, target string) *Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u, ok := a.users[userID]
+
+	if !ok {
+		u = &user{}
+		a.users[userID] = u
+	}
+
+	c := &Conn{
+		ID:      a.nextID.Add(1),
+		User:    userID,
+		Session: session,
+		Net:     network,
+		Target:  target,
+		Opened:  time.Now(),
+		user:    u,
+		acct:    a,
+	}
+
+	u.opened.Add(1)
+	u.active.Add(1)
+	a.conns[c.ID] = c
+
+	return c
+}
+
+// User returns the totals of a single user, nil when the user has no traffic yet.
+func (a *Accountant) User(userID string) *UserStats {
+	a.mu.Lock()
+	u, ok := a.users[userID]
+	a.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return u.stats(userID)
+}
+
+// Users returns the totals of every user sorted by ID.
+func (a *Accountant) Users() []*UserStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	list := make([]*UserStats, 0, len(a.users))
+
+	for id, u := range a.users {
+		list = append(list, u.stats(id))
+	}
+
+	slices.SortFunc(list, func(x, y *UserStats) int { return strings.Compare(x.User, y.User) })
+
+	return list
+}
+
+// Conns returns the open connections sorted by ID.
+func (a *Accountant) Conns() []*ConnStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	list := make([]*ConnStats, 0, len(a.conns))
+
+	for _, c := range a.conns {
+		list = append(list, &ConnStats{
+			Bytes:   c.Snapshot(),
+			ID:      c.ID,
+			User:    c.User,
+			Session: c.Session,
+			Net:     c.Net,
+			Target:  c.Target,
+			Opened:  c.Opened,
+		})
+	}
+
+	slices.SortFunc(list, func(x, y *ConnStats) int { return cmp.Compare(x.ID, y.ID) })
+
+	return list
+}
+
+// Flush writes the usage of every user since the previous flush to the sink.
+// Usage that failed to be written is included again in the next flush.
+func (a *Accountant) Flush() error {
+	if a.conf.Sink == nil {
+		return nil
+	}
+
+	// Concurrent flushes would both write the same usage.
+	a.fmu.Lock()
+	defer a.fmu.Unlock()
+
+	now := time.Now()
+	records := []*Record{}
+	totals := map[string]Bytes{}
+
+	a.mu.Lock()
+
+	for id, u := range a.users {
+		total := u.Snapshot()
+		delta := total.Sub(a.flushed[id])
+
+		if delta == (Bytes{}) {
+			continue
+		}
+
+		totals[id] = total
+
+		records = append(records, &Record{
+			Bytes: delta,
+			Time:  now,
+			User:  id,
+		})
+	}
+
+	a.mu.Unlock()
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	slices.SortFunc(records, func(x, y *Record) int { return strings.Compare(x.User, y.User) })
+
+	if err := a.conf.Sink.Write(records); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	maps.Copy(a.flushed, totals)
+	a.mu.Unlock()
+
+	return nil
+}
+
+// Start flushes periodically until Stop is called.
+func (a *Accountant) Start() error {
+	a.started.Store(true)
+
+	go func() {
+		defer close(a.done)
+
+		ticker := time.NewTicker(a.conf.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := a.Flush(); err != nil && a.conf.Log != nil {
+					a.conf.Log.Errf("Failed to flush accounting records: %s", err.Error())
+				}
+			case <-a.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop ends the periodic flushes, writes the remaining usage and closes the sink.
+func (a *Accountant) Stop() error {
+	var err error
+
+	a.once.Do(func() {
+		close(a.stop)
+
+		// A periodic flush must not write to the sink once it is closed.
+		if a.started.Load() {
+			<-a.done
+		}
+
+		if err = a.Flush(); err != nil && a.conf.Log != nil {
+			a.conf.Log.Errf("Failed to flush accounting records: %s", err.Error())
+		}
+
+		if closer, ok := a.conf.Sink.(io.Closer); ok {
+			err = errors.Join(err, closer.Close())
+		}
+	})
+
+	return err
+}
+
+func (a *Accountant) Wait() {
+	<-a.done
+}
+
+// Report matches the relay Report callbacks and counts for both the connection and its user.
+func (c *Conn) Report(side uint8, op uint8, n int) {
+	c.Add(side, op, n)
+	c.user.Add(side, op, n)
+}
+
+// Close unregisters the connection, its bytes remain in the user totals.
+func (c *Conn) Close() {
+	c.once.Do(func() {
+		c.acct.mu.Lock()
+		delete(c.acct.conns, c.ID)
+		c.acct.mu.Unlock()
+
+		c.user.active.Add(-1)
+	})
+}
+
+func (c *Counters) Add(side uint8, op uint8, n int) {
+	c.c[side&1][op&1].Add(uint64(n))
+}
+
+func (c *Counters) Snapshot() Bytes {
+	return Bytes{
+		SrcRead:  c.c[SRC][READ].Load(),
+		SrcWrite: c.c[SRC][WRITE].Load(),
+		DstRead:  c.c[DST][READ].Load(),
+		DstWrite: c.c[DST][WRITE].Load(),
+	}
+}
+
+// Up is the traffic sent by the client, Down the traffic delivered to it.
+func (b Bytes) Up() uint64 {
+	return b.SrcRead
+}
+
+func (b Bytes) Down() uint64 {
+	return b.SrcWrite
+}
+
+func (b Bytes) Sub(o Bytes) Bytes {
+	return Bytes{
+		SrcRead:  b.SrcRead - o.SrcRead,
+		SrcWrite: b.SrcWrite - o.SrcWrite,
+		DstRead:  b.DstRead - o.DstRead,
+		DstWrite: b.DstWrite - o.DstWrite,
+	}
+}
+
+func (u *user) stats(id string) *UserStats {
+	return &UserStats{
+		Bytes:  u.Snapshot(),
+		User:   id,
+		Opened: u.opened.Load(),
+		Active: u.active.Load(),
+	}
+}
@@ -0,0 +1,155 @@
+package acct
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dipakw/logs"
+)
+
+type memSink struct {
+	records []*Record
+}
+
+func (s *memSink) Write(records []*Record) error {
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func TestCounters(t *testing.T) {
+	sink := &memSink{}
+	a := New(&Config{Sink: sink})
+
+	c1 := a.Open("alice", 1, "tcp", "example.com:443")
+	c2 := a.Open("alice", 1, "udp", "1.1.1.1:53")
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			c1.Report(SRC, READ, 10)
+			c1.Report(DST, WRITE, 10)
+			c2.Report(DST, READ, 5)
+			c2.Report(SRC, WRITE, 5)
+		}()
+	}
+
+	wg.Wait()
+
+	if conns := a.Conns(); len(conns) != 2 || conns[0].ID != c1.ID || conns[0].SrcRead != 1000 || conns[1].DstRead != 500 {
+		t.Fatalf("unexpected connections: %+v", conns)
+	}
+
+	c1.Close()
+	c1.Close()
+
+	u := a.User("alice")
+
+	if u.Up() != 1000 || u.Down() != 500 || u.DstWrite != 1000 || u.Opened != 2 || u.Active != 1 {
+		t.Fatalf("unexpected user totals: %+v", u)
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	c2.Report(SRC, READ, 7)
+	a.Flush()
+	a.Flush()
+
+	if len(sink.records) != 2 || sink.records[0].SrcRead != 1000 || sink.records[1].SrcRead != 7 || sink.records[1].SrcWrite != 0 {
+		t.Fatalf("expected two delta records, got %d", len(sink.records))
+	}
+}
+
+type failSink struct {
+	memSink
+
+	ok     bool
+	closed bool
+}
+
+func (s *failSink) Write(records []*Record) error {
+	if !s.ok {
+		return errors.New("disk full")
+	}
+
+	return s.memSink.Write(records)
+}
+
+func (s *failSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+// errLog records Errf calls, the other methods are not used by the accountant.
+type errLog struct {
+	logs.Log
+	errs chan string
+}
+
+func (l *errLog) Errf(format string, a ...any) {
+	l.errs <- format
+}
+
+func TestFlushErrors(t *testing.T) {
+	sink := &failSink{}
+	log := &errLog{errs: make(chan string, 16)}
+	a := New(&Config{Interval: 10 * time.Millisecond, Sink: sink, Log: log})
+
+	a.Open("alice", 1, "tcp", "example.com:443").Report(SRC, READ, 10)
+
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-log.errs:
+	case <-time.After(time.Second):
+		t.Fatal("expected the failed periodic flush to be logged")
+	}
+
+	a.Open("alice", 1, "tcp", "example.com:443").Report(SRC, READ, 10)
+
+	if err := a.Stop(); err == nil {
+		t.Fatal("expected the final flush to fail")
+	}
+
+	a.Wait()
+
+	if !sink.closed {
+		t.Fatal("expected Stop to close the sink")
+	}
+}
+
+func TestFlushRetries(t *testing.T) {
+	sink := &failSink{}
+	a := New(&Config{Sink: sink})
+	c := a.Open("alice", 1, "tcp", "example.com:443")
+
+	c.Report(SRC, READ, 10)
+
+	if err := a.Flush(); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+
+	c.Report(SRC, READ, 5)
+	sink.ok = true
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.records) != 1 || sink.records[0].SrcRead != 15 {
+		t.Fatalf("expected the failed usage to be written with the next flush, got %+v", sink.records)
+	}
+
+	if err := a.Flush(); err != nil || len(sink.records) != 1 {
+		t.Fatalf("expected nothing left to flush, got %d records %v", len(sink.records), err)
+	}
+}
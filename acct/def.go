@@ -0,0 +1,124 @@
+package acct
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dipakw/logs"
+)
+
+// Sides and operations, as passed to the relay Report callbacks.
+const (
+	SRC uint8 = 0
+	DST uint8 = 1
+
+	READ  uint8 = 0
+	WRITE uint8 = 1
+)
+
+const (
+	DEFAULT_INTERVAL = time.Minute
+)
+
+type Config struct {
+	// How often usage is flushed to the sink, DEFAULT_INTERVAL when zero.
+	Interval time.Duration
+
+	// Receives per-user usage since the previous flush, nothing is flushed when nil.
+	// Sinks that are also an io.Closer are closed by Stop.
+	Sink Sink
+
+	// Flush errors of the periodic and the final flush are logged here when set.
+	Log logs.Log
+}
+
+// Sink stores flushed usage records.
+type Sink interface {
+	Write(records []*Record) error
+}
+
+// Accountant aggregates byte counters per user and per connection.
+type Accountant struct {
+	conf    *Config
+	mu      sync.Mutex
+	users   map[string]*user
+	conns   map[uint64]*Conn
+	flushed map[string]Bytes
+	fmu     sync.Mutex
+	nextID  atomic.Uint64
+	started atomic.Bool
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Counters are updated inline by the relays without locking.
+type Counters struct {
+	c [2][2]atomic.Uint64
+}
+
+// Conn accounts a single relayed connection.
+type Conn struct {
+	Counters
+
+	ID      uint64
+	User    string
+	Session uint64
+	Net     string
+	Target  string
+	Opened  time.Time
+
+	user *user
+	acct *Accountant
+	once sync.Once
+}
+
+type user struct {
+	Counters
+
+	opened atomic.Uint64
+	active atomic.Int64
+}
+
+// Bytes is a snapshot of counters, source is the client side and destination the target side.
+type Bytes struct {
+	SrcRead  uint64 `json:"src_read"`
+	SrcWrite uint64 `json:"src_write"`
+	DstRead  uint64 `json:"dst_read"`
+	DstWrite uint64 `json:"dst_write"`
+}
+
+type UserStats struct {
+	Bytes
+
+	User   string `json:"user"`
+	Opened uint64 `json:"opened"`
+	Active int64  `json:"active"`
+}
+
+type ConnStats struct {
+	Bytes
+
+	ID      uint64    `json:"id"`
+	User    string    `json:"user"`
+	Session uint64    `json:"session"`
+	Net     string    `json:"net"`
+	Target  string    `json:"target"`
+	Opened  time.Time `json:"opened"`
+}
+
+// Record is the usage of one user during one flush interval.
+type Record struct {
+	Bytes
+
+	Time time.Time `json:"time"`
+	User string    `json:"user"`
+}
+
+// FileSink appends records to a file as JSON lines.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
@@ -0,0 +1,43 @@
+package acct
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+)
+
+// NewFileSink opens path for appending, creating it when missing.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{
+		file: file,
+	}, nil
+}
+
+// Write appends the records as JSON lines in a single write, so a failed flush rarely leaves a partial batch.
+func (s *FileSink) Write(records []*Record) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.file.Write(buf.Bytes())
+
+	return err
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
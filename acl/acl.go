@@ -0,0 +1,238 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// New compiles the rules, def is the action taken when no rule matches.
+func New(def string, rules []*Rule) (*Policy, error) {
+	if def == "" {
+		def = ALLOW
+	}
+
+	if def != ALLOW && def != DENY {
+		return nil, fmt.Errorf("default: must be %s or %s, got %q", ALLOW, DENY, def)
+	}
+
+	p := &Policy{
+		allow: def == ALLOW,
+		rules: make([]*rule, 0, len(rules)),
+	}
+
+	for i, r := range rules {
+		if errs := r.Validate(); len(errs) > 0 {
+			return nil, fmt.Errorf("rules[%d].%s: %s", i, errs[0].Field, errs[0].Msg)
+		}
+
+		p.rules = append(p.rules, r.compile())
+	}
+
+	return p, nil
+}
+
+// Check returns whether the request is allowed. When the first matching rule
+// depends on the destination IP and req.IP is not known yet, decided is false
+// and the check must be repeated once the host has been resolved.
+func (p *Policy) Check(req *Request) (allow bool, decided bool) {
+	if p == nil {
+		return true, true
+	}
+
+	ip := req.IP
+	host := normalize(req.Host)
+
+	if literal := net.ParseIP(host); literal != nil {
+		host = ""
+
+		if ip == nil {
+			ip = literal
+		}
+	}
+
+	for _, r := range p.rules {
+		if !r.matches(req, host) {
+			continue
+		}
+
+		if len(r.nets) > 0 {
+			if ip == nil {
+				return false, false
+			}
+
+			if !slices.ContainsFunc(r.nets, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+				continue
+			}
+		}
+
+		return r.allow, true
+	}
+
+	return p.allow, true
+}
+
+// Allowed is Check for resolved requests, an undecided result is a denial.
+func (p *Policy) Allowed(req *Request) bool {
+	allow, decided := p.Check(req)
+	return allow && decided
+}
+
+// Validate reports every invalid field of the rule.
+func (r *Rule) Validate() []*RuleErr {
+	var errs []*RuleErr
+
+	add := func(field string, format string, a ...any) {
+		errs = append(errs, &RuleErr{Field: field, Msg: fmt.Sprintf(format, a...)})
+	}
+
+	if r.Action != ALLOW && r.Action != DENY {
+		add("action", "must be %s or %s, got %q", ALLOW, DENY, r.Action)
+	}
+
+	for i, proto := range r.Protocols {
+		if proto != "tcp" && proto != "udp" {
+			add(fmt.Sprintf("protocols[%d]", i), "unsupported protocol %q, must be tcp or udp", proto)
+		}
+	}
+
+	for i, domain := range r.Domains {
+		if _, err := path.Match(domain, ""); err != nil || normalize(domain) == "" {
+			add(fmt.Sprintf("domains[%d]", i), "invalid domain pattern %q", domain)
+		}
+	}
+
+	for i, cidr := range r.CIDRs {
+		if _, err := parseCIDR(cidr); err != nil {
+			add(fmt.Sprintf("cidrs[%d]", i), "invalid CIDR %q", cidr)
+		}
+	}
+
+	for i, ports := range r.Ports {
+		if _, err := parsePorts(ports); err != nil {
+			add(fmt.Sprintf("ports[%d]", i), "%s", err.Error())
+		}
+	}
+
+	for i, cidr := range r.Sources {
+		if _, err := parseCIDR(cidr); err != nil {
+			add(fmt.Sprintf("sources[%d]", i), "invalid CIDR %q", cidr)
+		}
+	}
+
+	return errs
+}
+
+func (e *RuleErr) Error() string {
+	return e.Field + ": " + e.Msg
+}
+
+func (r *Rule) compile() *rule {
+	c := &rule{
+		allow:  r.Action == ALLOW,
+		users:  r.Users,
+		protos: r.Protocols,
+	}
+
+	for _, domain := range r.Domains {
+		c.domains = append(c.domains, normalize(domain))
+	}
+
+	for _, cidr := range r.CIDRs {
+		n, _ := parseCIDR(cidr)
+		c.nets = append(c.nets, n)
+	}
+
+	for _, ports := range r.Ports {
+		p, _ := parsePorts(ports)
+		c.ports = append(c.ports, p)
+	}
+
+	for _, cidr := range r.Sources {
+		n, _ := parseCIDR(cidr)
+		c.sources = append(c.sources, n)
+	}
+
+	return c
+}
+
+// matches checks every field except the CIDRs, host is empty for IP literals.
+func (r *rule) matches(req *Request, host string) bool {
+	if len(r.users) > 0 && !slices.Contains(r.users, req.User) {
+		return false
+	}
+
+	if len(r.protos) > 0 && !slices.Contains(r.protos, req.Proto) {
+		return false
+	}
+
+	if len(r.ports) > 0 && !slices.ContainsFunc(r.ports, func(p [2]uint16) bool { return req.Port >= p[0] && req.Port <= p[1] }) {
+		return false
+	}
+
+	if len(r.sources) > 0 && (req.Source == nil || !slices.ContainsFunc(r.sources, func(n *net.IPNet) bool { return n.Contains(req.Source) })) {
+		return false
+	}
+
+	if len(r.domains) > 0 && (host == "" || !slices.ContainsFunc(r.domains, func(d string) bool { return matchDomain(d, host) })) {
+		return false
+	}
+
+	return true
+}
+
+func matchDomain(pattern string, host string) bool {
+	// A leading dot matches the domain itself and all of its subdomains.
+	if strings.HasPrefix(pattern, ".") {
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	}
+
+	ok, _ := path.Match(pattern, host)
+	return ok
+}
+
+func normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// parseCIDR also accepts a bare IP as a single address network.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q", s)
+		}
+
+		bits := 8 * net.IPv6len
+
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+func parsePorts(s string) ([2]uint16, error) {
+	lo, hi, ranged := strings.Cut(s, "-")
+
+	if !ranged {
+		hi = lo
+	}
+
+	from, err1 := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	to, err2 := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+
+	if err1 != nil || err2 != nil || from > to {
+		return [2]uint16{}, fmt.Errorf("invalid port or range %q", s)
+	}
+
+	return [2]uint16{uint16(from), uint16(to)}, nil
+}
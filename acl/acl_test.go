@@ -0,0 +1,128 @@
+package acl
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPolicyOrder(t *testing.T) {
+	p, err := New(DENY, []*Rule{
+		{Action: DENY, CIDRs: []string{"127.0.0.0/8", "169.254.169.254"}},
+		{Action: DENY, Domains: []string{".internal.example"}},
+		{Action: ALLOW, Users: []string{"admin"}},
+		{Action: ALLOW, Protocols: []string{"tcp"}, Domains: []string{"*.example.com"}, Ports: []string{"443", "8000-8100"}},
+		{Action: ALLOW, Protocols: []string{"udp"}, CIDRs: []string{"1.1.1.1"}, Ports: []string{"53"}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		req     Request
+		allow   bool
+		decided bool
+	}{
+		{Request{User: "admin", Proto: "tcp", Host: "127.0.0.1", Port: 22}, false, true},
+		{Request{User: "admin", Proto: "tcp", Host: "db.internal.example", Port: 5432}, false, false},
+		{Request{User: "admin", Proto: "tcp", Host: "db.internal.example", IP: net.ParseIP("10.0.0.5"), Port: 5432}, false, true},
+		{Request{User: "admin", Proto: "tcp", Host: "localhost", IP: net.ParseIP("127.0.0.1"), Port: 80}, false, true},
+		{Request{User: "admin", Proto: "udp", Host: "example.org", IP: net.ParseIP("93.184.216.34"), Port: 53}, true, true},
+		{Request{User: "bob", Proto: "tcp", Host: "WWW.Example.com.", IP: net.ParseIP("93.184.216.34"), Port: 443}, true, true},
+		{Request{User: "bob", Proto: "tcp", Host: "www.example.com", IP: net.ParseIP("93.184.216.34"), Port: 8050}, true, true},
+		{Request{User: "bob", Proto: "tcp", Host: "www.example.com", IP: net.ParseIP("93.184.216.34"), Port: 80}, false, true},
+		{Request{User: "bob", Proto: "tcp", Host: "93.184.216.34", Port: 443}, false, true},
+		{Request{User: "bob", Proto: "udp", Host: "1.1.1.1", Port: 53}, true, true},
+		{Request{User: "bob", Proto: "udp", Host: "::ffff:169.254.169.254", Port: 53}, false, true},
+	}
+
+	for i, c := range cases {
+		allow, decided := p.Check(&c.req)
+
+		if allow != c.allow || decided != c.decided {
+			t.Errorf("case %d: expected (%v, %v), got (%v, %v)", i, c.allow, c.decided, allow, decided)
+		}
+	}
+}
+
+func TestPolicySources(t *testing.T) {
+	p, err := New(DENY, []*Rule{
+		{Action: ALLOW, Sources: []string{"192.0.2.0/24"}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.Allowed(&Request{User: "bob", Proto: "tcp", Host: "example.com", IP: net.ParseIP("93.184.216.34"), Port: 443, Source: net.ParseIP("192.0.2.10")}) {
+		t.Fatal("expected a client in the source network to be allowed")
+	}
+
+	// Unix socket clients have no source address.
+	for _, src := range []net.IP{net.ParseIP("198.51.100.1"), nil} {
+		if p.Allowed(&Request{User: "bob", Proto: "tcp", Host: "example.com", IP: net.ParseIP("93.184.216.34"), Port: 443, Source: src}) {
+			t.Fatalf("expected source %v to be denied", src)
+		}
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	r := &Rule{
+		Action:    "drop",
+		Protocols: []string{"icmp"},
+		Domains:   []string{"[bad"},
+		CIDRs:     []string{"10.0.0.0/33"},
+		Ports:     []string{"90-80"},
+		Sources:   []string{"office"},
+	}
+
+	want := []string{"action", "protocols[0]", "domains[0]", "cidrs[0]", "ports[0]", "sources[0]"}
+	errs := r.Validate()
+
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %d", len(want), len(errs))
+	}
+
+	for i, field := range want {
+		if errs[i].Field != field {
+			t.Fatalf("expected error %d on %s, got %s", i, field, errs[i].Field)
+		}
+	}
+
+	if _, err := New(ALLOW, []*Rule{r}); err == nil {
+		t.Fatal("expected New to reject an invalid rule")
+	}
+}
+
+func TestGuard(t *testing.T) {
+	g, err := NewGuard([]string{"10.1.0.0/16", "fd00::1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"127.0.0.1":        false,
+		"::ffff:127.0.0.1": false,
+		"0.0.0.0":          false,
+		"::":               false,
+		"::1":              false,
+		"169.254.169.254":  false,
+		"172.20.0.1":       false,
+		"192.168.1.1":      false,
+		"10.2.0.1":         false,
+		"fe80::1":          false,
+		"fd12::1":          false,
+		"10.1.2.3":         true,
+		"fd00::1":          true,
+		"172.32.0.1":       true,
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+	}
+
+	for ip, allowed := range cases {
+		if err := g.Check(net.ParseIP(ip)); (err == nil) != allowed {
+			t.Errorf("%s: expected allowed %v, got %v", ip, allowed, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package acl
+
+import (
+	"errors"
+	"net"
+)
+
+const (
+	ALLOW = "allow"
+	DENY  = "deny"
+)
+
+var (
+	ErrDenied = errors.New("destination denied by policy")
+)
+
+// PRIVATE_NETS are refused by a Guard unless explicitly allowed.
+// The unspecified addresses are included since dialing them reaches the local host.
+var PRIVATE_NETS = []string{
+	"0.0.0.0/8",
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// Rule is a single allow or deny entry as written in the config file.
+// Every non-empty field must match, any entry within a field may match.
+type Rule struct {
+	Action    string   `json:"action"`
+	Users     []string `json:"users,omitempty"`
+	Protocols []string `json:"protocols,omitempty"`
+	Domains   []string `json:"domains,omitempty"` // example.com, .example.com (suffix) or *.example.com (glob)
+	CIDRs     []string `json:"cidrs,omitempty"`
+	Ports     []string `json:"ports,omitempty"`   // 443 or 8000-9000
+	Sources   []string `json:"sources,omitempty"` // Client networks, as seen after the PROXY protocol
+}
+
+// RuleErr is a validation error for a single field of a rule.
+type RuleErr struct {
+	Field string
+	Msg   string
+}
+
+// Request describes a destination a user wants to reach.
+// IP is nil until the host has been resolved, Host is empty for IP literals.
+// Source is the client address, nil for unix socket clients.
+type Request struct {
+	User   string
+	Proto  string
+	Host   string
+	IP     net.IP
+	Port   uint16
+	Source net.IP
+}
+
+// Policy evaluates rules in order, the first matching rule wins.
+type Policy struct {
+	allow bool
+	rules []*rule
+}
+
+// Guard rejects private, loopback and link-local addresses at dial time.
+type Guard struct {
+	block []*net.IPNet
+	allow []*net.IPNet
+}
+
+type rule struct {
+	allow   bool
+	users   []string
+	protos  []string
+	domains []string
+	nets    []*net.IPNet
+	ports   [][2]uint16
+	sources []*net.IPNet
+}
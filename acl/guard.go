@@ -0,0 +1,44 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"slices"
+)
+
+// NewGuard blocks PRIVATE_NETS except for the networks in allow.
+func NewGuard(allow []string) (*Guard, error) {
+	g := &Guard{}
+
+	for _, cidr := range PRIVATE_NETS {
+		n, _ := parseCIDR(cidr)
+		g.block = append(g.block, n)
+	}
+
+	for i, cidr := range allow {
+		n, err := parseCIDR(cidr)
+
+		if err != nil {
+			return nil, fmt.Errorf("allow[%d]: invalid CIDR %q", i, cidr)
+		}
+
+		g.allow = append(g.allow, n)
+	}
+
+	return g, nil
+}
+
+// Check returns ErrDenied when ip is private and not explicitly allowed.
+func (g *Guard) Check(ip net.IP) error {
+	if g == nil {
+		return nil
+	}
+
+	contains := func(n *net.IPNet) bool { return n.Contains(ip) }
+
+	if slices.ContainsFunc(g.block, contains) && !slices.ContainsFunc(g.allow, contains) {
+		return fmt.Errorf("%w: private address %s", ErrDenied, ip)
+	}
+
+	return nil
+}
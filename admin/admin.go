@@ -0,0 +1,244 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kriptun/acct"
+	"kriptun/shared"
+	"kriptun/users"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func New(conf *Config) (*API, error) {
+	if conf.Sessions == nil || conf.Acct == nil {
+		return nil, errors.New("admin: sessions and accounting are required")
+	}
+
+	if !strings.HasPrefix(conf.Addr, UNIX_PREFIX) && conf.Token == "" {
+		return nil, errors.New("admin: a token is required on TCP listeners")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	a := &API{
+		conf:   conf,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", a.sessions)
+	mux.HandleFunc("DELETE /sessions/{id}", a.killSession)
+	mux.HandleFunc("DELETE /users/{id}/sessions", a.killUser)
+	mux.HandleFunc("POST /users/{id}/disable", a.disableUser)
+	mux.HandleFunc("POST /users/{id}/enable", a.enableUser)
+	mux.HandleFunc("POST /reload", a.reload)
+
+	a.server = &http.Server{
+		Handler:           a.authorize(mux),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	return a, nil
+}
+
+func (a *API) Start() error {
+	var err error
+
+	if path, ok := strings.CutPrefix(a.conf.Addr, UNIX_PREFIX); ok {
+		// Remove a socket left behind by a previous run.
+		os.Remove(path)
+
+		a.listener, err = shared.ListenUnix(path, 0600)
+	} else {
+		a.listener, err = net.Listen("tcp", a.conf.Addr)
+	}
+
+	if err != nil {
+		a.conf.Log.Errf("Failed to start admin API: %s", err.Error())
+		return err
+	}
+
+	a.conf.Log.Inff("Admin API running on: %s", a.conf.Addr)
+
+	go func() {
+		defer a.cancel()
+		a.server.Serve(a.listener)
+	}()
+
+	return nil
+}
+
+func (a *API) Stop() error {
+	return a.server.Close()
+}
+
+func (a *API) Wait() {
+	<-a.ctx.Done()
+}
+
+func (a *API) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.conf.Token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.conf.Token)) != 1 {
+				reply(w, http.StatusUnauthorized, &Error{Error: "invalid or missing token"})
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *API) sessions(w http.ResponseWriter, r *http.Request) {
+	list := []*Session{}
+	byID := map[uint64]*Session{}
+
+	for _, s := range a.conf.Sessions.List() {
+		if user := r.URL.Query().Get("user"); user != "" && user != s.User {
+			continue
+		}
+
+		item := &Session{
+			Bytes:   s.Snapshot(),
+			ID:      s.ID,
+			User:    s.User,
+			Remote:  s.Remote,
+			Started: s.Started,
+			Conns:   []*acct.ConnStats{},
+		}
+
+		list = append(list, item)
+		byID[s.ID] = item
+	}
+
+	for _, c := range a.conf.Acct.Conns() {
+		if item, ok := byID[c.Session]; ok {
+			item.Conns = append(item.Conns, c)
+		}
+	}
+
+	reply(w, http.StatusOK, list)
+}
+
+func (a *API) killSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+
+	if err != nil {
+		reply(w, http.StatusBadRequest, &Error{Error: "invalid session ID"})
+		return
+	}
+
+	if !a.conf.Sessions.Kill(id) {
+		reply(w, http.StatusNotFound, &Error{Error: "session not found"})
+		return
+	}
+
+	a.conf.Log.Wrnf("Admin killed session: session: %d", id)
+	reply(w, http.StatusOK, &Result{Killed: 1})
+}
+
+func (a *API) killUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	killed := a.conf.Sessions.KillUser(id)
+
+	a.conf.Log.Wrnf("Admin killed sessions: user: %s | sessions: %d", id, killed)
+	reply(w, http.StatusOK, &Result{Killed: killed})
+}
+
+func (a *API) disableUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	killed, ok := a.setEnabled(w, id, false)
+
+	if !ok {
+		return
+	}
+
+	a.conf.Log.Wrnf("Admin disabled user: user: %s | sessions: %d", id, killed)
+	reply(w, http.StatusOK, &Result{Killed: killed, Message: fmt.Sprintf("user %s disabled", id)})
+}
+
+func (a *API) enableUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if _, ok := a.setEnabled(w, id, true); !ok {
+		return
+	}
+
+	a.conf.Log.Wrnf("Admin enabled user: user: %s", id)
+	reply(w, http.StatusOK, &Result{Message: fmt.Sprintf("user %s enabled", id)})
+}
+
+func (a *API) reload(w http.ResponseWriter, r *http.Request) {
+	if a.conf.Reload == nil {
+		reply(w, http.StatusNotImplemented, &Error{Error: "reload is not available"})
+		return
+	}
+
+	if err := a.conf.Reload(); err != nil {
+		reply(w, http.StatusUnprocessableEntity, &Error{Error: err.Error()})
+		return
+	}
+
+	reply(w, http.StatusOK, &Result{Message: "reloaded"})
+}
+
+// setEnabled saves the user's flag, then closes the sessions of users that are no longer active,
+// including those removed from the file since the last reload. It returns how many were closed.
+func (a *API) setEnabled(w http.ResponseWriter, id string, enabled bool) (int, bool) {
+	if a.conf.Users == nil {
+		reply(w, http.StatusNotImplemented, &Error{Error: "no users file configured"})
+		return 0, false
+	}
+
+	if a.conf.Lock != nil {
+		a.conf.Lock.Lock()
+		defer a.conf.Lock.Unlock()
+	}
+
+	// Pick up changes made with the user command since the server started.
+	if err := a.conf.Users.Reload(); err != nil {
+		reply(w, http.StatusInternalServerError, &Error{Error: err.Error()})
+		return 0, false
+	}
+
+	err := a.conf.Users.Update(id, func(u *users.User) {
+		u.Enabled = enabled
+	})
+
+	if errors.Is(err, users.ErrNotFound) {
+		reply(w, http.StatusNotFound, &Error{Error: err.Error()})
+		return 0, false
+	}
+
+	if err == nil {
+		err = a.conf.Users.Save()
+	}
+
+	if err != nil {
+		reply(w, http.StatusInternalServerError, &Error{Error: err.Error()})
+		return 0, false
+	}
+
+	// New sessions are refused by the store, existing ones are closed here.
+	return a.conf.Sessions.Prune(a.conf.Users.Active), true
+}
+
+func reply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,151 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"kriptun/acct"
+	"kriptun/auth"
+	"kriptun/server"
+	"kriptun/users"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dipakw/logs"
+)
+
+func TestSessionsAndKill(t *testing.T) {
+	sessions := server.NewSessions(nil)
+	usage := acct.New(nil)
+
+	a, b := net.Pipe()
+	defer b.Close()
+
+	sess, _, err := sessions.Add(context.Background(), &auth.Auth{ID: []byte("alice")}, a)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := usage.Open("alice", sess.ID, "tcp", "example.com:443")
+	defer conn.Close()
+
+	api, err := New(&Config{
+		Addr:     "127.0.0.1:0",
+		Token:    "secret",
+		Log:      logs.New(&logs.Config{Allow: logs.NONE}),
+		Sessions: sessions,
+		Acct:     usage,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method string, path string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		api.server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("GET", "/sessions", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+
+	rec := do("GET", "/sessions", "secret")
+	list := []*Session{}
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 1 || list[0].User != "alice" || len(list[0].Conns) != 1 || list[0].Conns[0].Target != "example.com:443" {
+		t.Fatalf("unexpected sessions: %s", rec.Body.String())
+	}
+
+	if rec := do("DELETE", "/sessions/99", "secret"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+
+	if rec := do("DELETE", "/users/alice/sessions", "secret"); rec.Code != http.StatusOK || sessions.Total() != 0 {
+		t.Fatalf("expected the session to be killed, got %d", rec.Code)
+	}
+
+	if sess.Ctx().Err() == nil {
+		t.Fatal("expected the session context to be canceled")
+	}
+
+	if rec := do("POST", "/users/alice/disable", "secret"); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without a users store, got %d", rec.Code)
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	if err := os.WriteFile(path, []byte(`{"users": [{"id": "alice", "enabled": true}, {"id": "bob", "enabled": true}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := users.Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := server.NewSessions(nil)
+
+	for _, id := range []string{"alice", "bob", "carol"} {
+		a, b := net.Pipe()
+		defer b.Close()
+
+		if _, _, err := sessions.Add(context.Background(), &auth.Auth{ID: []byte(id)}, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Bob is removed with the user command while the server runs.
+	if err := os.WriteFile(path, []byte(`{"users": [{"id": "alice", "enabled": true}, {"id": "carol", "enabled": true}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	api, err := New(&Config{
+		Addr:     "127.0.0.1:0",
+		Token:    "secret",
+		Log:      logs.New(&logs.Config{Allow: logs.NONE}),
+		Sessions: sessions,
+		Acct:     acct.New(nil),
+		Users:    store,
+		Lock:     &sync.Mutex{},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/users/alice/disable", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rec := httptest.NewRecorder()
+	api.server.Handler.ServeHTTP(rec, req)
+
+	res := &Result{}
+
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("expected the user to be disabled, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if res.Killed != 2 || sessions.Count("alice") != 0 || sessions.Count("bob") != 0 || sessions.Count("carol") != 1 {
+		t.Fatalf("expected the sessions of alice and bob to be closed, got %d killed", res.Killed)
+	}
+
+	if saved, err := users.Open(path); err != nil || saved.Active("alice") || !saved.Active("carol") {
+		t.Fatalf("expected alice to be saved as disabled, got %v", err)
+	}
+}
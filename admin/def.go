@@ -0,0 +1,73 @@
+package admin
+
+import (
+	"context"
+	"kriptun/acct"
+	"kriptun/server"
+	"kriptun/users"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dipakw/logs"
+)
+
+const (
+	// UNIX_PREFIX selects a unix socket in Config.Addr, e.g. unix:/run/kriptun/admin.sock
+	UNIX_PREFIX = "unix:"
+)
+
+type Config struct {
+	// Addr is a loopback host:port, or a unix socket path prefixed with UNIX_PREFIX.
+	Addr string
+
+	// Token is required as "Authorization: Bearer <token>", optional on unix sockets.
+	Token string
+
+	Log      logs.Log
+	Sessions *server.Sessions
+	Acct     *acct.Accountant
+	Users    *users.Store
+
+	// Lock is held while the users file is reloaded and saved, it is shared with Reload.
+	Lock sync.Locker
+
+	// Reload re-reads users and policies, the endpoint is disabled when nil.
+	Reload func() error
+}
+
+// API serves the admin endpoints:
+//
+//	GET    /sessions                 list live sessions with their connections
+//	DELETE /sessions/{id}            kill a session
+//	DELETE /users/{id}/sessions      kill every session of a user
+//	POST   /users/{id}/disable       disable a user and kill its sessions
+//	POST   /users/{id}/enable        enable a user again
+//	POST   /reload                   reload users, policies and limits
+type API struct {
+	conf     *Config
+	server   *http.Server
+	listener net.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+type Session struct {
+	acct.Bytes
+
+	ID      uint64            `json:"id"`
+	User    string            `json:"user"`
+	Remote  string            `json:"remote"`
+	Started time.Time         `json:"started"`
+	Conns   []*acct.ConnStats `json:"conns"`
+}
+
+type Result struct {
+	Killed  int    `json:"killed,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type Error struct {
+	Error string `json:"error"`
+}
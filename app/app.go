@@ -1,17 +1,34 @@
 package app
 
 import (
+	"context"
 	"fmt"
-	"net"
+	"kriptun/auth"
+	"kriptun/config"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dipakw/logs"
 )
 
 func Run(version string) {
 	cmd := "start"
 
 	cli := NewCli(map[string]string{
-		"host": "::",
-		"port": "8890",
+		"host":     "::",
+		"port":     "8890",
+		"identity": "kriptun.key",
+		"users":    "users.json",
+		"server":   "127.0.0.1:8890",
+		"socks":    "127.0.0.1:1080",
+		"algo":     auth.KEY_ED25519,
+		"out":      "client.key",
+
+		"rekey-bytes":    "1G",
+		"rekey-interval": "1h",
 	})
 
 	if len(os.Args) > 1 {
@@ -20,16 +37,52 @@ func Run(version string) {
 
 	switch cmd {
 	case "start", "s":
-		addr := net.JoinHostPort(cli.Get("host").Value(), cli.Get("port").Value())
-		srv, err := runServer("tcp", addr)
+		conf, err := serverConfig(cli)
 
 		if err != nil {
 			fmt.Println("Error:", err)
 			os.Exit(1)
 		}
 
-		if srv.Start() == nil {
-			srv.Wait()
+		runners, rl, err := runServer(cli, conf)
+
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+
+		if err := serve(runners, conf.Timeouts.Shutdown.Value(), rl.Reload); err != nil {
+			os.Exit(1)
+		}
+
+	case "config":
+		if err := runConfig(cli); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+
+	case "client", "c":
+		runners, err := runClient(cli)
+
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+
+		if err := serve(runners, 0, nil); err != nil {
+			os.Exit(1)
+		}
+
+	case "user", "u":
+		if err := runUser(cli); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+
+	case "keygen":
+		if err := runKeygen(cli); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
 		}
 
 	case "version", "v":
@@ -42,3 +95,98 @@ func Run(version string) {
 		fmt.Println("Unknown command: " + cmd)
 	}
 }
+
+// serve starts the runners and waits for them, or for SIGINT or SIGTERM.
+// On a signal, drainers get up to grace to finish, then every runner is stopped.
+// A second signal exits immediately. SIGHUP calls reload when it is not nil.
+func serve(runners []runner, grace time.Duration, reload func() error) error {
+	started := []runner{}
+
+	stopAll := func() {
+		for i := len(started) - 1; i >= 0; i-- {
+			started[i].Stop()
+		}
+	}
+
+	for _, r := range runners {
+		if err := r.Start(); err != nil {
+			stopAll()
+			return err
+		}
+
+		started = append(started, r)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	done := make(chan struct{})
+
+	go func() {
+		for _, r := range runners {
+			r.Wait()
+		}
+
+		close(done)
+	}()
+
+	hup := make(chan os.Signal, 1)
+
+	if reload != nil {
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+
+wait:
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-hup:
+			// Errors are logged by reload, the running configuration is kept.
+			reload()
+		case <-ctx.Done():
+			stop()
+			break wait
+		}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	var wg sync.WaitGroup
+
+	for _, r := range runners {
+		if d, ok := r.(drainer); ok {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				d.Shutdown(shutdownCtx)
+			}()
+		}
+	}
+
+	wg.Wait()
+	stopAll()
+
+	return nil
+}
+
+func newLogger(conf *config.Log) logs.Log {
+	out := &logs.Out{
+		Target: os.Stdout,
+		Color:  conf.Color,
+	}
+
+	if conf.File != "" {
+		out = &logs.Out{
+			File: conf.File,
+		}
+	}
+
+	return logs.New(&logs.Config{
+		Allow: config.LOG_LEVELS[conf.Level],
+		Outs:  []*logs.Out{out},
+	})
+}
@@ -2,7 +2,9 @@ package app
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -13,19 +15,106 @@ Usage:
 Commands:
   version, v   Show version
   start, s     Start the server (default)
+  client, c    Start the local SOCKS5/HTTP proxy client
+  user, u      Manage users: add|del|passwd|key|limit <id>, list
+  keygen       Create a client key pair: kriptun keygen [--algo=ed25519] [--out=client.key]
+  config       Validate or print the server config: check|print
   help, h      Show this help message
 
-Options:
-  --host, -h    Server host (default: ::)
-  --port, -p    Server port (default: 14000)
+Server options:
+  --config         Server config file (JSON), see: kriptun config print
+  --host, -h       Server host (default: ::)
+  --port, -p       Server port (default: 8890)
+  --identity       Server identity key file, created if missing (default: kriptun.key)
+  --users          Users file (default: users.json)
+
+User options:
+  --password       Password to set, a random one is generated if omitted
+  --pubkey         Public key file or "<algo>:<base64>", the user signs in with the private key instead
+  --proto          Comma separated allowed protocols: tcp,udp (default: all)
+  --expires        Expiry date, YYYY-MM-DD or RFC3339
+  --disabled       Add the user disabled
+  --up-rate        Upload rate for all connections of the user, e.g. 1M (bytes per second)
+  --down-rate      Download rate for all connections of the user
+  --conn-up-rate   Upload rate per connection
+  --conn-down-rate Download rate per connection
+  --daily          Daily traffic quota, e.g. 10G (0 uses the server default, "unlimited" lifts it)
+  --monthly        Monthly traffic quota, e.g. 200G
+
+Client options:
+  --server         Kriptun server address or unix:/path (default: 127.0.0.1:8890)
+  --user           Kriptun username
+  --pass           Kriptun password
+  --key            Private key file from kriptun keygen, used instead of --pass
+  --server-fp      Comma separated trusted server fingerprints (SHA256:...)
+  --known-hosts    Trust-on-first-use known hosts file (default: kriptun/known_hosts in the user config dir)
+  --insecure       Accept any server identity when no fingerprint or known hosts file is given
+  --require-hybrid Refuse servers that do not offer the X25519 + ML-KEM key exchange
+  --rekey-bytes    Move to a fresh traffic key after this many bytes, 0 disables it (default: 1G)
+  --rekey-interval Move to a fresh traffic key after this long, 0 disables it (default: 1h)
+  --no-mux         Open a separate session for every connection
+  --transport      Transport to the server: tcp, tls or wss (default: tcp)
+  --tls-sni        TLS server name (default: the server host)
+  --tls-ca         PEM file with the CA that signed the server certificate (default: system roots)
+  --tls-insecure   Skip TLS certificate checks, the server identity is still verified
+  --ws-path        WebSocket request path (default: /)
+  --socks          SOCKS5 listen address (default: 127.0.0.1:1080)
+  --socks-user     Require this SOCKS5 username
+  --socks-pass     Require this SOCKS5 password
+  --http           HTTP proxy listen address (disabled by default)
+  --http-user      Require this HTTP proxy username
+  --http-pass      Require this HTTP proxy password
+
+Keygen options:
+  --algo           ed25519, ml-dsa-44, ml-dsa-65 or ml-dsa-87 (default: ed25519, ML-DSA needs a Go 1.27 build)
+  --out            Private key file, the public key is written next to it with .pub (default: client.key)
 
 Notes:
   - All options can use either --long or -short forms.
+  - The server reloads users, policies and limits on SIGHUP.
 `)
 
 var parseArgs = map[string]bool{
-	"--host": true,
-	"--port": true,
+	"--host":           true,
+	"--port":           true,
+	"--config":         true,
+	"--identity":       true,
+	"--users":          true,
+	"--password":       true,
+	"--pubkey":         true,
+	"--key":            true,
+	"--algo":           true,
+	"--out":            true,
+	"--proto":          true,
+	"--expires":        true,
+	"--disabled":       true,
+	"--up-rate":        true,
+	"--down-rate":      true,
+	"--conn-up-rate":   true,
+	"--conn-down-rate": true,
+	"--daily":          true,
+	"--monthly":        true,
+	"--server-fp":      true,
+	"--known-hosts":    true,
+	"--insecure":       true,
+	"--no-mux":         true,
+	"--require-hybrid": true,
+	"--rekey-bytes":    true,
+	"--rekey-interval": true,
+	"--transport":      true,
+	"--tls-sni":        true,
+	"--tls-ca":         true,
+	"--tls-insecure":   true,
+	"--ws-path":        true,
+	"--server":         true,
+	"--user":           true,
+	"--pass":           true,
+	"--socks":          true,
+	"--socks-user":     true,
+	"--socks-pass":     true,
+	"--http":           true,
+	"--http-user":      true,
+	"--http-pass":      true,
 }
 
 var parseArgsShort = map[string]bool{
@@ -42,12 +131,18 @@ func NewCli(defaultOpts map[string]string) *Cli {
 	args := os.Args[1:]
 
 	main := ""
+	positional := []string{}
 	opts := map[string]*ValName{}
 
 	if len(args) > 0 {
 		main = args[0]
 
 		for i := 1; i < len(args); i++ {
+			if !strings.HasPrefix(args[i], "-") {
+				positional = append(positional, args[i])
+				continue
+			}
+
 			parts := strings.SplitN(args[i], "=", 2)
 			key := parts[0]
 			val := ""
@@ -75,6 +170,7 @@ func NewCli(defaultOpts map[string]string) *Cli {
 
 	return &Cli{
 		main:        main,
+		args:        positional,
 		opts:        opts,
 		defaultOpts: defaultOpts,
 	}
@@ -89,6 +185,15 @@ func (c *Cli) Help(message string) {
 	fmt.Println(cli_doc)
 }
 
+// Arg returns the positional argument at i, not counting the command.
+func (c *Cli) Arg(i int) string {
+	if i < len(c.args) {
+		return c.args[i]
+	}
+
+	return ""
+}
+
 func (c *Cli) Get(key string) *CliArg {
 	val := ""
 	name := "--" + key
@@ -125,3 +230,36 @@ func (c *CliArg) Value() string {
 
 	return c.Default
 }
+
+// List splits a comma separated value, dropping empty items.
+func (c *CliArg) List() []string {
+	var list []string
+
+	for _, item := range strings.Split(c.Value(), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// Size parses a byte count with an optional K, M, G or T suffix (powers of 1024).
+func (c *CliArg) Size() (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(c.Value()))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := uint64(1)
+
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		mult = 1 << (10 * (strings.IndexByte("KMGT", s[i]) + 1))
+		s = s[:i]
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+
+	if err != nil || n > math.MaxUint64/mult {
+		return 0, fmt.Errorf("invalid size for %s: %s", c.Name, c.Value())
+	}
+
+	return n * mult, nil
+}
@@ -0,0 +1,185 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"kriptun/auth"
+	"kriptun/client"
+	"kriptun/config"
+	"kriptun/shared"
+	"kriptun/transport"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func runClient(cli *Cli) ([]runner, error) {
+	server := &shared.Addr{
+		Net:  "tcp",
+		Addr: cli.Get("server").Value(),
+	}
+
+	// A local server can be reached through its unix socket listener.
+	if path, ok := strings.CutPrefix(server.Addr, "unix:"); ok {
+		server.Net, server.Addr = "unix", path
+	}
+
+	tr, err := clientTransport(cli)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rekey, err := clientRekey(cli)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hosts, err := knownHosts(cli)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var key *auth.PrivateKey
+
+	if path := cli.Get("key").Value(); path != "" {
+		if key, err = auth.LoadPrivateKey(path); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := client.New(&client.Config{
+		Log:      newLogger(config.Default().Log),
+		Username: cli.Get("user").Value(),
+		Password: cli.Get("pass").Value(),
+		Key:      key,
+
+		ServerFingerprints: cli.Get("server-fp").List(),
+		KnownHosts:         hosts,
+		Insecure:           cli.Get("insecure").Passed,
+		NoMux:              cli.Get("no-mux").Passed,
+		RequireHybrid:      cli.Get("require-hybrid").Passed,
+		Rekey:              rekey,
+
+		Server:    server,
+		Transport: tr,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	socks, err := client.NewSocks(c, &client.SocksConfig{
+		Bind:     cli.Get("socks").Value(),
+		Username: cli.Get("socks-user").Value(),
+		Password: cli.Get("socks-pass").Value(),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	runners := []runner{socks}
+
+	if bind := cli.Get("http").Value(); bind != "" {
+		proxy, err := client.NewHTTP(c, &client.HTTPConfig{
+			Bind:     bind,
+			Username: cli.Get("http-user").Value(),
+			Password: cli.Get("http-pass").Value(),
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		runners = append(runners, proxy)
+	}
+
+	return runners, nil
+}
+
+// knownHosts returns the known hosts file, kriptun/known_hosts in the user config dir by default so
+// the server identity is pinned on first use. None is needed with fingerprints or --insecure.
+func knownHosts(cli *Cli) (string, error) {
+	if path := cli.Get("known-hosts").Value(); path != "" {
+		return path, nil
+	}
+
+	if len(cli.Get("server-fp").List()) > 0 || cli.Get("insecure").Passed {
+		return "", nil
+	}
+
+	dir, err := os.UserConfigDir()
+
+	if err != nil {
+		return "", fmt.Errorf("%w, pass --known-hosts, --server-fp or --insecure", err)
+	}
+
+	dir = filepath.Join(dir, "kriptun")
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "known_hosts"), nil
+}
+
+// clientRekey reads the rekey thresholds, 0 disables either.
+func clientRekey(cli *Cli) (*shared.Rekey, error) {
+	n, err := cli.Get("rekey-bytes").Size()
+
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := time.ParseDuration(cli.Get("rekey-interval").Value())
+
+	if err != nil || d < 0 {
+		return nil, fmt.Errorf("invalid duration for --rekey-interval: %s", cli.Get("rekey-interval").Value())
+	}
+
+	return &shared.Rekey{Bytes: n, Interval: d}, nil
+}
+
+func clientTransport(cli *Cli) (*transport.ClientConfig, error) {
+	kind := cli.Get("transport").Value()
+
+	switch kind {
+	case "", transport.TCP:
+		return nil, nil
+	case transport.TLS, transport.WSS:
+	default:
+		return nil, fmt.Errorf("%w: %s, must be tcp, tls or wss", transport.ErrUnknown, kind)
+	}
+
+	conf := &tls.Config{
+		ServerName: cli.Get("tls-sni").Value(),
+
+		// The kriptun handshake pins the server identity either way.
+		InsecureSkipVerify: cli.Get("tls-insecure").Passed,
+	}
+
+	if path := cli.Get("tls-ca").Value(); path != "" {
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		conf.RootCAs = x509.NewCertPool()
+
+		if !conf.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", path)
+		}
+	}
+
+	return &transport.ClientConfig{
+		Kind: kind,
+		TLS:  conf,
+		Path: cli.Get("ws-path").Value(),
+	}, nil
+}
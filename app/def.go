@@ -2,11 +2,18 @@ package app
 
 import (
 	"context"
+	"kriptun/limit"
+	"kriptun/server"
+	"kriptun/users"
 	"sync"
+	"sync/atomic"
+
+	"github.com/dipakw/logs"
 )
 
 type Cli struct {
 	main        string
+	args        []string
 	opts        map[string]*ValName
 	defaultOpts map[string]string
 }
@@ -34,3 +41,25 @@ type Server struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 }
+
+type runner interface {
+	Start() error
+	Stop() error
+	Wait()
+}
+
+// reloader swaps the reloadable parts of the server configuration.
+type reloader struct {
+	cli      *Cli
+	log      logs.Log
+	mu       sync.Mutex
+	store    *users.Store
+	sessions *server.Sessions
+	server   *server.Server
+	defaults atomic.Pointer[limit.Limits]
+}
+
+// drainer is a runner that can finish its work before stopping.
+type drainer interface {
+	Shutdown(ctx context.Context) error
+}
@@ -0,0 +1,40 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"kriptun/auth"
+	"os"
+)
+
+func runKeygen(cli *Cli) error {
+	out := cli.Get("out").Value()
+
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("%s already exists", out)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	key, err := auth.GenerateKey(cli.Get("algo").Value())
+
+	if err != nil {
+		return err
+	}
+
+	if err := key.Save(out); err != nil {
+		return err
+	}
+
+	pub := key.Public().String()
+
+	if err := os.WriteFile(out+".pub", []byte(pub+"\n"), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Private key: %s\n", out)
+	fmt.Printf("Public key: %s.pub\n", out)
+	fmt.Printf("Add it on the server with: kriptun user add <id> --pubkey=%s.pub\n", out)
+
+	return nil
+}
@@ -1,38 +1,333 @@
 package app
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kriptun/acct"
+	"kriptun/acl"
+	"kriptun/admin"
+	"kriptun/auth"
+	"kriptun/config"
+	"kriptun/limit"
+	"kriptun/metrics"
+	"kriptun/proxyproto"
 	"kriptun/server"
 	"kriptun/shared"
-	"os"
-
-	"github.com/dipakw/logs"
+	"kriptun/transport"
+	"kriptun/users"
+	"net"
 )
 
-func runServer(network, addr string) (*server.Server, error) {
-	logger := logs.New(&logs.Config{
-		Allow: logs.ALL,
-		Outs: []*logs.Out{
+// serverConfig loads --config, or the defaults, and applies the command line overrides.
+func serverConfig(cli *Cli) (*config.Config, error) {
+	conf := config.Default()
+
+	if path := cli.Get("config"); path.Passed {
+		var err error
+
+		if conf, err = config.Load(path.Value()); err != nil {
+			return nil, err
+		}
+	}
+
+	if host, port := cli.Get("host"), cli.Get("port"); host.Passed || port.Passed {
+		conf.Listeners = []*config.Listener{
 			{
-				Target: os.Stdout,
-				Color:  true,
+				Net:  "tcp",
+				Addr: net.JoinHostPort(host.Value(), port.Value()),
 			},
+		}
+	}
+
+	if identity := cli.Get("identity"); identity.Passed {
+		conf.Identity = identity.Value()
+	}
+
+	if file := cli.Get("users"); file.Passed {
+		conf.Users.File = file.Value()
+	}
+
+	return conf, conf.Validate()
+}
+
+// runServer returns the admin and metrics listeners, the server bound to every listener,
+// the usage accountant and the limiter, and the reloader for SIGHUP.
+func runServer(cli *Cli, conf *config.Config) ([]runner, *reloader, error) {
+	key, err := auth.LoadOrCreateIdentity(conf.Identity)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store, err := users.Open(conf.Users.File)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger := newLogger(conf.Log)
+
+	if store.Len() == 0 {
+		logger.Wrnf("No users found in %s, add one with: kriptun user add <id>", conf.Users.File)
+	}
+
+	policy, err := acl.New(conf.Policies.Default, conf.Policies.Rules)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accounting := &acct.Config{
+		Interval: conf.Accounting.Interval.Value(),
+		Log:      logger,
+	}
+
+	if conf.Accounting.File != "" {
+		sink, err := acct.NewFileSink(conf.Accounting.File)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		accounting.Sink = sink
+	}
+
+	usage := acct.New(accounting)
+
+	sessions := server.NewSessions(sessionsConfig(conf))
+
+	rl := &reloader{
+		cli:      cli,
+		log:      logger,
+		store:    store,
+		sessions: sessions,
+	}
+
+	rl.defaults.Store(conf.Limits.Defaults)
+
+	limiter, err := limit.New(&limit.Config{
+		State: conf.Limits.State,
+
+		LimitsFN: func(id string) *limit.Limits {
+			if u := store.Get(id); u != nil {
+				return rl.defaults.Load().Merge(u.Limits)
+			}
+
+			return nil
 		},
 	})
 
-	return server.New(&server.Config{
-		Log: logger,
+	if err != nil {
+		return nil, nil, err
+	}
 
-		Bind: &shared.Addr{
-			Net:  network,
-			Addr: addr,
-		},
+	runners := []runner{}
 
-		PwFN: func(id string) ([]byte, error) {
-			return []byte("password"), nil
-		},
+	var collectors *server.Metrics
+
+	if addr := conf.Metrics.Addr; addr != "" {
+		reg := metrics.NewRegistry()
+		collectors = server.NewMetrics(reg, sessions, usage)
+		runners = append(runners, metrics.NewServer(addr, reg, logger))
+
+		logger.Inff("Metrics endpoint: http://%s/metrics", addr)
+	}
+
+	if conf.Admin.Addr != "" {
+		api, err := admin.New(&admin.Config{
+			Addr:     conf.Admin.Addr,
+			Token:    conf.Admin.Token,
+			Log:      logger,
+			Sessions: sessions,
+			Acct:     usage,
+			Users:    store,
+			Lock:     &rl.mu,
+			Reload:   rl.Reload,
+		})
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		runners = append(runners, api)
+	}
+
+	listeners := make([]*server.Listener, len(conf.Listeners))
+
+	for i, l := range conf.Listeners {
+		listeners[i] = &server.Listener{
+			Net:  l.Net,
+			Addr: l.Addr,
+			Mode: l.FileMode(),
+		}
+
+		if l.Transport != "" && l.Transport != transport.TCP {
+			cert, err := tls.LoadX509KeyPair(l.Cert, l.Key)
+
+			if err != nil {
+				return nil, nil, fmt.Errorf("listeners[%d]: %w", i, err)
+			}
+
+			listeners[i].Transport = &transport.ServerConfig{
+				Kind: l.Transport,
+				TLS:  &tls.Config{Certificates: []tls.Certificate{cert}},
+				Path: l.Path,
+			}
+		}
 
-		ProtoFN: func(id string, proto string) bool {
-			return proto == "tcp" || proto == "udp"
+		if len(l.ProxyProtocol) > 0 {
+			trusted, err := proxyproto.ParseTrusted(l.ProxyProtocol)
+
+			if err != nil {
+				return nil, nil, fmt.Errorf("listeners[%d]: %w", i, err)
+			}
+
+			listeners[i].Proxy = &proxyproto.Config{Trusted: trusted}
+		}
+
+		// An explicit zero disables keep-alives, the server reads zero as the system default.
+		if l.KeepAlive != "" {
+			if listeners[i].KeepAlive = l.KeepAlive.Value(); listeners[i].KeepAlive == 0 {
+				listeners[i].KeepAlive = -1
+			}
+		}
+	}
+
+	srv, err := server.New(&server.Config{
+		Listeners: listeners,
+		Log:       logger,
+		Identity:  key,
+		Users:     store,
+
+		Auth: &server.AuthConfig{
+			Bits:          conf.Auth.Bits,
+			Timeout:       conf.Auth.Timeout.Value(),
+			MinSigSize:    conf.Auth.MinSigSize,
+			MaxSigSize:    conf.Auth.MaxSigSize,
+			MinIdMetaSize: conf.Auth.MinIdMetaSize,
+			MaxIdMetaSize: conf.Auth.MaxIdMetaSize,
+			DelayOnAuth:   conf.Auth.DelayOnAuth.Value(),
+			Hybrid:        conf.Auth.Hybrid,
 		},
+
+		RequestTimeout: conf.Timeouts.Request.Value(),
+		Rekey:          &shared.Rekey{Bytes: conf.Rekey.Bytes, Interval: conf.Rekey.Interval.Value()},
+		Protocols:      conf.Policies.Protocols,
+		Policy:         policy,
+		AllowPrivate:   conf.Policies.AllowPrivate,
+		Acct:           usage,
+		Limiter:        limiter,
+		Sessions:       sessions,
+		Metrics:        collectors,
 	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rl.server = srv
+
+	runners = append(runners, srv)
+
+	return append(runners, usage, limiter), rl, nil
+}
+
+func runConfig(cli *Cli) error {
+	switch cli.Arg(0) {
+	case "check":
+		conf, err := serverConfig(cli)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Config OK: %d listener(s), users: %s\n", len(conf.Listeners), conf.Users.File)
+
+	case "print":
+		conf, err := serverConfig(cli)
+
+		if err != nil {
+			return err
+		}
+
+		data, err := json.MarshalIndent(conf, "", "  ")
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(data))
+
+	default:
+		return errors.New("usage: kriptun config <check|print> [--config=path]")
+	}
+
+	return nil
+}
+
+// Reload re-reads the config file and the users file, then swaps in the users, policies,
+// limits and session limits. Listeners, identity, auth and file locations need a restart.
+// Everything is loaded and validated first, a failed reload changes nothing.
+func (r *reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conf, err := serverConfig(r.cli)
+
+	if err != nil {
+		r.log.Errf("Failed to reload config: %s", err.Error())
+		return err
+	}
+
+	policy, err := acl.New(conf.Policies.Default, conf.Policies.Rules)
+
+	if err != nil {
+		r.log.Errf("Failed to reload policies: %s", err.Error())
+		return err
+	}
+
+	policies := &server.Policies{
+		Protocols:    conf.Policies.Protocols,
+		Policy:       policy,
+		AllowPrivate: conf.Policies.AllowPrivate,
+	}
+
+	if err := policies.Validate(); err != nil {
+		r.log.Errf("Failed to reload policies: %s", err.Error())
+		return err
+	}
+
+	fresh, err := users.Open(r.store.Path())
+
+	if err != nil {
+		r.log.Errf("Failed to reload users: %s", err.Error())
+		return err
+	}
+
+	// Validated above, so this is not expected to fail. It goes first so that nothing is applied if it does.
+	if err := r.server.SetPolicies(policies); err != nil {
+		r.log.Errf("Failed to reload policies: %s", err.Error())
+		return err
+	}
+
+	r.store.Replace(fresh)
+	r.defaults.Store(conf.Limits.Defaults)
+	r.sessions.SetConfig(sessionsConfig(conf))
+
+	// Sessions of users that were removed or disabled are closed.
+	closed := r.sessions.Prune(r.store.Active)
+
+	r.log.Inff("Reloaded: users: %d | rules: %d | closed sessions: %d", r.store.Len(), len(conf.Policies.Rules), closed)
+
+	return nil
+}
+
+func sessionsConfig(conf *config.Config) *server.SessionsConfig {
+	return &server.SessionsConfig{
+		MaxPerUser: conf.Sessions.MaxPerUser,
+		MaxTotal:   conf.Sessions.MaxTotal,
+		Evict:      conf.Sessions.OnLimit == "evict",
+	}
 }
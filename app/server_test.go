@@ -0,0 +1,138 @@
+package app
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"kriptun/auth"
+	"kriptun/limit"
+	"kriptun/server"
+	"kriptun/users"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dipakw/logs"
+)
+
+func testReloader(t *testing.T) (*reloader, string, string) {
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "kriptun.json")
+	usersPath := filepath.Join(dir, "users.json")
+
+	writeReloadFiles(t, confPath, usersPath, 1, `{"id": "alice", "secret": "pw", "enabled": true}, {"id": "bob", "secret": "pw", "enabled": true}`)
+
+	store, err := users.Open(usersPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, identity, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := logs.New(&logs.Config{Allow: logs.NONE})
+	sessions := server.NewSessions(nil)
+
+	srv, err := server.New(&server.Config{
+		Listeners: []*server.Listener{{Net: "tcp4", Addr: "127.0.0.1:0"}},
+		Log:       log,
+		Identity:  identity,
+		Users:     store,
+		Sessions:  sessions,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &reloader{
+		cli:      &Cli{opts: map[string]*ValName{"config": {Val: confPath, Name: "--config"}}},
+		log:      log,
+		store:    store,
+		sessions: sessions,
+		server:   srv,
+	}
+
+	r.defaults.Store(&limit.Limits{UpRate: 1})
+
+	return r, confPath, usersPath
+}
+
+func writeReloadFiles(t *testing.T, confPath string, usersPath string, upRate int, list string) {
+	conf := fmt.Sprintf(`{
+		"identity": %q,
+		"users": {"file": %q},
+		"limits": {"defaults": {"up_rate": %d}, "state": ""}
+	}`, filepath.Join(filepath.Dir(confPath), "kriptun.key"), usersPath, upRate)
+
+	if err := os.WriteFile(confPath, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(usersPath, []byte(`{"users": [`+list+`]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	r, confPath, usersPath := testReloader(t)
+
+	a, b := net.Pipe()
+	defer b.Close()
+
+	sess, _, err := r.sessions.Add(context.Background(), &auth.Auth{ID: []byte("bob")}, a)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob is removed from the file.
+	writeReloadFiles(t, confPath, usersPath, 2, `{"id": "alice", "secret": "pw", "enabled": true}`)
+
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.store.Get("bob") != nil || r.defaults.Load().UpRate != 2 {
+		t.Fatalf("expected the new users and limits, got %v %+v", r.store.List(), r.defaults.Load())
+	}
+
+	if sess.Ctx().Err() == nil || r.sessions.Total() != 0 {
+		t.Fatal("expected the session of the removed user to be closed")
+	}
+}
+
+func TestReloadFailsWhole(t *testing.T) {
+	r, confPath, usersPath := testReloader(t)
+
+	tests := map[string]func(){
+		"broken users file": func() {
+			writeReloadFiles(t, confPath, usersPath, 2, `{"id": "carol", "secret": "pw", "enabled": true}, null`)
+		},
+		"broken config": func() {
+			writeReloadFiles(t, confPath, usersPath, 2, `{"id": "carol", "secret": "pw", "enabled": true}`)
+			os.WriteFile(confPath, []byte(`{"limits": "none"}`), 0600)
+		},
+		"broken policies": func() {
+			writeReloadFiles(t, confPath, usersPath, 2, `{"id": "carol", "secret": "pw", "enabled": true}`)
+			os.WriteFile(confPath, []byte(`{"policies": {"default": "maybe"}}`), 0600)
+		},
+	}
+
+	for name, breakFiles := range tests {
+		breakFiles()
+
+		if err := r.Reload(); err == nil {
+			t.Fatalf("%s: expected the reload to fail", name)
+		}
+
+		if r.store.Get("bob") == nil || r.store.Get("carol") != nil || r.defaults.Load().UpRate != 1 {
+			t.Fatalf("%s: expected nothing to change, got %v %+v", name, r.store.List(), r.defaults.Load())
+		}
+	}
+}
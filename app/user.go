@@ -0,0 +1,348 @@
+package app
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"kriptun/auth"
+	"kriptun/limit"
+	"kriptun/shared"
+	"kriptun/users"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func runUser(cli *Cli) error {
+	store, err := users.Open(cli.Get("users").Value())
+
+	if err != nil {
+		return err
+	}
+
+	id := cli.Arg(1)
+
+	if cli.Arg(0) != "list" && id == "" {
+		return errors.New("usage: kriptun user <add|del|passwd|key|limit> <id> [options]")
+	}
+
+	switch cli.Arg(0) {
+	case "add":
+		u := &users.User{
+			ID:        id,
+			Enabled:   !cli.Get("disabled").Passed,
+			Protocols: cli.Get("proto").List(),
+		}
+
+		for _, proto := range u.Protocols {
+			if proto != "tcp" && proto != "udp" {
+				return fmt.Errorf("unsupported protocol: %s", proto)
+			}
+		}
+
+		if expires := cli.Get("expires").Value(); expires != "" {
+			if u.Expires, err = parseTime(expires); err != nil {
+				return err
+			}
+		}
+
+		if u.PublicKey, err = pubkey(cli); err != nil {
+			return err
+		}
+
+		var pw string
+
+		if u.PublicKey == "" {
+			if pw, err = secret(cli); err != nil {
+				return err
+			}
+
+			if u.Verifier, err = verifier(pw); err != nil {
+				return err
+			}
+		}
+
+		if u.Limits, err = limits(cli, nil); err != nil {
+			return err
+		}
+
+		if err := store.Add(u); err != nil {
+			return err
+		}
+
+		if err := store.Save(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Added user: %s\n", id)
+
+		if u.PublicKey == "" && !cli.Get("password").Passed {
+			fmt.Printf("Password: %s\n", pw)
+		}
+
+	case "del":
+		if err := store.Del(id); err != nil {
+			return err
+		}
+
+		if err := store.Save(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Deleted user: %s\n", id)
+
+	case "passwd":
+		pw, err := secret(cli)
+
+		if err != nil {
+			return err
+		}
+
+		v, err := verifier(pw)
+
+		if err != nil {
+			return err
+		}
+
+		err = store.Update(id, func(u *users.User) {
+			u.Verifier = v
+			u.Secret = ""
+			u.PublicKey = ""
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if err := store.Save(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Changed password: %s\n", id)
+
+		if !cli.Get("password").Passed {
+			fmt.Printf("Password: %s\n", pw)
+		}
+
+	case "key":
+		key, err := pubkey(cli)
+
+		if err != nil {
+			return err
+		}
+
+		if key == "" {
+			return errors.New("usage: kriptun user key <id> --pubkey=<file or key>")
+		}
+
+		// The password is dropped, the user can only sign in with the key from now on.
+		err = store.Update(id, func(u *users.User) {
+			u.PublicKey = key
+			u.Verifier = ""
+			u.Secret = ""
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if err := store.Save(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Changed public key: %s\n", id)
+
+	case "limit":
+		u := store.Get(id)
+
+		if u == nil {
+			return users.ErrNotFound
+		}
+
+		l, err := limits(cli, u.Limits)
+
+		if err != nil {
+			return err
+		}
+
+		err = store.Update(id, func(u *users.User) {
+			u.Limits = l
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if err := store.Save(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Limits of %s: %s\n", id, formatLimits(l))
+
+	case "list":
+		fmt.Printf("%-24s %-8s %-10s %-10s %-26s %s\n", "ID", "ENABLED", "AUTH", "PROTOCOLS", "EXPIRES", "LIMITS")
+
+		for _, u := range store.List() {
+			protocols := strings.Join(u.Protocols, ",")
+			expires := "never"
+
+			if protocols == "" {
+				protocols = "all"
+			}
+
+			if !u.Expires.IsZero() {
+				expires = u.Expires.Format(time.RFC3339)
+			}
+
+			method := "plain"
+
+			if key, err := auth.ParsePublicKey(u.PublicKey); err == nil {
+				method = key.Algo
+			} else if u.Verifier != "" {
+				method = "argon2id"
+			}
+
+			fmt.Printf("%-24s %-8t %-10s %-10s %-26s %s\n", u.ID, u.Enabled, method, protocols, expires, formatLimits(u.Limits))
+		}
+
+	default:
+		return fmt.Errorf("unknown user command: %s", cli.Arg(0))
+	}
+
+	return nil
+}
+
+// secret returns the password passed with --password, or generates a random one.
+func secret(cli *Cli) (string, error) {
+	if pw := cli.Get("password"); pw.Passed {
+		if pw.Input == "" {
+			return "", errors.New("password can not be empty")
+		}
+
+		return pw.Input, nil
+	}
+
+	buf, err := shared.Rand(18)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// verifier hashes pw, the server never stores the password itself.
+func verifier(pw string) (string, error) {
+	v, err := auth.NewVerifier([]byte(pw), auth.NewKDFParams())
+
+	if err != nil {
+		return "", err
+	}
+
+	return v.String(), nil
+}
+
+// pubkey returns the key passed with --pubkey, read from a file unless it is the key itself.
+func pubkey(cli *Cli) (string, error) {
+	arg := cli.Get("pubkey")
+
+	if !arg.Passed {
+		return "", nil
+	}
+
+	s := arg.Input
+
+	if data, err := os.ReadFile(s); err == nil {
+		s = string(data)
+	} else if !strings.Contains(s, ":") {
+		return "", err
+	}
+
+	key, err := auth.ParsePublicKey(s)
+
+	if err != nil {
+		return "", err
+	}
+
+	return key.String(), nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	return time.ParseInLocation(time.DateOnly, s, time.Local)
+}
+
+// limits applies the passed limit options on top of l, nil is returned when nothing is limited.
+func limits(cli *Cli, l *limit.Limits) (*limit.Limits, error) {
+	m := &limit.Limits{}
+
+	if l != nil {
+		*m = *l
+	}
+
+	for key, field := range limitFields(m) {
+		if arg := cli.Get(key); arg.Passed {
+			if strings.EqualFold(strings.TrimSpace(arg.Value()), "unlimited") {
+				*field = limit.UNLIMITED
+				continue
+			}
+
+			n, err := arg.Size()
+
+			if err != nil {
+				return nil, err
+			}
+
+			*field = n
+		}
+	}
+
+	if *m == (limit.Limits{}) {
+		return nil, nil
+	}
+
+	return m, nil
+}
+
+func formatLimits(l *limit.Limits) string {
+	if l == nil {
+		return "default"
+	}
+
+	parts := []string{}
+
+	for _, key := range []string{"up-rate", "down-rate", "conn-up-rate", "conn-down-rate", "daily", "monthly"} {
+		if n := *limitFields(l)[key]; n == limit.UNLIMITED {
+			parts = append(parts, key+"=unlimited")
+		} else if n > 0 {
+			parts = append(parts, key+"="+formatSize(n))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func limitFields(l *limit.Limits) map[string]*uint64 {
+	return map[string]*uint64{
+		"up-rate":        &l.UpRate,
+		"down-rate":      &l.DownRate,
+		"conn-up-rate":   &l.ConnUpRate,
+		"conn-down-rate": &l.ConnDownRate,
+		"daily":          &l.Daily,
+		"monthly":        &l.Monthly,
+	}
+}
+
+func formatSize(n uint64) string {
+	for i := 4; i > 0; i-- {
+		if unit := uint64(1) << (10 * i); n%unit == 0 {
+			return strconv.FormatUint(n/unit, 10) + string("KMGT"[i-1])
+		}
+	}
+
+	return strconv.FormatUint(n, 10)
+}
@@ -0,0 +1,522 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/mlkem"
+	"encoding/binary"
+	"errors"
+	"kriptun/shared"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// byteConn reads and writes a single byte per call, so every handshake
+// message is split across as many reads as possible.
+type byteConn struct {
+	net.Conn
+}
+
+func (c *byteConn) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *byteConn) Write(b []byte) (int, error) {
+	for i := range b {
+		if _, err := c.Conn.Write(b[i : i+1]); err != nil {
+			return i, err
+		}
+	}
+
+	return len(b), nil
+}
+
+func testOpts(t *testing.T, serverPw, clientPw string) (*ServerOpts, *ClientOpts) {
+	_, identity, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sopts := &ServerOpts{
+		Bits:          768,
+		Timeout:       5 * time.Second,
+		MinSigSize:    32,
+		MaxSigSize:    32,
+		MinIdMetaSize: 2,
+		MaxIdMetaSize: 256,
+		Identity:      identity,
+
+		VerifySig: func(auth *Auth, msg []byte, sig []byte) (bool, error) {
+			hash, err := shared.Hamc([]byte(serverPw), msg)
+
+			if err != nil {
+				return false, err
+			}
+
+			return bytes.Equal(hash, sig), nil
+		},
+	}
+
+	copts := &ClientOpts{
+		Bits:    768,
+		ID:      []byte("user"),
+		Meta:    map[string]string{"k": "v"},
+		Timeout: 5 * time.Second,
+
+		SignMsg: func(msg []byte) ([]byte, error) {
+			return shared.Hamc([]byte(clientPw), msg)
+		},
+
+		Insecure: true,
+	}
+
+	return sopts, copts
+}
+
+func handshake(sopts *ServerOpts, copts *ClientOpts) (*Auth, *Auth) {
+	a, b := net.Pipe()
+	ch := make(chan *Auth, 1)
+
+	go func() {
+		defer a.Close()
+		ch <- Server(&byteConn{a}, sopts)
+	}()
+
+	cres := Client(&byteConn{b}, copts)
+	b.Close()
+
+	return <-ch, cres
+}
+
+func TestHandshakeByteByByte(t *testing.T) {
+	sopts, copts := testOpts(t, "secret", "secret")
+	sres, cres := handshake(sopts, copts)
+
+	if !sres.Ok() {
+		t.Fatalf("server: %s: %v", sres.Err().Reason(), sres.Err().Main())
+	}
+
+	if !cres.Ok() {
+		t.Fatalf("client: %s: %v", cres.Err().Reason(), cres.Err().Main())
+	}
+
+	if !bytes.Equal(sres.Key, cres.Key) {
+		t.Fatal("keys do not match")
+	}
+
+	if string(sres.ID) != "user" || sres.Meta["k"] != "v" {
+		t.Fatalf("unexpected ID and meta: %s %v", sres.ID, sres.Meta)
+	}
+
+	if !bytes.Equal(cres.ServerKey, sopts.Identity.Public().(ed25519.PublicKey)) {
+		t.Fatal("server key does not match")
+	}
+}
+
+func TestHandshakeBits(t *testing.T) {
+	tests := []struct {
+		server uint16
+		client uint16
+		ok     bool
+	}{
+		{768, 0, true},
+		{1024, 0, true},
+		{1024, 1024, true},
+		{768, 1024, false},
+		{1024, 768, false},
+	}
+
+	for _, tt := range tests {
+		sopts, copts := testOpts(t, "secret", "secret")
+		sopts.Bits, copts.Bits = tt.server, tt.client
+		sopts.Hybrid, copts.Hybrid = true, true
+
+		sres, cres := handshake(sopts, copts)
+
+		if ok := sres.Ok() && cres.Ok() && bytes.Equal(sres.Key, cres.Key); ok != tt.ok {
+			t.Fatalf("server %d, client %d: expected ok %v, got server %+v client %+v", tt.server, tt.client, tt.ok, sres.Err(), cres.Err())
+		}
+	}
+}
+
+func TestHandshakeBadSignature(t *testing.T) {
+	sopts, copts := testOpts(t, "secret", "wrong")
+	sres, cres := handshake(sopts, copts)
+
+	if sres.Ok() || sres.Err().Reason() != "failed to verify the signature" {
+		t.Fatalf("server: expected signature failure, got %+v", sres.Err())
+	}
+
+	if cres.Ok() {
+		t.Fatal("client: expected failure")
+	}
+}
+
+func TestHandshakeServerMismatch(t *testing.T) {
+	sopts, copts := testOpts(t, "secret", "secret")
+	copts.ServerFingerprints = []string{Fingerprint(make([]byte, IDENTITY_KEY_SIZE))}
+
+	_, cres := handshake(sopts, copts)
+
+	if cres.Ok() || cres.Err().Reason() != REASON_SERVER_MISMATCH {
+		t.Fatalf("client: expected %q, got %+v", REASON_SERVER_MISMATCH, cres.Err())
+	}
+}
+
+func TestHandshakeNoTrustAnchor(t *testing.T) {
+	sopts, copts := testOpts(t, "secret", "secret")
+	copts.Insecure = false
+
+	if _, cres := handshake(sopts, copts); cres.Ok() || !errors.Is(cres.Err().Main(), ErrNoTrustAnchor) {
+		t.Fatalf("client: expected %v, got %+v", ErrNoTrustAnchor, cres.Err())
+	}
+}
+
+func TestHandshakeKnownHosts(t *testing.T) {
+	sopts, copts := testOpts(t, "secret", "secret")
+	copts.KnownHosts = filepath.Join(t.TempDir(), "known_hosts")
+	copts.Host = "example:8890"
+
+	// First use records the identity, the second connection must match it.
+	for i := 0; i < 2; i++ {
+		if _, cres := handshake(sopts, copts); !cres.Ok() {
+			t.Fatalf("client: %s: %v", cres.Err().Reason(), cres.Err().Main())
+		}
+	}
+
+	other, _ := testOpts(t, "secret", "secret")
+	_, cres := handshake(other, copts)
+
+	if cres.Ok() || cres.Err().Reason() != REASON_SERVER_MISMATCH {
+		t.Fatalf("client: expected %q, got %+v", REASON_SERVER_MISMATCH, cres.Err())
+	}
+}
+
+func TestHandshakeClientKeys(t *testing.T) {
+	for _, algo := range []string{KEY_ED25519, KEY_MLDSA_44, KEY_MLDSA_65, KEY_MLDSA_87} {
+		t.Run(algo, func(t *testing.T) {
+			key, err := GenerateKey(algo)
+
+			// ML-DSA is only available from Go 1.27, see mldsa_stub.go.
+			if algo != KEY_ED25519 && errors.Is(err, ErrKeyAlgo) {
+				t.Skip(err)
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(t.TempDir(), "client.key")
+
+			if err := key.Save(path); err != nil {
+				t.Fatal(err)
+			}
+
+			if key, err = LoadPrivateKey(path); err != nil || key.Algo != algo {
+				t.Fatalf("expected a %s key back, got %v", algo, err)
+			}
+
+			pub, err := ParsePublicKey(key.Public().String() + " bob@laptop")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sopts, copts := testOpts(t, "", "")
+			sopts.MaxSigSize = MAX_CLIENT_SIG_SIZE
+			sopts.VerifySig = pub.VerifySig
+			copts.SignMsg = key.SignMsg
+
+			if s, c := handshake(sopts, copts); !s.Ok() || !c.Ok() {
+				t.Fatalf("expected the handshake to succeed, server: %v, client: %v", s.Err(), c.Err())
+			}
+
+			// A signature without the kriptun context does not verify.
+			msg := []byte("challenge")
+			sig, _ := key.key.Sign(nil, msg, crypto.Hash(0))
+
+			if ok, _ := pub.VerifySig(nil, msg, sig); ok {
+				t.Fatal("expected a signature without context to be rejected")
+			}
+		})
+	}
+}
+
+func TestHandshakeVerifier(t *testing.T) {
+	params := &KDFParams{KDF: KDF_ARGON2ID, Time: 1, Memory: 1024, Threads: 1, Salt: randbytes(16)}
+
+	v, err := NewVerifier([]byte("secret"), params)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server only keeps the stored string.
+	if v, err = ParseVerifier(v.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pw := range []string{"secret", "wrong"} {
+		sopts, copts := testOpts(t, "", "")
+		sopts.VerifySig = v.VerifySig
+		sopts.Params = func(*Auth) (*KDFParams, error) { return v.Params, nil }
+		copts.SignMsg = PasswordSigner([]byte(pw))
+
+		s, c := handshake(sopts, copts)
+
+		if ok := s.Ok() && c.Ok(); ok != (pw == "secret") {
+			t.Fatalf("password %q: expected success %v, server: %v, client: %v", pw, pw == "secret", s.Err(), c.Err())
+		}
+	}
+
+	// Without parameters the signer falls back to the plain password.
+	sopts, copts := testOpts(t, "secret", "")
+	copts.SignMsg = PasswordSigner([]byte("secret"))
+
+	if s, c := handshake(sopts, copts); !s.Ok() || !c.Ok() {
+		t.Fatalf("expected the plain password to work, server: %v, client: %v", s.Err(), c.Err())
+	}
+}
+
+func TestKDFParamsBounds(t *testing.T) {
+	greedy := &KDFParams{KDF: KDF_ARGON2ID, Time: 1, Memory: KDF_MAX_MEMORY + 1, Threads: 1, Salt: randbytes(16)}
+	msg := append(randbytes(CHALLENGE_SIZE), greedy.encode()...)
+
+	if _, err := PasswordSigner([]byte("pw"))(msg); !errors.Is(err, ErrKDFParams) {
+		t.Fatalf("expected the memory bound to be enforced, got %v", err)
+	}
+
+	if _, err := ParseVerifier("$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$a2V5"); !errors.Is(err, ErrKDFParams) {
+		t.Fatalf("expected a short salt and key to be rejected, got %v", err)
+	}
+}
+
+func TestHandshakeHybrid(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  bool
+		client  bool
+		require bool
+		ok      bool
+		hybrid  bool
+	}{
+		{"both", true, true, false, true, true},
+		{"old client", true, false, false, true, false},
+		{"old server", false, true, false, true, false},
+		{"required", true, false, true, true, true},
+		{"required but not offered", false, true, true, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sopts, copts := testOpts(t, "secret", "secret")
+			sopts.Hybrid = tt.server
+			copts.Hybrid = tt.client
+			copts.RequireHybrid = tt.require
+
+			s, c := handshake(sopts, copts)
+
+			if c.Ok() != tt.ok {
+				t.Fatalf("expected success %v, server: %v, client: %v", tt.ok, s.Err(), c.Err())
+			}
+
+			if !tt.ok {
+				return
+			}
+
+			if !s.Ok() || s.Hybrid != tt.hybrid || c.Hybrid != tt.hybrid || !bytes.Equal(s.Key, c.Key) {
+				t.Fatalf("expected hybrid %v on both sides with the same key, got %v and %v", tt.hybrid, s.Hybrid, c.Hybrid)
+			}
+		})
+	}
+}
+
+func TestHandshakeKeySchedule(t *testing.T) {
+	sopts, copts := testOpts(t, "secret", "secret")
+	s, c := handshake(sopts, copts)
+
+	if !s.Ok() || !c.Ok() {
+		t.Fatalf("server: %v, client: %v", s.Err(), c.Err())
+	}
+
+	if !bytes.Equal(s.C2SKey, c.C2SKey) || !bytes.Equal(s.S2CKey, c.S2CKey) {
+		t.Fatal("traffic keys do not match")
+	}
+
+	if bytes.Equal(c.Key, c.C2SKey) || bytes.Equal(c.Key, c.S2CKey) || bytes.Equal(c.C2SKey, c.S2CKey) {
+		t.Fatal("expected distinct handshake and traffic keys")
+	}
+
+	if !s.Rekey || !c.Rekey {
+		t.Fatal("expected rekeying to be negotiated")
+	}
+
+	// Stripping the offer from the hello is caught, the server signs the hello it sent.
+	a, b := net.Pipe()
+	ch := make(chan *Auth, 1)
+
+	go func() {
+		defer a.Close()
+		ch <- Server(&stripConn{Conn: a, size: ENCAP_KEY_SIZES[768] + IDENTITY_KEY_SIZE}, sopts)
+	}()
+
+	c = Client(b, copts)
+	b.Close()
+	s = <-ch
+
+	if s.Ok() || c.Ok() {
+		t.Fatal("expected the stripped offer to fail the handshake on both sides")
+	}
+}
+
+// legacyClient speaks the handshake of clients that predate capabilities: it ignores what follows
+// the identity key, sends the bare ciphertext and uses the raw ML-KEM secret for everything.
+func legacyClient(conn net.Conn, copts *ClientOpts) ([]byte, error) {
+	hello, err := readFrame(conn, STEP_ENCAP_KEY, MAX_FRAME_SIZE, copts.Timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	size := ENCAP_KEY_SIZES[768]
+	ek, err := mlkem.NewEncapsulationKey768(hello[:size])
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, ct := ek.Encapsulate()
+
+	if err := writeFrame(conn, STEP_CIPHERTEXT, ct); err != nil {
+		return nil, err
+	}
+
+	buf, err := readFrame(conn, STEP_ACK, 256, copts.Timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ack, err := decrypt(key, buf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	idkey := hello[size : size+IDENTITY_KEY_SIZE]
+
+	if len(ack) != 10+IDENTITY_SIG_SIZE || !ed25519.Verify(idkey, identityMsg(hello[:size], idkey, ct), ack[10:]) {
+		return nil, errors.New("invalid ACK")
+	}
+
+	steps := []struct {
+		step    uint8
+		payload func(prev []byte) ([]byte, error)
+	}{
+		{STEP_ID_META, func([]byte) ([]byte, error) { return encodeIdMeta(copts.ID, copts.Meta), nil }},
+		{STEP_SIGNATURE, copts.SignMsg},
+	}
+
+	var prev []byte
+
+	for _, st := range steps {
+		payload, err := st.payload(prev)
+
+		if err == nil {
+			payload, err = encrypt(key, payload)
+		}
+
+		if err == nil {
+			err = writeFrame(conn, st.step, payload)
+		}
+
+		if err == nil {
+			buf, err = readFrame(conn, st.step+1, MAX_FRAME_SIZE, copts.Timeout)
+		}
+
+		if err == nil {
+			prev, err = decrypt(key, buf)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+func TestHandshakeLegacyClient(t *testing.T) {
+	sopts, copts := testOpts(t, "secret", "secret")
+	sopts.Hybrid = true
+
+	a, b := net.Pipe()
+	ch := make(chan *Auth, 1)
+
+	go func() {
+		defer a.Close()
+		ch <- Server(a, sopts)
+	}()
+
+	key, err := legacyClient(b, copts)
+	b.Close()
+	s := <-ch
+
+	if err != nil || !s.Ok() {
+		t.Fatalf("client: %v, server: %v", err, s.Err())
+	}
+
+	// One key is used for everything, as the old client expects.
+	if !bytes.Equal(s.Key, key) || !bytes.Equal(s.C2SKey, key) || !bytes.Equal(s.S2CKey, key) {
+		t.Fatal("expected the raw ML-KEM key for the handshake and both directions")
+	}
+
+	if s.Hybrid || s.Rekey {
+		t.Fatal("expected no capabilities for an old client")
+	}
+}
+
+// stripConn drops the capabilities from the server hello, like an active attacker would.
+type stripConn struct {
+	net.Conn
+	size int
+}
+
+func (c *stripConn) Write(b []byte) (int, error) {
+	if len(b) > FRAME_HEADER_SIZE && b[1] == STEP_ENCAP_KEY {
+		n := len(b)
+		b = append([]byte{}, b[:FRAME_HEADER_SIZE+c.size]...)
+		binary.BigEndian.PutUint16(b[2:], uint16(c.size))
+
+		_, err := c.Conn.Write(b)
+		return n, err
+	}
+
+	return c.Conn.Write(b)
+}
+
+func TestHandshakeHybridDowngrade(t *testing.T) {
+	sopts, copts := testOpts(t, "secret", "secret")
+	sopts.Hybrid = true
+	copts.RequireHybrid = true
+
+	a, b := net.Pipe()
+	defer b.Close()
+
+	go func() {
+		defer a.Close()
+		Server(&stripConn{Conn: a, size: ENCAP_KEY_SIZES[768] + IDENTITY_KEY_SIZE}, sopts)
+	}()
+
+	if c := Client(b, copts); c.Ok() || c.Err().Reason() != "hybrid key exchange not offered" {
+		t.Fatalf("expected the downgrade to be refused, got %+v", c.Err())
+	}
+}
@@ -2,42 +2,90 @@ package auth
 
 import (
 	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/mlkem"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"net"
+	"slices"
 	"time"
 )
 
 func Client(serverConn net.Conn, args *ClientOpts) *Auth {
 	res := &Auth{}
 
-	if args.Bits != 768 && args.Bits != 1024 {
+	if args.Bits != 0 && args.Bits != 768 && args.Bits != 1024 {
 		return res.re(&Err{
 			reason: "invalid bits",
-			err:    fmt.Errorf("received: %d, must be 768 or 1024", args.Bits),
+			err:    fmt.Errorf("received: %d, must be 0, 768 or 1024", args.Bits),
 		})
 	}
 
-	// Step 1: Get the public key
-	buf, n, err := readonce(serverConn, ENCAP_KEY_SIZES[args.Bits], &readopts{
-		timeout: args.Timeout,
-		full:    true,
-	})
+	// Step 1: Get the public key and the server identity
+	buf, err := readFrame(serverConn, STEP_ENCAP_KEY, MAX_FRAME_SIZE, args.Timeout)
 
-	if err != nil || n != ENCAP_KEY_SIZES[args.Bits] {
+	bits := args.Bits
+
+	// Without a fixed size it is taken from the hello, whose 768 form stays well below a 1024 key.
+	if bits == 0 {
+		bits = 768
+
+		if len(buf) >= ENCAP_KEY_SIZES[1024]+IDENTITY_KEY_SIZE {
+			bits = 1024
+		}
+	}
+
+	// Trailing bytes are reserved for extensions.
+	if err == nil && len(buf) < ENCAP_KEY_SIZES[bits]+IDENTITY_KEY_SIZE {
+		err = fmt.Errorf("received: %d, must be at least %d bytes", len(buf), ENCAP_KEY_SIZES[bits]+IDENTITY_KEY_SIZE)
+	}
+
+	if err != nil {
 		return res.re(&Err{
 			reason: "failed to the the public key",
 			err:    err,
 		})
 	}
 
+	hello := buf
+	base := ENCAP_KEY_SIZES[bits] + IDENTITY_KEY_SIZE
+	encapkey := hello[:ENCAP_KEY_SIZES[bits]]
+	idkey := hello[ENCAP_KEY_SIZES[bits]:base]
+
+	// Step 1.1: Take the capabilities we support out of those the server offers.
+	offer, share, _, err := parseCaps(hello[base:])
+
+	if err != nil {
+		return res.re(&Err{
+			reason: "invalid capabilities",
+			err:    err,
+		})
+	}
+
+	if args.RequireHybrid && offer&CAP_HYBRID == 0 {
+		return res.re(&Err{
+			reason: "hybrid key exchange not offered",
+			err:    errors.New("the server only supports ML-KEM"),
+		})
+	}
+
+	caps := offer & (CAP_KEY_SCHEDULE | CAP_REKEY)
+
+	if args.Hybrid || args.RequireHybrid {
+		caps |= offer & CAP_HYBRID
+	}
+
+	res.Hybrid = caps&CAP_HYBRID != 0
+	res.Rekey = caps&CAP_REKEY != 0
+
 	var pubkey any
 
-	if args.Bits == 768 {
-		pubkey, err = mlkem.NewEncapsulationKey768(buf)
+	if bits == 768 {
+		pubkey, err = mlkem.NewEncapsulationKey768(encapkey)
 	} else {
-		pubkey, err = mlkem.NewEncapsulationKey1024(buf)
+		pubkey, err = mlkem.NewEncapsulationKey1024(encapkey)
 	}
 
 	if err != nil {
@@ -51,27 +99,57 @@ func Client(serverConn net.Conn, args *ClientOpts) *Auth {
 	var enckey []byte
 	var ct []byte
 
-	if args.Bits == 768 {
+	if bits == 768 {
 		enckey, ct = pubkey.(*mlkem.EncapsulationKey768).Encapsulate()
 	} else {
 		enckey, ct = pubkey.(*mlkem.EncapsulationKey1024).Encapsulate()
 	}
 
-	n, err = serverConn.Write(ct)
+	// The capabilities byte is sent even when empty, so the server binds the exchange
+	// to the hello we received and a stripped offer is detected.
+	reply := append(slices.Clip(ct), caps)
+	secret := enckey
+
+	// Step 2.1: The X25519 key follows the capabilities.
+	if res.Hybrid {
+		ecdhKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+
+		if err != nil {
+			return res.re(&Err{
+				reason: "failed to generate the x25519 key",
+				err:    err,
+			})
+		}
+
+		reply = append(reply, ecdhKey.PublicKey().Bytes()...)
+		ecdhSecret, err := x25519Secret(ecdhKey, share)
+
+		if err != nil {
+			return res.re(&Err{
+				reason: "failed to derive the x25519 secret",
+				err:    err,
+			})
+		}
+
+		secret = slices.Concat(secret, ecdhSecret)
+	}
 
-	if err != nil || n != len(ct) {
+	if err := res.deriveKeys(caps, secret, hello, reply); err != nil {
 		return res.re(&Err{
-			reason: "failed to send the ciphertext",
+			reason: "failed to derive the session keys",
 			err:    err,
 		})
 	}
 
-	res.Key = enckey
+	if err := writeFrame(serverConn, STEP_CIPHERTEXT, reply); err != nil {
+		return res.re(&Err{
+			reason: "failed to send the ciphertext",
+			err:    err,
+		})
+	}
 
 	// Step 3: Receive ACK
-	buf, n, err = readonce(serverConn, 256, &readopts{
-		timeout: args.Timeout,
-	})
+	buf, err = readFrame(serverConn, STEP_ACK, 256, args.Timeout)
 
 	if err != nil {
 		return res.re(&Err{
@@ -80,7 +158,7 @@ func Client(serverConn net.Conn, args *ClientOpts) *Auth {
 		})
 	}
 
-	ackm, err := res.Decrypt(buf[:n])
+	ackm, err := res.Decrypt(buf)
 
 	if err != nil {
 		return res.re(&Err{
@@ -89,13 +167,45 @@ func Client(serverConn net.Conn, args *ClientOpts) *Auth {
 		})
 	}
 
-	if !bytes.Equal(ackm[0:4], []byte{0, 8, 0, 8}) {
+	if len(ackm) != 10+IDENTITY_SIG_SIZE || !bytes.Equal(ackm[0:4], []byte{0, 8, 0, 8}) {
 		return res.re(&Err{
 			reason: "invalid ACK",
 			err:    errors.New("invalid ACK"),
 		})
 	}
 
+	// Step 3.1: Verify the server identity
+	if !ed25519.Verify(idkey, identityMsg(hello, idkey, reply), ackm[10:]) {
+		return res.re(&Err{
+			reason: REASON_SERVER_MISMATCH,
+			err:    errors.New("invalid server identity signature"),
+		})
+	}
+
+	host := args.Host
+
+	if host == "" {
+		host = serverConn.RemoteAddr().String()
+	}
+
+	trusted, err := args.trusts(host, idkey)
+
+	if err != nil {
+		return res.re(&Err{
+			reason: "failed to check the server identity",
+			err:    err,
+		})
+	}
+
+	if !trusted {
+		return res.re(&Err{
+			reason: REASON_SERVER_MISMATCH,
+			err:    fmt.Errorf("untrusted server identity: %s", Fingerprint(idkey)),
+		})
+	}
+
+	res.ServerKey = idkey
+
 	// Step 4: Send ID and Meta
 	idm := encodeIdMeta(args.ID, args.Meta)
 	idme, err := res.Encrypt(idm)
@@ -107,9 +217,7 @@ func Client(serverConn net.Conn, args *ClientOpts) *Auth {
 		})
 	}
 
-	n, err = serverConn.Write(idme)
-
-	if err != nil || n != len(idme) {
+	if err := writeFrame(serverConn, STEP_ID_META, idme); err != nil {
 		return res.re(&Err{
 			reason: "failed to send ID and meta data",
 			err:    err,
@@ -117,9 +225,7 @@ func Client(serverConn net.Conn, args *ClientOpts) *Auth {
 	}
 
 	// Step 5: Get the challenge
-	buf, n, err = readonce(serverConn, 128, &readopts{
-		timeout: args.Timeout,
-	})
+	buf, err = readFrame(serverConn, STEP_CHALLENGE, CHALLENGE_SIZE+KDF_PARAMS_MAX+SEALED_OVERHEAD, args.Timeout)
 
 	if err != nil {
 		return res.re(&Err{
@@ -128,7 +234,7 @@ func Client(serverConn net.Conn, args *ClientOpts) *Auth {
 		})
 	}
 
-	chnm, err := res.Decrypt(buf[:n])
+	chnm, err := res.Decrypt(buf)
 
 	if err != nil {
 		return res.re(&Err{
@@ -137,7 +243,8 @@ func Client(serverConn net.Conn, args *ClientOpts) *Auth {
 		})
 	}
 
-	if len(chnm) != CHALLENGE_SIZE {
+	// Anything past the challenge are the key derivation parameters for SignMsg.
+	if len(chnm) < CHALLENGE_SIZE {
 		return res.re(&Err{
 			reason: "challenge message is too short",
 			err:    fmt.Errorf("received %d/%d", len(chnm), CHALLENGE_SIZE),
@@ -164,14 +271,7 @@ func Client(serverConn net.Conn, args *ClientOpts) *Auth {
 	}
 
 	// Step 7: Send the signature
-	sized := make([]byte, 2+len(encsig))
-
-	copy(sized, uint16bytes(uint16(len(encsig))))
-	copy(sized[2:], encsig)
-
-	n, err = serverConn.Write(sized)
-
-	if err != nil || n != len(sized) {
+	if err := writeFrame(serverConn, STEP_SIGNATURE, encsig); err != nil {
 		return res.re(&Err{
 			reason: "failed to send the signature",
 			err:    err,
@@ -179,9 +279,7 @@ func Client(serverConn net.Conn, args *ClientOpts) *Auth {
 	}
 
 	// Step 8: Get the confirmation
-	buf, n, err = readonce(serverConn, 128, &readopts{
-		timeout: args.Timeout,
-	})
+	buf, err = readFrame(serverConn, STEP_CONFIRM, 128, args.Timeout)
 
 	if err != nil {
 		return res.re(&Err{
@@ -190,7 +288,7 @@ func Client(serverConn net.Conn, args *ClientOpts) *Auth {
 		})
 	}
 
-	dcnf, err := res.Decrypt(buf[:n])
+	dcnf, err := res.Decrypt(buf)
 
 	if err != nil {
 		return res.re(&Err{
@@ -207,7 +305,7 @@ func Client(serverConn net.Conn, args *ClientOpts) *Auth {
 	}
 
 	// Step 9: Verify the confirmation
-	if !bytes.Equal(dcnf, chnm) {
+	if !bytes.Equal(dcnf, chnm[:CHALLENGE_SIZE]) {
 		return res.re(&Err{
 			reason: "invalid confirmation",
 			err:    errors.New("challenges do not match"),
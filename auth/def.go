@@ -1,12 +1,105 @@
 package auth
 
 import (
+	"crypto"
+	"crypto/ed25519"
 	"crypto/mlkem"
+	"errors"
 	"time"
 )
 
 const (
-	CHALLENGE_SIZE = 40
+	CHALLENGE_SIZE    = 40
+	IDENTITY_KEY_SIZE = ed25519.PublicKeySize
+	IDENTITY_SIG_SIZE = ed25519.SignatureSize
+)
+
+const (
+	PROTO_VERSION     = 1
+	FRAME_HEADER_SIZE = 4
+	MAX_FRAME_SIZE    = 65535
+
+	// Encryption overhead of a handshake message: nonce + GCM tag.
+	SEALED_OVERHEAD = 12 + 16
+)
+
+// Handshake steps, carried in every frame header.
+const (
+	STEP_ENCAP_KEY uint8 = iota + 1
+	STEP_CIPHERTEXT
+	STEP_ACK
+	STEP_ID_META
+	STEP_CHALLENGE
+	STEP_SIGNATURE
+	STEP_CONFIRM
+)
+
+// Capabilities, sent after the identity key by the server and after the ciphertext by the client.
+// Format: [caps:uint8] followed by the fields of every set bit, in bit order.
+const (
+	// CAP_HYBRID adds an X25519 exchange to ML-KEM: [x25519-public-key:32]
+	CAP_HYBRID uint8 = 1 << 0
+
+	// CAP_KEY_SCHEDULE derives separate handshake and traffic keys, see Auth.C2SKey.
+	CAP_KEY_SCHEDULE uint8 = 1 << 1
+
+	// CAP_REKEY lets either side move its traffic to a fresh key, see shared.NewSecureConn.
+	CAP_REKEY uint8 = 1 << 2
+
+	X25519_KEY_SIZE = 32
+	HYBRID_KDF_INFO = "kriptun-hybrid-mlkem-x25519"
+
+	// Largest capabilities part of a client reply.
+	MAX_CAPS_SIZE = 1 + X25519_KEY_SIZE
+)
+
+// HKDF labels of the key schedule.
+const (
+	KEY_INFO_HANDSHAKE = "kriptun handshake"
+	KEY_INFO_C2S       = "kriptun client to server"
+	KEY_INFO_S2C       = "kriptun server to client"
+)
+
+// Client key algorithms, as written in front of a public key.
+const (
+	KEY_ED25519  = "ed25519"
+	KEY_MLDSA_44 = "ml-dsa-44"
+	KEY_MLDSA_65 = "ml-dsa-65"
+	KEY_MLDSA_87 = "ml-dsa-87"
+
+	// Signature context of client keys, so they can not be used to sign anything else.
+	CLIENT_SIG_CONTEXT = "kriptun-client-auth"
+
+	// Largest client signature, ML-DSA-87.
+	MAX_CLIENT_SIG_SIZE = 4627
+)
+
+// Password key derivation, see KDFParams.
+const (
+	KDF_ARGON2ID = 1
+	KDF_KEY_SIZE = 32
+
+	// Bounds the client enforces on the parameters it receives from the server.
+	KDF_MIN_SALT    = 8
+	KDF_MAX_SALT    = 64
+	KDF_MAX_TIME    = 16
+	KDF_MAX_MEMORY  = 1 << 20 // KiB, 1 GiB
+	KDF_MAX_THREADS = 64
+
+	// Encoded parameters: [kdf:uint8][time:uint32][memory:uint32][threads:uint8][salt_len:uint8][salt]
+	KDF_PARAMS_HEADER = 11
+	KDF_PARAMS_MAX    = KDF_PARAMS_HEADER + KDF_MAX_SALT
+)
+
+var (
+	ErrKeyAlgo       = errors.New("unsupported key algorithm")
+	ErrNoTrustAnchor = errors.New("no trusted server identity: set a fingerprint or a known hosts file")
+	ErrKDFParams     = errors.New("invalid key derivation parameters")
+)
+
+const (
+	// REASON_SERVER_MISMATCH is the Err reason reported when the server identity is not trusted.
+	REASON_SERVER_MISMATCH = "server identity mismatch"
 )
 
 var ENCAP_KEY_SIZES = map[uint16]int{
@@ -22,7 +115,21 @@ var CIPHERTEXT_SIZES = map[uint16]int{
 type Auth struct {
 	ID   []byte
 	Meta map[string]string
-	Key  []byte
+
+	// Key protects the handshake messages, C2SKey and S2CKey the traffic of each direction.
+	// All three are the same key when the peer does not support CAP_KEY_SCHEDULE.
+	Key    []byte
+	C2SKey []byte
+	S2CKey []byte
+
+	// ServerKey is the identity public key presented by the server.
+	ServerKey []byte
+
+	// Hybrid is set when the key combines ML-KEM and X25519, see CAP_HYBRID.
+	Hybrid bool
+
+	// Rekey is set when both sides can rekey the traffic, see CAP_REKEY.
+	Rekey bool
 
 	time time.Time
 	err  *Err
@@ -41,18 +148,64 @@ type ServerOpts struct {
 	MinIdMetaSize uint16
 	MaxIdMetaSize uint16
 	DelayOnAuth   time.Duration
+	Identity      ed25519.PrivateKey
 	VerifySig     func(auth *Auth, msg []byte, sig []byte) (bool, error)
+
+	// Hybrid offers the X25519 + ML-KEM exchange, clients that do not know it still use ML-KEM alone.
+	Hybrid bool
+
+	// Params returns the key derivation parameters of the user, which are appended to the
+	// challenge so the client can derive its HMAC key, see PasswordSigner. Nil sends none.
+	Params func(auth *Auth) (*KDFParams, error)
+}
+
+// KDFParams describe how a password is stretched into an HMAC key.
+type KDFParams struct {
+	KDF     uint8
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	Salt    []byte
+}
+
+// Verifier is what the server stores instead of a password: the parameters and the derived key.
+// It is written in the PHC string format: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+type Verifier struct {
+	Params *KDFParams
+	Key    []byte
+}
+
+// PublicKey is a client public key, written as "<algo>:<base64>".
+type PublicKey struct {
+	Algo string
+	Key  []byte
+}
+
+// PrivateKey is a client private key, stored as a PEM encoded PKCS#8 file.
+type PrivateKey struct {
+	Algo string
+	key  crypto.Signer
 }
 
 type ClientOpts struct {
+	// ML-KEM key size, 768 or 1024. Zero follows the size of the key the server sends.
 	Bits    uint16
 	ID      []byte
 	Meta    map[string]string
 	Timeout time.Duration
 	SignMsg func(msg []byte) ([]byte, error)
-}
 
-type readopts struct {
-	full    bool
-	timeout time.Duration
+	// Hybrid uses the X25519 + ML-KEM exchange when the server offers it,
+	// RequireHybrid fails the handshake when it does not.
+	Hybrid        bool
+	RequireHybrid bool
+
+	// Trusted server identities. When none of these are set the handshake fails unless Insecure is set.
+	ServerKeys         [][]byte
+	ServerFingerprints []string
+	KnownHosts         string // Path to a trust-on-first-use known hosts file.
+	Host               string // Name recorded in KnownHosts, defaults to the remote address.
+
+	// Insecure accepts any server identity when none of the above are set, leaving the session open to MITM.
+	Insecure bool
 }
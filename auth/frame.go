@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// writeFrame writes a single handshake message.
+// Format: [version:uint8][step:uint8][length:uint16][payload]
+func writeFrame(conn net.Conn, step uint8, payload []byte) error {
+	if len(payload) > MAX_FRAME_SIZE {
+		return fmt.Errorf("frame payload too large: %d", len(payload))
+	}
+
+	buf := make([]byte, FRAME_HEADER_SIZE+len(payload))
+
+	buf[0] = PROTO_VERSION
+	buf[1] = step
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(payload)))
+	copy(buf[FRAME_HEADER_SIZE:], payload)
+
+	_, err := conn.Write(buf)
+
+	return err
+}
+
+// readFrame reads a single handshake message, which must belong to the expected step
+// and carry at most max bytes of payload.
+func readFrame(conn net.Conn, step uint8, max int, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	head := make([]byte, FRAME_HEADER_SIZE)
+
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+
+	if head[0] != PROTO_VERSION {
+		return nil, fmt.Errorf("unsupported protocol version: %d", head[0])
+	}
+
+	if head[1] != step {
+		return nil, fmt.Errorf("unexpected step: received %d, expected %d", head[1], step)
+	}
+
+	size := int(binary.BigEndian.Uint16(head[2:]))
+
+	if size > max {
+		return nil, fmt.Errorf("frame too large: received %d, max %d", size, max)
+	}
+
+	buf := make([]byte, size)
+
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
@@ -8,8 +8,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"net"
-	"time"
 )
 
 // Encrypt encrypts the given message with the provided key using AES-GCM.
@@ -67,39 +65,6 @@ func randbytes(size int) []byte {
 	return key
 }
 
-func readonce(conn net.Conn, size int, opts *readopts) ([]byte, int, error) {
-	opt := &readopts{
-		timeout: 0,
-		full:    false,
-	}
-
-	if opts != nil {
-		opt = opts
-	}
-
-	buf := make([]byte, size)
-
-	if opt.timeout > 0 {
-		conn.SetReadDeadline(time.Now().Add(opt.timeout))
-		defer conn.SetDeadline(time.Time{})
-	}
-
-	var n int
-	var err error
-
-	if opt.full {
-		n, err = io.ReadFull(conn, buf)
-	} else {
-		n, err = conn.Read(buf)
-	}
-
-	if err != nil {
-		return nil, 0, err
-	}
-
-	return buf, n, nil
-}
-
 func uint16bytes(n uint16) []byte {
 	b := make([]byte, 2)
 	binary.BigEndian.PutUint16(b, n)
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var knownHostsMu sync.Mutex
+
+// Fingerprint returns the SHA256 fingerprint of a server identity public key.
+func Fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// LoadIdentity reads a PEM encoded PKCS#8 Ed25519 private key.
+func LoadIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM private key found", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	priv, ok := key.(ed25519.PrivateKey)
+
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 private key", path)
+	}
+
+	return priv, nil
+}
+
+// LoadOrCreateIdentity loads the identity key at path, generating and saving a new one if it does not exist.
+func LoadOrCreateIdentity(path string) (ed25519.PrivateKey, error) {
+	priv, err := LoadIdentity(path)
+
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return priv, err
+	}
+
+	_, priv, err = ed25519.GenerateKey(nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+
+	return priv, nil
+}
+
+// identityMsg is the message signed by the server identity key.
+// It binds the ephemeral encapsulation key, the identity key and the client's ciphertext,
+// or the whole hello and reply in a hybrid exchange.
+func identityMsg(encapKey, idKey, ct []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("kriptun-server-identity"))
+	h.Write(encapKey)
+	h.Write(idKey)
+	h.Write(ct)
+
+	return h.Sum(nil)
+}
+
+func (args *ClientOpts) trusts(host string, key []byte) (bool, error) {
+	if len(args.ServerKeys) == 0 && len(args.ServerFingerprints) == 0 && args.KnownHosts == "" {
+		if args.Insecure {
+			return true, nil
+		}
+
+		return false, ErrNoTrustAnchor
+	}
+
+	for _, k := range args.ServerKeys {
+		if bytes.Equal(k, key) {
+			return true, nil
+		}
+	}
+
+	fp := Fingerprint(key)
+
+	for _, f := range args.ServerFingerprints {
+		if f == fp {
+			return true, nil
+		}
+	}
+
+	if args.KnownHosts == "" {
+		return false, nil
+	}
+
+	return knownHost(args.KnownHosts, host, fp)
+}
+
+// knownHost checks the fingerprint against the known hosts file.
+// Format: one "<host> <fingerprint>" entry per line, lines starting with '#' are ignored.
+// Unknown hosts are trusted on first use and appended to the file.
+func knownHost(path string, host string, fp string) (bool, error) {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if fields[0] == host {
+			return fields[1] == fp, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	if _, err := fmt.Fprintf(file, "%s %s\n", host, fp); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// parseCaps reads the capabilities following the fixed part of a hello or reply,
+// rest is whatever follows the fields we know about.
+func parseCaps(ext []byte) (caps uint8, share []byte, rest []byte, err error) {
+	if len(ext) == 0 {
+		return 0, nil, nil, nil
+	}
+
+	caps, rest = ext[0], ext[1:]
+
+	if caps&CAP_HYBRID != 0 {
+		if len(rest) < X25519_KEY_SIZE {
+			return 0, nil, nil, errors.New("truncated x25519 key")
+		}
+
+		share, rest = rest[:X25519_KEY_SIZE], rest[X25519_KEY_SIZE:]
+	}
+
+	return caps, share, rest, nil
+}
+
+// x25519Secret derives the X25519 shared secret with the peer's public key.
+func x25519Secret(priv *ecdh.PrivateKey, peer []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Fails on low order points, which would make the secret predictable.
+	return priv.ECDH(pub)
+}
+
+// deriveKeys runs the key schedule over the negotiated capabilities. secret is the ML-KEM shared
+// secret, followed by the X25519 one in a hybrid exchange. The transcript hash of the hello (step 1)
+// and reply (step 2) payloads salts the derivation, binding the keys to the exact messages exchanged.
+//
+// Without CAP_KEY_SCHEDULE a single key protects the handshake and both directions, as older peers
+// expect. hello and reply are nil for clients that predate capabilities, which use the raw secret.
+func (a *Auth) deriveKeys(caps uint8, secret, hello, reply []byte) error {
+	a.Key = secret
+
+	if caps&CAP_KEY_SCHEDULE != 0 {
+		prk, err := hkdf.Extract(sha256.New, secret, transcriptHash(hello, reply))
+
+		if err != nil {
+			return err
+		}
+
+		for _, k := range []struct {
+			dst  *[]byte
+			info string
+		}{
+			{&a.Key, KEY_INFO_HANDSHAKE},
+			{&a.C2SKey, KEY_INFO_C2S},
+			{&a.S2CKey, KEY_INFO_S2C},
+		} {
+			if *k.dst, err = hkdf.Expand(sha256.New, prk, k.info, 32); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if hello != nil {
+		info := KEY_INFO_HANDSHAKE
+
+		if caps&CAP_HYBRID != 0 {
+			info = HYBRID_KDF_INFO
+		}
+
+		key, err := hkdf.Key(sha256.New, secret, transcriptHash(hello, reply), info, 32)
+
+		if err != nil {
+			return err
+		}
+
+		a.Key = key
+	}
+
+	a.C2SKey, a.S2CKey = a.Key, a.Key
+
+	return nil
+}
+
+func transcriptHash(hello, reply []byte) []byte {
+	h := sha256.New()
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(hello))))
+	h.Write(hello)
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(reply))))
+	h.Write(reply)
+
+	return h.Sum(nil)
+}
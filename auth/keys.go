@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// GenerateKey creates a client key, algo is one of the KEY_* constants.
+func GenerateKey(algo string) (*PrivateKey, error) {
+	if algo == KEY_ED25519 {
+		_, priv, err := ed25519.GenerateKey(nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &PrivateKey{Algo: algo, key: priv}, nil
+	}
+
+	key, err := generateMLDSA(algo)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &PrivateKey{Algo: algo, key: key}, nil
+}
+
+// LoadPrivateKey reads a client key written by Save.
+func LoadPrivateKey(path string) (*PrivateKey, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM private key found", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if priv, ok := key.(ed25519.PrivateKey); ok {
+		return &PrivateKey{Algo: KEY_ED25519, key: priv}, nil
+	}
+
+	if algo, priv, ok := mldsaKey(key); ok {
+		return &PrivateKey{Algo: algo, key: priv}, nil
+	}
+
+	return nil, fmt.Errorf("%s: %w: %T", path, ErrKeyAlgo, key)
+}
+
+// Save writes the key to path, readable by the owner only.
+func (k *PrivateKey) Save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(k.key)
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+func (k *PrivateKey) Public() *PublicKey {
+	pub := &PublicKey{Algo: k.Algo}
+
+	switch p := k.key.Public().(type) {
+	case ed25519.PublicKey:
+		pub.Key = p
+	case interface{ Bytes() []byte }:
+		pub.Key = p.Bytes()
+	}
+
+	return pub
+}
+
+// SignMsg signs the challenge, it can be used as ClientOpts.SignMsg.
+func (k *PrivateKey) SignMsg(msg []byte) ([]byte, error) {
+	if k.Algo == KEY_ED25519 {
+		return k.key.Sign(nil, msg, &ed25519.Options{Context: CLIENT_SIG_CONTEXT})
+	}
+
+	return signMLDSA(k.key, msg)
+}
+
+// ParsePublicKey parses "<algo>:<base64>", anything after a space is a comment.
+func ParsePublicKey(s string) (*PublicKey, error) {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), " ")
+	algo, enc, ok := strings.Cut(s, ":")
+
+	if !ok {
+		return nil, errors.New("public key must look like <algo>:<base64>")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(enc)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key encoding: %w", err)
+	}
+
+	k := &PublicKey{Algo: algo, Key: key}
+
+	if algo == KEY_ED25519 {
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("ed25519 public key must be %d bytes, got %d", ed25519.PublicKeySize, len(key))
+		}
+
+		return k, nil
+	}
+
+	if err := checkMLDSA(algo, key); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (k *PublicKey) String() string {
+	return k.Algo + ":" + base64.StdEncoding.EncodeToString(k.Key)
+}
+
+// VerifySig checks a signature made by PrivateKey.SignMsg, it can be used as ServerOpts.VerifySig.
+func (k *PublicKey) VerifySig(auth *Auth, msg []byte, sig []byte) (bool, error) {
+	if k.Algo == KEY_ED25519 {
+		if err := ed25519.VerifyWithOptions(k.Key, msg, sig, &ed25519.Options{Context: CLIENT_SIG_CONTEXT}); err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	if err := verifyMLDSA(k.Algo, k.Key, msg, sig); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,83 @@
+//go:build go1.27
+
+package auth
+
+import (
+	"crypto"
+	"crypto/mldsa"
+	"fmt"
+)
+
+var mldsaSets = map[string]func() mldsa.Parameters{
+	KEY_MLDSA_44: mldsa.MLDSA44,
+	KEY_MLDSA_65: mldsa.MLDSA65,
+	KEY_MLDSA_87: mldsa.MLDSA87,
+}
+
+func mldsaParams(algo string) (mldsa.Parameters, error) {
+	params, ok := mldsaSets[algo]
+
+	if !ok {
+		return mldsa.Parameters{}, fmt.Errorf("%w: %s", ErrKeyAlgo, algo)
+	}
+
+	return params(), nil
+}
+
+func generateMLDSA(algo string) (crypto.Signer, error) {
+	params, err := mldsaParams(algo)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mldsa.GenerateKey(params)
+}
+
+func mldsaKey(key any) (string, crypto.Signer, bool) {
+	priv, ok := key.(*mldsa.PrivateKey)
+
+	if !ok {
+		return "", nil, false
+	}
+
+	for algo, params := range mldsaSets {
+		if priv.PublicKey().Parameters() == params() {
+			return algo, priv, true
+		}
+	}
+
+	return "", nil, false
+}
+
+func signMLDSA(key crypto.Signer, msg []byte) ([]byte, error) {
+	return key.Sign(nil, msg, &mldsa.Options{Context: CLIENT_SIG_CONTEXT})
+}
+
+func checkMLDSA(algo string, key []byte) error {
+	params, err := mldsaParams(algo)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = mldsa.NewPublicKey(params, key)
+
+	return err
+}
+
+func verifyMLDSA(algo string, key []byte, msg []byte, sig []byte) error {
+	params, err := mldsaParams(algo)
+
+	if err != nil {
+		return err
+	}
+
+	pub, err := mldsa.NewPublicKey(params, key)
+
+	if err != nil {
+		return err
+	}
+
+	return mldsa.Verify(pub, msg, sig, &mldsa.Options{Context: CLIENT_SIG_CONTEXT})
+}
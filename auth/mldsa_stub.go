@@ -0,0 +1,40 @@
+//go:build !go1.27
+
+package auth
+
+import (
+	"crypto"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// ML-DSA needs crypto/mldsa, only Ed25519 keys work with older toolchains.
+
+func generateMLDSA(algo string) (crypto.Signer, error) {
+	return nil, unsupported(algo)
+}
+
+func mldsaKey(key any) (string, crypto.Signer, bool) {
+	return "", nil, false
+}
+
+func signMLDSA(key crypto.Signer, msg []byte) ([]byte, error) {
+	return nil, unsupported("ml-dsa")
+}
+
+func checkMLDSA(algo string, key []byte) error {
+	return unsupported(algo)
+}
+
+func verifyMLDSA(algo string, key []byte, msg []byte, sig []byte) error {
+	return unsupported(algo)
+}
+
+func unsupported(algo string) error {
+	if !strings.HasPrefix(algo, "ml-dsa") {
+		return fmt.Errorf("%w: %s", ErrKeyAlgo, algo)
+	}
+
+	return fmt.Errorf("%w: %s, ML-DSA needs kriptun built with Go 1.27 or later, this one was built with %s", ErrKeyAlgo, algo, runtime.Version())
+}
@@ -1,11 +1,14 @@
 package auth
 
 import (
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/mlkem"
-	"encoding/binary"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"net"
+	"slices"
 	"time"
 )
 
@@ -19,6 +22,13 @@ func Server(clientConn net.Conn, args *ServerOpts) *Auth {
 		})
 	}
 
+	if len(args.Identity) != ed25519.PrivateKeySize {
+		return res.re(&Err{
+			reason: "invalid identity key",
+			err:    errors.New("server identity key is missing or malformed"),
+		})
+	}
+
 	// Step 1: Generate private key.
 	var privkey any
 	var err error
@@ -45,32 +55,77 @@ func Server(clientConn net.Conn, args *ServerOpts) *Auth {
 		pubkeyb = privkey.(*mlkem.DecapsulationKey1024).EncapsulationKey().Bytes()
 	}
 
-	n, err := clientConn.Write(pubkeyb)
-	if err != nil || n != ENCAP_KEY_SIZES[args.Bits] {
+	idkey := args.Identity.Public().(ed25519.PublicKey)
+	hello := slices.Concat(pubkeyb, idkey)
+
+	// Step 2.1: Offer our capabilities, old clients ignore the trailing bytes.
+	offer := CAP_KEY_SCHEDULE | CAP_REKEY
+
+	var ecdhKey *ecdh.PrivateKey
+
+	if args.Hybrid {
+		if ecdhKey, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+			return res.re(&Err{
+				reason: "failed to generate the x25519 key",
+				err:    err,
+			})
+		}
+
+		offer |= CAP_HYBRID
+	}
+
+	hello = append(hello, offer)
+
+	if ecdhKey != nil {
+		hello = append(hello, ecdhKey.PublicKey().Bytes()...)
+	}
+
+	if err := writeFrame(clientConn, STEP_ENCAP_KEY, hello); err != nil {
 		return res.re(&Err{
 			reason: "failed to send public key to the client",
 			err:    err,
 		})
 	}
 
-	// Step 3: Receive the ciphertext.
-	buf, n, err := readonce(clientConn, CIPHERTEXT_SIZES[args.Bits], &readopts{
-		timeout: args.Timeout,
-		full:    true,
-	})
+	// Step 3: Receive the ciphertext, followed by the capabilities the client took.
+	ctSize := CIPHERTEXT_SIZES[args.Bits]
+	reply, err := readFrame(clientConn, STEP_CIPHERTEXT, ctSize+MAX_CAPS_SIZE, args.Timeout)
+
+	if err == nil && len(reply) < ctSize {
+		err = fmt.Errorf("received: %d, must be at least %d bytes", len(reply), ctSize)
+	}
 
-	if err != nil || n != CIPHERTEXT_SIZES[args.Bits] {
+	if err != nil {
 		return res.re(&Err{
 			reason: "failed to get ciphertext from the client",
 			err:    err,
 		})
 	}
 
+	ct := reply[:ctSize]
+	caps, share, rest, err := parseCaps(reply[ctSize:])
+
+	if err == nil && (caps&^offer != 0 || len(rest) != 0) {
+		err = fmt.Errorf("capabilities 0x%02x, offered 0x%02x, %d trailing bytes", caps, offer, len(rest))
+	}
+
+	if err != nil {
+		return res.re(&Err{
+			reason: "invalid capabilities",
+			err:    err,
+		})
+	}
+
+	res.Hybrid = caps&CAP_HYBRID != 0
+	res.Rekey = caps&CAP_REKEY != 0
+
 	// Step 4: Decapsulate the chipertext.
+	var secret []byte
+
 	if args.Bits == 768 {
-		res.Key, err = privkey.(*mlkem.DecapsulationKey768).Decapsulate(buf)
+		secret, err = privkey.(*mlkem.DecapsulationKey768).Decapsulate(ct)
 	} else {
-		res.Key, err = privkey.(*mlkem.DecapsulationKey1024).Decapsulate(buf)
+		secret, err = privkey.(*mlkem.DecapsulationKey1024).Decapsulate(ct)
 	}
 
 	if err != nil {
@@ -80,9 +135,41 @@ func Server(clientConn net.Conn, args *ServerOpts) *Auth {
 		})
 	}
 
-	// Step 5: Send ACK.
+	// Step 4.1: Derive the keys. When the client sends its capabilities, even none, the identity
+	// signs the whole exchange, so a stripped or altered offer breaks the signature. Only clients
+	// that predate capabilities get the plain ML-KEM key.
+	idmsg := identityMsg(pubkeyb, idkey, ct)
+	thello, treply := []byte(nil), []byte(nil)
+
+	if len(reply) > ctSize {
+		idmsg = identityMsg(hello, idkey, reply)
+		thello, treply = hello, reply
+	}
+
+	if res.Hybrid {
+		ecdhSecret, err := x25519Secret(ecdhKey, share)
+
+		if err != nil {
+			return res.re(&Err{
+				reason: "failed to derive the x25519 secret",
+				err:    err,
+			})
+		}
+
+		secret = slices.Concat(secret, ecdhSecret)
+	}
+
+	if err := res.deriveKeys(caps, secret, thello, treply); err != nil {
+		return res.re(&Err{
+			reason: "failed to derive the session keys",
+			err:    err,
+		})
+	}
+
+	// Step 5: Send ACK signed by the server identity.
 	msg := []byte{0, 8, 0, 8}
 	msg = append(msg, randbytes(6)...)
+	msg = append(msg, ed25519.Sign(args.Identity, idmsg)...)
 	msg, err = res.Encrypt(msg)
 
 	if err != nil {
@@ -92,9 +179,7 @@ func Server(clientConn net.Conn, args *ServerOpts) *Auth {
 		})
 	}
 
-	n, err = clientConn.Write(msg)
-
-	if err != nil || n != len(msg) {
+	if err := writeFrame(clientConn, STEP_ACK, msg); err != nil {
 		return res.re(&Err{
 			reason: "failed to send the ack message",
 			err:    err,
@@ -102,9 +187,7 @@ func Server(clientConn net.Conn, args *ServerOpts) *Auth {
 	}
 
 	// Step 6: Receive the ID and meta data.
-	buf, n, err = readonce(clientConn, int(args.MaxIdMetaSize), &readopts{
-		timeout: args.Timeout,
-	})
+	buf, err := readFrame(clientConn, STEP_ID_META, int(args.MaxIdMetaSize)+SEALED_OVERHEAD, args.Timeout)
 
 	if err != nil {
 		return res.re(&Err{
@@ -113,7 +196,7 @@ func Server(clientConn net.Conn, args *ServerOpts) *Auth {
 		})
 	}
 
-	idme, err := res.Decrypt(buf[:n])
+	idme, err := res.Decrypt(buf)
 
 	if err != nil {
 		return res.re(&Err{
@@ -148,9 +231,26 @@ func Server(clientConn net.Conn, args *ServerOpts) *Auth {
 	res.ID = id
 	res.Meta = meta
 
-	// Step 7: Send the challenge.
+	// Step 7: Send the challenge, followed by the key derivation parameters of the user if any.
 	challenge := randbytes(CHALLENGE_SIZE)
-	encryptedChlng, err := res.Encrypt(challenge)
+	chlngMsg := challenge
+
+	if args.Params != nil {
+		params, err := args.Params(res)
+
+		if err != nil {
+			return res.re(&Err{
+				reason: "failed to get the key derivation parameters",
+				err:    err,
+			})
+		}
+
+		if params != nil {
+			chlngMsg = append(slices.Clip(challenge), params.encode()...)
+		}
+	}
+
+	encryptedChlng, err := res.Encrypt(chlngMsg)
 
 	if err != nil {
 		return res.re(&Err{
@@ -159,52 +259,31 @@ func Server(clientConn net.Conn, args *ServerOpts) *Auth {
 		})
 	}
 
-	n, err = clientConn.Write(encryptedChlng)
-
-	if err != nil || n != len(encryptedChlng) {
+	if err := writeFrame(clientConn, STEP_CHALLENGE, encryptedChlng); err != nil {
 		return res.re(&Err{
 			reason: "failed to write the challenge message",
 			err:    err,
 		})
 	}
 
-	// Step 8: Get the encrypted signed message size.
-	buf, n, err = readonce(clientConn, 2, &readopts{
-		timeout: args.Timeout,
-		full:    true,
-	})
+	// Step 8: Get the signed message.
+	buf, err = readFrame(clientConn, STEP_SIGNATURE, int(args.MaxSigSize)+SEALED_OVERHEAD, args.Timeout)
 
-	if err != nil || n != 2 {
+	if err != nil {
 		return res.re(&Err{
-			reason: "failed to get the encrypted message size",
+			reason: "failed to get the signature",
 			err:    err,
 		})
 	}
 
-	encsize := binary.BigEndian.Uint16(buf)
-	decsize := encsize - 28
-
-	if decsize < args.MinSigSize || decsize > args.MaxSigSize {
+	if decsize := len(buf) - SEALED_OVERHEAD; decsize < int(args.MinSigSize) || decsize > int(args.MaxSigSize) {
 		return res.re(&Err{
 			reason: "received invalid signature size",
 			err:    fmt.Errorf("received: %d, min: %d, max: %d", decsize, args.MinSigSize, args.MaxSigSize),
 		})
 	}
 
-	// Step 8: Get the signed message.
-	buf, n, err = readonce(clientConn, int(encsize), &readopts{
-		timeout: args.Timeout,
-		full:    true,
-	})
-
-	if err != nil {
-		return res.re(&Err{
-			reason: "failed to get the signature",
-			err:    err,
-		})
-	}
-
-	dsig, err := res.Decrypt(buf[:n])
+	dsig, err := res.Decrypt(buf)
 
 	if err != nil {
 		return res.re(&Err{
@@ -214,7 +293,7 @@ func Server(clientConn net.Conn, args *ServerOpts) *Auth {
 	}
 
 	// Step 9: Verify the signature
-	if ok, err := args.VerifySig(res, challenge, dsig); !ok {
+	if ok, err := args.VerifySig(res, chlngMsg, dsig); !ok {
 		if err == nil {
 			err = errors.New("signatures didn't match")
 		}
@@ -235,9 +314,7 @@ func Server(clientConn net.Conn, args *ServerOpts) *Auth {
 		})
 	}
 
-	n, err = clientConn.Write(cnfm)
-
-	if err != nil || n != len(cnfm) {
+	if err := writeFrame(clientConn, STEP_CONFIRM, cnfm); err != nil {
 		return res.re(&Err{
 			reason: "failed to send the confirmation message",
 			err:    err,
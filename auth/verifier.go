@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"kriptun/shared"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// NewKDFParams returns Argon2id parameters with a fresh random salt.
+func NewKDFParams() *KDFParams {
+	return &KDFParams{
+		KDF:     KDF_ARGON2ID,
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+		Salt:    randbytes(16),
+	}
+}
+
+// NewVerifier derives the verifier of pw, p is usually NewKDFParams().
+func NewVerifier(pw []byte, p *KDFParams) (*Verifier, error) {
+	key, err := p.Derive(pw)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Verifier{Params: p, Key: key}, nil
+}
+
+// ParseVerifier parses the string written by Verifier.String.
+func ParseVerifier(s string) (*Verifier, error) {
+	var version, m, t, p uint32
+
+	parts := strings.Split(s, "$")
+
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return nil, fmt.Errorf("%w: expected $argon2id$v=19$m=...,t=...,p=...$<salt>$<key>", ErrKDFParams)
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrKDFParams, parts[2])
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil || p > 255 {
+		return nil, fmt.Errorf("%w: %q", ErrKDFParams, parts[3])
+	}
+
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[4])
+	key, err2 := base64.RawStdEncoding.DecodeString(parts[5])
+
+	if err1 != nil || err2 != nil || len(key) != KDF_KEY_SIZE {
+		return nil, fmt.Errorf("%w: invalid salt or key", ErrKDFParams)
+	}
+
+	v := &Verifier{
+		Params: &KDFParams{KDF: KDF_ARGON2ID, Time: t, Memory: m, Threads: uint8(p), Salt: salt},
+		Key:    key,
+	}
+
+	return v, v.Params.check()
+}
+
+func (v *Verifier) String() string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		v.Params.Memory,
+		v.Params.Time,
+		v.Params.Threads,
+		base64.RawStdEncoding.EncodeToString(v.Params.Salt),
+		base64.RawStdEncoding.EncodeToString(v.Key),
+	)
+}
+
+// VerifySig checks an HMAC made by PasswordSigner, it can be used as ServerOpts.VerifySig.
+func (v *Verifier) VerifySig(auth *Auth, msg []byte, sig []byte) (bool, error) {
+	mac, err := shared.Hamc(v.Key, msg)
+
+	if err != nil {
+		return false, err
+	}
+
+	return hmac.Equal(mac, sig), nil
+}
+
+// PasswordSigner returns a ClientOpts.SignMsg that signs with the password itself when
+// the server sends no parameters, and with the key derived from it when it does.
+// The derived key is kept for as long as the server sends the same parameters.
+func PasswordSigner(pw []byte) func(msg []byte) ([]byte, error) {
+	var mu sync.Mutex
+	var last string
+	var lastKey []byte
+
+	return func(msg []byte) ([]byte, error) {
+		if len(msg) == CHALLENGE_SIZE {
+			return shared.Hamc(pw, msg)
+		}
+
+		encoded := msg[CHALLENGE_SIZE:]
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if lastKey == nil || last != string(encoded) {
+			p, err := decodeKDFParams(encoded)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if lastKey, err = p.Derive(pw); err != nil {
+				return nil, err
+			}
+
+			last = string(encoded)
+		}
+
+		return shared.Hamc(lastKey, msg)
+	}
+}
+
+// Derive stretches pw into an HMAC key.
+func (p *KDFParams) Derive(pw []byte) ([]byte, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+
+	return argon2.IDKey(pw, p.Salt, p.Time, p.Memory, p.Threads, KDF_KEY_SIZE), nil
+}
+
+func (p *KDFParams) encode() []byte {
+	b := []byte{p.KDF}
+	b = binary.BigEndian.AppendUint32(b, p.Time)
+	b = binary.BigEndian.AppendUint32(b, p.Memory)
+	b = append(b, p.Threads, uint8(len(p.Salt)))
+
+	return append(b, p.Salt...)
+}
+
+func decodeKDFParams(b []byte) (*KDFParams, error) {
+	if len(b) < KDF_PARAMS_HEADER || len(b) != KDF_PARAMS_HEADER+int(b[10]) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrKDFParams, len(b))
+	}
+
+	p := &KDFParams{
+		KDF:     b[0],
+		Time:    binary.BigEndian.Uint32(b[1:]),
+		Memory:  binary.BigEndian.Uint32(b[5:]),
+		Threads: b[9],
+		Salt:    b[KDF_PARAMS_HEADER:],
+	}
+
+	return p, p.check()
+}
+
+// check keeps a server from making clients burn unbounded memory or time.
+func (p *KDFParams) check() error {
+	switch {
+	case p.KDF != KDF_ARGON2ID:
+		return fmt.Errorf("%w: unknown kdf %d", ErrKDFParams, p.KDF)
+	case len(p.Salt) < KDF_MIN_SALT || len(p.Salt) > KDF_MAX_SALT:
+		return fmt.Errorf("%w: salt must be %d to %d bytes", ErrKDFParams, KDF_MIN_SALT, KDF_MAX_SALT)
+	case p.Time < 1 || p.Time > KDF_MAX_TIME:
+		return fmt.Errorf("%w: time must be 1 to %d", ErrKDFParams, KDF_MAX_TIME)
+	case p.Memory < 8*uint32(p.Threads) || p.Memory > KDF_MAX_MEMORY:
+		return fmt.Errorf("%w: memory must be %d to %d KiB", ErrKDFParams, 8*uint32(p.Threads), KDF_MAX_MEMORY)
+	case p.Threads < 1 || p.Threads > KDF_MAX_THREADS:
+		return fmt.Errorf("%w: threads must be 1 to %d", ErrKDFParams, KDF_MAX_THREADS)
+	}
+
+	return nil
+}
@@ -1,72 +1,279 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"kriptun/auth"
+	"kriptun/mux"
 	"kriptun/shared"
+	"kriptun/transport"
 	"net"
 	"time"
-
-	"github.com/dipakw/uconn"
 )
 
 func New(conf *Config) (*Client, error) {
+	if conf.Rekey == nil {
+		conf.Rekey = &shared.Rekey{Bytes: shared.REKEY_BYTES, Interval: shared.REKEY_INTERVAL}
+	}
+
 	c := &Client{
 		conf: conf,
+
+		// Built once, the signer keeps the key derived from the password across sessions.
+		sign: auth.PasswordSigner([]byte(conf.Password)),
+	}
+
+	if conf.Key != nil {
+		c.sign = conf.Key.SignMsg
 	}
 
 	return c, nil
 }
 
+// Dial opens a connection to the target through the server.
+// Unless disabled, targets share multiplexed sessions, falling back to a dedicated
+// session per target when the server does not support multiplexing.
 func (c *Client) Dial(t *shared.Target) (net.Conn, error) {
-	conn, err := net.Dial(c.conf.Server.Net, c.conf.Server.Addr)
+	if c.conf.NoMux || c.legacy.Load() {
+		return c.dialLegacy(t)
+	}
+
+	for retried := false; ; retried = true {
+		sess, err := c.session()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if sess == nil {
+			return c.dialLegacy(t)
+		}
+
+		stream, err := sess.Open()
+
+		if err != nil {
+			// The session died after it was picked, a fresh one is tried once.
+			if sess.IsClosed() && !retried {
+				continue
+			}
+
+			return nil, err
+		}
+
+		if err := c.request(stream, t); err != nil {
+			stream.Close()
+			return nil, err
+		}
+
+		return stream, nil
+	}
+}
+
+// Close closes all multiplexed sessions and the streams they carry.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, sess := range c.pool {
+		sess.Close()
+	}
+
+	c.pool = nil
+
+	return nil
+}
+
+func (c *Client) dialLegacy(t *shared.Target) (net.Conn, error) {
+	conn, err := c.connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.request(conn, t); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// session returns a usable multiplexed session, opening a new one when needed.
+// It returns nil when the server only supports legacy sessions.
+// The lock is not held while dialing, concurrent callers wait for the same dial instead.
+func (c *Client) session() (*mux.Session, error) {
+	for {
+		c.mu.Lock()
+
+		pool := c.pool[:0]
+
+		for _, sess := range c.pool {
+			if !sess.IsClosed() {
+				pool = append(pool, sess)
+			}
+		}
+
+		c.pool = pool
+
+		for _, sess := range c.pool {
+			if sess.NumStreams() < MAX_STREAMS {
+				c.mu.Unlock()
+				return sess, nil
+			}
+		}
+
+		if call := c.dialing; call != nil {
+			c.mu.Unlock()
+
+			<-call.done
+
+			// The new session may already be full, look again.
+			if call.err != nil || call.sess == nil {
+				return call.sess, call.err
+			}
+
+			continue
+		}
+
+		call := &dialCall{done: make(chan struct{})}
+		c.dialing = call
+
+		c.mu.Unlock()
+
+		call.sess, call.err = c.openSession()
+
+		c.mu.Lock()
+
+		c.dialing = nil
+
+		if call.sess != nil {
+			c.pool = append(c.pool, call.sess)
+		}
+
+		c.mu.Unlock()
+
+		close(call.done)
+
+		return call.sess, call.err
+	}
+}
+
+// openSession connects and asks the server for a multiplexed session.
+func (c *Client) openSession() (*mux.Session, error) {
+	conn, err := c.connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte{shared.SESSION_MUX, mux.VERSION}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	buf := make([]byte, 1)
+
+	conn.SetReadDeadline(time.Now().Add(REQUEST_TIMEOUT))
+
+	if _, err := conn.Read(buf); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	if buf[0] != shared.SESSION_MUX {
+		conn.Close()
+
+		if buf[0] == shared.MALFORMED_REQUEST {
+			c.legacy.Store(true)
+			return nil, nil
+		}
+
+		return nil, &StatusErr{Status: buf[0]}
+	}
+
+	return mux.Client(conn, &mux.Config{
+		MaxStreams: MAX_STREAMS,
+	}), nil
+}
+
+// connect opens an authenticated and encrypted connection to the server.
+func (c *Client) connect() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+
+	conn, err := transport.Dial(ctx, c.conf.Server.Net, c.conf.Server.Addr, c.conf.Transport)
 
 	if err != nil {
 		return nil, err
 	}
 
 	authUser := auth.Client(conn, &auth.ClientOpts{
-		Bits:    768,
 		ID:      []byte(c.conf.Username),
 		Timeout: 5 * time.Second,
 
-		SignMsg: func(msg []byte) ([]byte, error) {
-			return shared.Hamc([]byte(c.conf.Password), msg)
-		},
+		SignMsg:       c.sign,
+		Hybrid:        true,
+		RequireHybrid: c.conf.RequireHybrid,
+
+		ServerFingerprints: c.conf.ServerFingerprints,
+		KnownHosts:         c.conf.KnownHosts,
+		Insecure:           c.conf.Insecure,
+		Host:               c.conf.Server.Addr,
 	})
 
 	if !authUser.Ok() {
+		conn.Close()
 		return nil, authUser.Err().Main()
 	}
 
-	conn, err = uconn.New(conn, &uconn.Opts{
-		Algo: uconn.ALGO_AES256_GCM,
-		Key:  authUser.Key,
-	})
+	var rekey *shared.Rekey
+
+	if authUser.Rekey {
+		rekey = c.conf.Rekey
+	}
+
+	sconn, err := shared.NewSecureConn(conn, authUser.C2SKey, authUser.S2CKey, rekey)
 
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
+	return sconn, nil
+}
+
+// request sends the target and waits for the server to open it.
+func (c *Client) request(conn net.Conn, t *shared.Target) error {
 	buf, err := t.Pack()
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if _, err := conn.Write(buf); err != nil {
-		return nil, err
+		return err
 	}
 
 	buf = make([]byte, 1)
 
+	// The server answers once it has connected to the target, or given up.
+	conn.SetReadDeadline(time.Now().Add(time.Duration(t.CToB)*time.Second + REQUEST_TIMEOUT))
+
 	if _, err := conn.Read(buf); err != nil {
-		return nil, err
+		return err
 	}
 
+	conn.SetReadDeadline(time.Time{})
+
 	if buf[0] != shared.CONN_OPENED {
-		return nil, fmt.Errorf("connection not opened: %d", buf[0])
+		return &StatusErr{Status: buf[0]}
 	}
 
-	return conn, nil
+	return nil
+}
+
+func (e *StatusErr) Error() string {
+	return fmt.Sprintf("connection not opened: %d", e.Status)
 }
@@ -0,0 +1,241 @@
+package client
+
+import (
+	"io"
+	"kriptun/auth"
+	"kriptun/mux"
+	"kriptun/server"
+	"kriptun/shared"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dipakw/logs"
+)
+
+func TestSessionSharesDial(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 8)
+
+	// Accepts and never answers, like a black-holed server.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			accepted <- conn
+		}
+	}()
+
+	c, err := New(&Config{
+		Server:   &shared.Addr{Net: "tcp", Addr: ln.Addr().String()},
+		Log:      logs.New(&logs.Config{Allow: logs.NONE}),
+		Username: "user",
+		Password: "pw",
+		Insecure: true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 4)
+
+	for range 4 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := c.Dial(&shared.Target{Net: "tcp", Host: "127.0.0.1", Port: 80})
+			errs <- err
+		}()
+	}
+
+	conn := <-accepted
+
+	select {
+	case <-accepted:
+		t.Fatal("expected concurrent dials to share one connection")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Closing the hung connection fails every waiting Dial at once.
+	conn.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-accepted:
+		t.Fatal("expected the waiting dials to share the failure")
+	case <-time.After(time.Second):
+		t.Fatal("expected the waiting dials to fail together")
+	}
+
+	close(errs)
+
+	for err := range errs {
+		if err == nil {
+			t.Fatal("expected the dial to fail")
+		}
+	}
+
+	// Close does not wait for a dial in progress.
+	go c.Dial(&shared.Target{Net: "tcp", Host: "127.0.0.1", Port: 80})
+
+	conn = <-accepted
+	defer conn.Close()
+
+	done = make(chan struct{})
+
+	go func() {
+		c.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Close not to wait for the dial")
+	}
+}
+
+func TestDialBits(t *testing.T) {
+	echo, err := net.Listen("tcp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	port := echo.Addr().(*net.TCPAddr).Port
+
+	for _, bits := range []uint16{768, 1024} {
+		c := testClientAuth(t, &server.AuthConfig{
+			Bits:          bits,
+			Timeout:       5 * time.Second,
+			MinSigSize:    32,
+			MaxSigSize:    auth.MAX_CLIENT_SIG_SIZE,
+			MinIdMetaSize: 2,
+			MaxIdMetaSize: 256,
+			Hybrid:        true,
+		})
+
+		conn, err := c.Dial(&shared.Target{Net: "tcp", Host: "127.0.0.1", Port: uint16(port)})
+
+		if err != nil {
+			t.Fatalf("%d bits: %v", bits, err)
+		}
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		buf := make([]byte, 4)
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("%d bits: expected the echo, got %q %v", bits, buf, err)
+		}
+
+		conn.Close()
+	}
+}
+
+// deadConn fails every write, like a connection that just dropped.
+type deadConn struct {
+	net.Conn
+}
+
+func (d *deadConn) Write(p []byte) (int, error) {
+	return 0, net.ErrClosed
+}
+
+func TestDialRetriesDeadSession(t *testing.T) {
+	echo, err := net.Listen("tcp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	c := testClient(t)
+
+	a, b := net.Pipe()
+	defer b.Close()
+
+	// The pooled session still looks open, it only fails once a stream is opened on it.
+	c.pool = append(c.pool, mux.Client(&deadConn{Conn: a}, nil))
+
+	conn, err := c.Dial(&shared.Target{Net: "tcp", Host: "127.0.0.1", Port: uint16(echo.Addr().(*net.TCPAddr).Port)})
+
+	if err != nil {
+		t.Fatalf("expected the dial to retry on a fresh session, got %v", err)
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, 4)
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected the echo, got %q %v", buf, err)
+	}
+}
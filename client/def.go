@@ -1,18 +1,165 @@
 package client
 
 import (
+	"context"
+	"kriptun/auth"
+	"kriptun/mux"
 	"kriptun/shared"
+	"kriptun/transport"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dipakw/logs"
 )
 
+const (
+	// Streams per multiplexed session before another session is opened.
+	MAX_STREAMS = 256
+
+	// Covers the TCP connect and any TLS or WebSocket handshake.
+	DIAL_TIMEOUT = 10 * time.Second
+
+	// How long the server may take to answer a request, on top of the target connect timeout.
+	REQUEST_TIMEOUT = 5 * time.Second
+)
+
+const (
+	SOCKS_VERSION  = 0x05
+	SOCKS_AUTH_VER = 0x01
+
+	SOCKS_METHOD_NONE     = 0x00
+	SOCKS_METHOD_USERPASS = 0x02
+	SOCKS_METHOD_REJECT   = 0xff
+
+	SOCKS_CMD_CONNECT   = 0x01
+	SOCKS_CMD_BIND      = 0x02
+	SOCKS_CMD_ASSOCIATE = 0x03
+
+	SOCKS_ATYP_IPV4   = 0x01
+	SOCKS_ATYP_DOMAIN = 0x03
+	SOCKS_ATYP_IPV6   = 0x04
+
+	SOCKS_REP_SUCCEEDED           = 0x00
+	SOCKS_REP_GENERAL_FAILURE     = 0x01
+	SOCKS_REP_NOT_ALLOWED         = 0x02
+	SOCKS_REP_NETWORK_UNREACHABLE = 0x03
+	SOCKS_REP_HOST_UNREACHABLE    = 0x04
+	SOCKS_REP_CONN_REFUSED        = 0x05
+	SOCKS_REP_TTL_EXPIRED         = 0x06
+	SOCKS_REP_CMD_NOT_SUPPORTED   = 0x07
+	SOCKS_REP_ATYP_NOT_SUPPORTED  = 0x08
+)
+
 type Config struct {
 	Server   *shared.Addr
 	Log      logs.Log
 	Username string
 	Password string
+
+	// Key signs the challenge instead of the password when set.
+	Key *auth.PrivateKey
+
+	// Server identity pinning, see auth.ClientOpts.
+	ServerFingerprints []string
+	KnownHosts         string
+
+	// Insecure accepts any server identity when neither fingerprints nor a known hosts file are set.
+	Insecure bool
+
+	// RequireHybrid refuses servers that do not offer the X25519 + ML-KEM exchange.
+	RequireHybrid bool
+
+	// Rekey thresholds of the session traffic, defaults are used when nil.
+	Rekey *shared.Rekey
+
+	// NoMux opens a dedicated session for every target instead of multiplexing.
+	NoMux bool
+
+	// Transport to reach the server through, raw TCP when nil.
+	Transport *transport.ClientConfig
 }
 
 type Client struct {
-	conf *Config
+	conf   *Config
+	mu     sync.Mutex
+	pool   []*mux.Session
+	legacy atomic.Bool
+	sign   func(msg []byte) ([]byte, error)
+
+	// The session being opened, nil when no dial is in progress.
+	dialing *dialCall
+}
+
+type dialCall struct {
+	done chan struct{}
+	sess *mux.Session
+	err  error
+}
+
+// StatusErr is returned by Dial when the server answers with anything other than CONN_OPENED.
+type StatusErr struct {
+	Status uint8
+}
+
+type SocksConfig struct {
+	Bind     string
+	Username string
+	Password string
+
+	// Key signs the challenge instead of the password when set.
+	Key     *auth.PrivateKey
+	Timeout time.Duration
+}
+
+type Socks struct {
+	client   *Client
+	conf     *SocksConfig
+	ctx      context.Context
+	cancel   context.CancelFunc
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+type socksAssoc struct {
+	socks   *Socks
+	pc      net.PacketConn
+	peer    net.IP
+	mu      sync.Mutex
+	client  net.Addr
+	tunnels map[string]*PacketConn
+}
+
+type HTTPConfig struct {
+	Bind     string
+	Username string
+	Password string
+
+	// Key signs the challenge instead of the password when set.
+	Key     *auth.PrivateKey
+	Timeout time.Duration
+}
+
+type HTTP struct {
+	client    *Client
+	conf      *HTTPConfig
+	server    *http.Server
+	transport *http.Transport
+	listener  net.Listener
+	wg        sync.WaitGroup
+}
+
+// PacketConn carries datagrams to and from a single udp target.
+type PacketConn struct {
+	conn net.Conn
+	addr *targetAddr
+	mu   sync.Mutex
+	buf  []byte
+}
+
+type targetAddr struct {
+	net  string
+	addr string
 }
@@ -0,0 +1,284 @@
+package client
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"kriptun/shared"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dipakw/logs"
+)
+
+// Hop-by-hop headers are meaningful only for a single connection and must not be forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func NewHTTP(c *Client, conf *HTTPConfig) (*HTTP, error) {
+	if conf.Timeout == 0 {
+		conf.Timeout = 10 * time.Second
+	}
+
+	h := &HTTP{
+		client: c,
+		conf:   conf,
+		wg:     sync.WaitGroup{},
+	}
+
+	h.transport = &http.Transport{
+		Proxy: nil,
+
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return h.dial(addr)
+		},
+
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+
+	h.server = &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: conf.Timeout,
+	}
+
+	return h, nil
+}
+
+func (h *HTTP) Start() error {
+	var err error
+
+	h.listener, err = net.Listen("tcp", h.conf.Bind)
+
+	if err != nil {
+		h.client.conf.Log.Mustf(logs.ERROR, logs.DTAG, "Failed to start HTTP proxy: %s", err.Error())
+		return err
+	}
+
+	h.client.conf.Log.Mustf(logs.INFO, logs.DTAG, "HTTP proxy listening on: %s", h.Addr())
+
+	h.wg.Add(1)
+
+	go func() {
+		defer h.wg.Done()
+
+		if err := h.server.Serve(h.listener); err != nil && err != http.ErrServerClosed {
+			h.client.conf.Log.Err("Failed to serve:", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+func (h *HTTP) Stop() error {
+	h.transport.CloseIdleConnections()
+	return h.server.Close()
+}
+
+func (h *HTTP) Wait() {
+	h.wg.Wait()
+}
+
+func (h *HTTP) Addr() string {
+	if h.listener != nil {
+		return h.listener.Addr().String()
+	}
+
+	return h.conf.Bind
+}
+
+func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="kriptun"`)
+		http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		h.tunnel(w, r)
+		return
+	}
+
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(w, "Only absolute http:// URLs can be proxied", http.StatusBadRequest)
+		return
+	}
+
+	h.forward(w, r)
+}
+
+func (h *HTTP) authorized(r *http.Request) bool {
+	if h.conf.Username == "" {
+		return true
+	}
+
+	scheme, creds, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+
+	dec, err := base64.StdEncoding.DecodeString(strings.TrimSpace(creds))
+
+	if err != nil {
+		return false
+	}
+
+	user, pass, _ := strings.Cut(string(dec), ":")
+
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(h.conf.Username)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(pass), []byte(h.conf.Password)) == 1
+
+	return userOk && passOk
+}
+
+func (h *HTTP) tunnel(w http.ResponseWriter, r *http.Request) {
+	tconn, err := h.dial(r.Host)
+
+	if err != nil {
+		h.client.conf.Log.Errf("Failed to dial: %s | error: %s", r.Host, err.Error())
+		gatewayError(w, err)
+		return
+	}
+
+	defer tconn.Close()
+
+	hj, ok := w.(http.Hijacker)
+
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hj.Hijack()
+
+	if err != nil {
+		h.client.conf.Log.Errf("Failed to hijack: %s | error: %s", r.Host, err.Error())
+		return
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	// Bytes the client sent right after the request may already sit in the buffer.
+	if n := rw.Reader.Buffered(); n > 0 {
+		buf, _ := rw.Reader.Peek(n)
+
+		if _, err := tconn.Write(buf); err != nil {
+			return
+		}
+	}
+
+	pipe(conn, tconn)
+}
+
+func (h *HTTP) forward(w http.ResponseWriter, r *http.Request) {
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+
+	removeHopHeaders(req.Header)
+
+	res, err := h.transport.RoundTrip(req)
+
+	if err != nil {
+		h.client.conf.Log.Errf("Failed to forward: %s | error: %s", r.URL.String(), err.Error())
+		gatewayError(w, err)
+		return
+	}
+
+	defer res.Body.Close()
+
+	removeHopHeaders(res.Header)
+
+	for key, vals := range res.Header {
+		for _, val := range vals {
+			w.Header().Add(key, val)
+		}
+	}
+
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+func (h *HTTP) dial(addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		host, port = addr, "80"
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return h.client.Dial(&shared.Target{
+		Net:  "tcp",
+		Host: host,
+		Port: uint16(p),
+		CToB: uint16(h.conf.Timeout / time.Second),
+	})
+}
+
+// httpStatus maps a Dial error onto a gateway response status.
+func httpStatus(err error) int {
+	var se *StatusErr
+	var ne net.Error
+
+	if errors.As(err, &se) {
+		switch se.Status {
+		case shared.B_CONNECT_TIMEOUT, shared.B_READ_TIMEOUT, shared.B_WRITE_TIMEOUT:
+			return http.StatusGatewayTimeout
+		case shared.INVALID_PROTOCOL, shared.CONN_DENIED:
+			return http.StatusForbidden
+		case shared.QUOTA_EXCEEDED, shared.SESSION_LIMIT:
+			return http.StatusTooManyRequests
+		default:
+			return http.StatusBadGateway
+		}
+	}
+
+	if errors.As(err, &ne) && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+// gatewayError answers with the status of a Dial error, the error itself stays in the log.
+func gatewayError(w http.ResponseWriter, err error) {
+	status := httpStatus(err)
+	http.Error(w, http.StatusText(status), status)
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, val := range header.Values("Connection") {
+		for _, key := range strings.Split(val, ",") {
+			header.Del(strings.TrimSpace(key))
+		}
+	}
+
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+}
@@ -0,0 +1,251 @@
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"kriptun/shared"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testHTTP(t *testing.T, c *Client, conf *HTTPConfig) string {
+	conf.Bind = "127.0.0.1:0"
+
+	h, err := NewHTTP(c, conf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		h.Stop()
+		h.Wait()
+	})
+
+	return h.Addr()
+}
+
+// httpRequest writes raw to a new connection to the proxy and reads the response.
+func httpRequest(t *testing.T, addr string, raw string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn := socksDial(t, addr)
+
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { res.Body.Close() })
+
+	return conn, br, res
+}
+
+func basicAuth(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func TestHTTPAuth(t *testing.T) {
+	addr := testHTTP(t, testClient(t), &HTTPConfig{Username: "alice", Password: "secret"})
+
+	tests := map[string]string{
+		"missing":      "",
+		"bad password": basicAuth("alice", "wrong"),
+		"bad username": basicAuth("bob", "secret"),
+		"bad scheme":   "Bearer " + base64.StdEncoding.EncodeToString([]byte("alice:secret")),
+		"bad encoding": "Basic !!!",
+	}
+
+	for name, header := range tests {
+		t.Run(name, func(t *testing.T) {
+			raw := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n"
+
+			if header != "" {
+				raw += "Proxy-Authorization: " + header + "\r\n"
+			}
+
+			_, _, res := httpRequest(t, addr, raw+"\r\n")
+
+			if res.StatusCode != http.StatusProxyAuthRequired {
+				t.Fatalf("expected 407, got %d", res.StatusCode)
+			}
+
+			if res.Header.Get("Proxy-Authenticate") == "" {
+				t.Fatal("expected a Proxy-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestHTTPForward(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, key := range []string{"Proxy-Authorization", "Proxy-Connection", "Keep-Alive", "X-Hop"} {
+			if r.Header.Get(key) != "" {
+				http.Error(w, key+" was forwarded", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if r.Header.Get("X-End") != "kept" {
+			http.Error(w, "X-End was dropped", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Connection", "X-Hop-Res")
+		w.Header().Set("X-Hop-Res", "1")
+		w.Header().Set("X-End-Res", "kept")
+		io.WriteString(w, "hello")
+	}))
+
+	defer backend.Close()
+
+	addr := testHTTP(t, testClient(t), &HTTPConfig{Username: "alice", Password: "secret"})
+	host := backend.Listener.Addr().String()
+
+	_, _, res := httpRequest(t, addr, "GET http://"+host+"/ HTTP/1.1\r\n"+
+		"Host: "+host+"\r\n"+
+		"Proxy-Authorization: "+basicAuth("alice", "secret")+"\r\n"+
+		"Proxy-Connection: keep-alive\r\n"+
+		"Connection: X-Hop\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"X-Hop: 1\r\n"+
+		"X-End: kept\r\n\r\n")
+
+	body, _ := io.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("expected the backend response, got %d %q", res.StatusCode, body)
+	}
+
+	if res.Header.Get("X-Hop-Res") != "" || res.Header.Get("X-End-Res") != "kept" {
+		t.Fatalf("expected only hop-by-hop response headers to be removed, got %v", res.Header)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	echo, err := net.Listen("tcp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	addr := testHTTP(t, testClient(t), &HTTPConfig{})
+	host := echo.Addr().String()
+
+	// The first bytes of the tunnel are sent together with the request.
+	conn, br, res := httpRequest(t, addr, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\nping")
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the tunnel to open, got %d", res.StatusCode)
+	}
+
+	if _, err := io.WriteString(conn, "pong"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 8)
+
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "pingpong" {
+		t.Fatalf("expected the echo, got %q %v", buf, err)
+	}
+}
+
+func TestHTTPDialErrors(t *testing.T) {
+	closed, err := net.Listen("tcp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed.Close()
+
+	addr := testHTTP(t, testClient(t), &HTTPConfig{})
+	refused := closed.Addr().String()
+
+	tests := []struct {
+		raw    string
+		status int
+	}{
+		{"CONNECT " + refused + " HTTP/1.1\r\nHost: " + refused + "\r\n\r\n", http.StatusBadGateway},
+		{"CONNECT 10.0.0.1:80 HTTP/1.1\r\nHost: 10.0.0.1:80\r\n\r\n", http.StatusForbidden},
+		{"GET http://" + refused + "/ HTTP/1.1\r\nHost: " + refused + "\r\n\r\n", http.StatusBadGateway},
+		{"GET http://10.0.0.1/ HTTP/1.1\r\nHost: 10.0.0.1\r\n\r\n", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		line, _, _ := strings.Cut(tt.raw, "\r\n")
+
+		_, _, res := httpRequest(t, addr, tt.raw)
+
+		body, _ := io.ReadAll(res.Body)
+
+		if res.StatusCode != tt.status {
+			t.Fatalf("%s: expected %d, got %d", line, tt.status, res.StatusCode)
+		}
+
+		// The dial error is logged, never sent to the browser.
+		if text := strings.TrimSpace(string(body)); text != http.StatusText(tt.status) {
+			t.Fatalf("%s: expected the status text, got %q", line, text)
+		}
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	tests := map[uint8]int{
+		shared.INVALID_PROTOCOL:  http.StatusForbidden,
+		shared.CONN_DENIED:       http.StatusForbidden,
+		shared.QUOTA_EXCEEDED:    http.StatusTooManyRequests,
+		shared.SESSION_LIMIT:     http.StatusTooManyRequests,
+		shared.B_CONNECT_TIMEOUT: http.StatusGatewayTimeout,
+		shared.B_READ_TIMEOUT:    http.StatusGatewayTimeout,
+		shared.B_WRITE_TIMEOUT:   http.StatusGatewayTimeout,
+		shared.CONN_REFUSED:      http.StatusBadGateway,
+		shared.RESOLVE_FAILED:    http.StatusBadGateway,
+		shared.CONN_RESET:        http.StatusBadGateway,
+	}
+
+	for status, code := range tests {
+		if got := httpStatus(&StatusErr{Status: status}); got != code {
+			t.Errorf("status %s: expected %d, got %d", shared.STATUS_NAMES[status], code, got)
+		}
+	}
+
+	if got := httpStatus(os.ErrDeadlineExceeded); got != http.StatusGatewayTimeout {
+		t.Errorf("expected a timeout to map to 504, got %d", got)
+	}
+
+	if got := httpStatus(errors.New("dial failed")); got != http.StatusBadGateway {
+		t.Errorf("expected other errors to map to 502, got %d", got)
+	}
+}
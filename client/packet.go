@@ -0,0 +1,96 @@
+package client
+
+import (
+	"errors"
+	"kriptun/shared"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ListenPacket opens a tunnel to a udp target and returns it as a net.PacketConn.
+// Every datagram written is delivered to the target, and ReadFrom returns the target's replies.
+func (c *Client) ListenPacket(t *shared.Target) (*PacketConn, error) {
+	if t.Net != "udp" {
+		return nil, errors.New("packet conn requires a udp target")
+	}
+
+	conn, err := c.Dial(t)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &PacketConn{
+		conn: conn,
+		addr: &targetAddr{
+			net:  t.Net,
+			addr: net.JoinHostPort(t.Host, strconv.Itoa(int(t.Port))),
+		},
+		buf: make([]byte, shared.MAX_DATAGRAM_SIZE),
+	}, nil
+}
+
+// ReadFrom reads a single datagram, truncating it if p is too small.
+func (pc *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	n, err := shared.ReadDatagram(pc.conn, pc.buf)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return copy(p, pc.buf[:n]), pc.addr, nil
+}
+
+// WriteTo sends p as a single datagram. The tunnel is bound to its target, so addr is ignored.
+func (pc *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if err := shared.WriteDatagram(pc.conn, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (pc *PacketConn) Read(p []byte) (int, error) {
+	n, _, err := pc.ReadFrom(p)
+	return n, err
+}
+
+func (pc *PacketConn) Write(p []byte) (int, error) {
+	return pc.WriteTo(p, pc.addr)
+}
+
+func (pc *PacketConn) Close() error {
+	return pc.conn.Close()
+}
+
+func (pc *PacketConn) LocalAddr() net.Addr {
+	return pc.conn.LocalAddr()
+}
+
+func (pc *PacketConn) RemoteAddr() net.Addr {
+	return pc.addr
+}
+
+func (pc *PacketConn) SetDeadline(t time.Time) error {
+	return pc.conn.SetDeadline(t)
+}
+
+func (pc *PacketConn) SetReadDeadline(t time.Time) error {
+	return pc.conn.SetReadDeadline(t)
+}
+
+func (pc *PacketConn) SetWriteDeadline(t time.Time) error {
+	return pc.conn.SetWriteDeadline(t)
+}
+
+func (a *targetAddr) Network() string {
+	return a.net
+}
+
+func (a *targetAddr) String() string {
+	return a.addr
+}
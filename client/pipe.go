@@ -0,0 +1,28 @@
+package client
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// pipe copies data between a and b in both directions until either side is done.
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		io.Copy(dst, src)
+
+		// Neither side supports half-close, so close both ends.
+		a.Close()
+		b.Close()
+	}
+
+	go cp(a, b)
+	go cp(b, a)
+
+	wg.Wait()
+}
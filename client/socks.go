@@ -0,0 +1,500 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"kriptun/shared"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dipakw/logs"
+)
+
+var errSocksAtyp = errors.New("address type not supported")
+
+func NewSocks(c *Client, conf *SocksConfig) (*Socks, error) {
+	if conf.Timeout == 0 {
+		conf.Timeout = 10 * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Socks{
+		client: c,
+		conf:   conf,
+		ctx:    ctx,
+		cancel: cancel,
+		wg:     sync.WaitGroup{},
+	}
+
+	return s, nil
+}
+
+func (s *Socks) Start() error {
+	var err error
+
+	s.listener, err = net.Listen("tcp", s.conf.Bind)
+
+	if err != nil {
+		s.client.conf.Log.Mustf(logs.ERROR, logs.DTAG, "Failed to start SOCKS5 listener: %s", err.Error())
+		return err
+	}
+
+	s.client.conf.Log.Mustf(logs.INFO, logs.DTAG, "SOCKS5 listening on: %s", s.Addr())
+
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+		defer s.listener.Close()
+
+		for {
+			conn, err := s.listener.Accept()
+
+			if err != nil {
+				if s.ctx.Err() == nil {
+					s.client.conf.Log.Err("Failed to accept:", err.Error())
+				}
+
+				return
+			}
+
+			go s.handle(conn)
+		}
+	}()
+
+	return nil
+}
+
+func (s *Socks) Stop() error {
+	s.cancel()
+
+	// Nothing is listening when Start failed.
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Close()
+}
+
+func (s *Socks) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Socks) Addr() string {
+	if s.listener != nil {
+		return s.listener.Addr().String()
+	}
+
+	return s.conf.Bind
+}
+
+func (s *Socks) handle(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(s.conf.Timeout))
+
+	if err := s.negotiate(conn); err != nil {
+		s.client.conf.Log.Errf("SOCKS5 negotiation failed: %s | error: %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+
+	head := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, head); err != nil {
+		s.client.conf.Log.Errf("Failed to read SOCKS5 request: %s | error: %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+
+	if head[0] != SOCKS_VERSION {
+		s.client.conf.Log.Errf("Invalid SOCKS5 request version: %s | version: %d", conn.RemoteAddr().String(), head[0])
+		return
+	}
+
+	host, port, err := readSocksAddr(conn, head[3])
+
+	if err != nil {
+		if err == errSocksAtyp {
+			writeSocksReply(conn, SOCKS_REP_ATYP_NOT_SUPPORTED, nil)
+		}
+
+		s.client.conf.Log.Errf("Failed to read SOCKS5 address: %s | error: %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	switch head[1] {
+	case SOCKS_CMD_CONNECT:
+		s.connect(conn, host, port)
+	case SOCKS_CMD_ASSOCIATE:
+		s.associate(conn)
+	default:
+		writeSocksReply(conn, SOCKS_REP_CMD_NOT_SUPPORTED, nil)
+	}
+}
+
+func (s *Socks) negotiate(conn net.Conn) error {
+	buf := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+
+	if buf[0] != SOCKS_VERSION {
+		return fmt.Errorf("unsupported version: %d", buf[0])
+	}
+
+	methods := make([]byte, buf[1])
+
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	method := byte(SOCKS_METHOD_NONE)
+
+	if s.conf.Username != "" {
+		method = SOCKS_METHOD_USERPASS
+	}
+
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{SOCKS_VERSION, SOCKS_METHOD_REJECT})
+		return errors.New("no acceptable auth method")
+	}
+
+	if _, err := conn.Write([]byte{SOCKS_VERSION, method}); err != nil {
+		return err
+	}
+
+	if method == SOCKS_METHOD_USERPASS {
+		return s.authenticate(conn)
+	}
+
+	return nil
+}
+
+// authenticate runs the username/password sub-negotiation (RFC 1929).
+func (s *Socks) authenticate(conn net.Conn) error {
+	buf := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+
+	if buf[0] != SOCKS_AUTH_VER {
+		return fmt.Errorf("unsupported auth version: %d", buf[0])
+	}
+
+	user := make([]byte, buf[1])
+
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return err
+	}
+
+	pass := make([]byte, buf[0])
+
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return err
+	}
+
+	userOk := subtle.ConstantTimeCompare(user, []byte(s.conf.Username)) == 1
+	passOk := subtle.ConstantTimeCompare(pass, []byte(s.conf.Password)) == 1
+
+	if !userOk || !passOk {
+		conn.Write([]byte{SOCKS_AUTH_VER, 0x01})
+		return errors.New("invalid credentials")
+	}
+
+	_, err := conn.Write([]byte{SOCKS_AUTH_VER, 0x00})
+
+	return err
+}
+
+func (s *Socks) connect(conn net.Conn, host string, port uint16) {
+	tconn, err := s.client.Dial(&shared.Target{
+		Net:  "tcp",
+		Host: host,
+		Port: port,
+		CToB: uint16(s.conf.Timeout / time.Second),
+	})
+
+	if err != nil {
+		s.client.conf.Log.Errf("Failed to dial: %s | error: %s", net.JoinHostPort(host, strconv.Itoa(int(port))), err.Error())
+		writeSocksReply(conn, socksReply(err), nil)
+		return
+	}
+
+	defer tconn.Close()
+
+	if err := writeSocksReply(conn, SOCKS_REP_SUCCEEDED, conn.LocalAddr()); err != nil {
+		return
+	}
+
+	pipe(conn, tconn)
+}
+
+func (s *Socks) associate(conn net.Conn) {
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+
+	if err != nil {
+		s.client.conf.Log.Errf("Failed to listen UDP: %s | error: %s", conn.RemoteAddr().String(), err.Error())
+		writeSocksReply(conn, SOCKS_REP_GENERAL_FAILURE, nil)
+		return
+	}
+
+	defer pc.Close()
+
+	if err := writeSocksReply(conn, SOCKS_REP_SUCCEEDED, pc.LocalAddr()); err != nil {
+		return
+	}
+
+	peer, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	a := &socksAssoc{
+		socks:   s,
+		pc:      pc,
+		peer:    net.ParseIP(peer),
+		tunnels: map[string]*PacketConn{},
+	}
+
+	go a.run()
+	defer a.close()
+
+	// The association lives as long as the control connection.
+	io.Copy(io.Discard, conn)
+}
+
+func (a *socksAssoc) run() {
+	buf := make([]byte, 65535)
+
+	for {
+		n, from, err := a.pc.ReadFrom(buf)
+
+		if err != nil {
+			return
+		}
+
+		udpFrom, ok := from.(*net.UDPAddr)
+
+		// Only accept datagrams from the host that opened the association.
+		if !ok || (a.peer != nil && !a.peer.Equal(udpFrom.IP)) {
+			continue
+		}
+
+		// [RSV:2][FRAG:1][ATYP:1][DST.ADDR][DST.PORT][DATA], fragments are not supported.
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+
+		host, port, size, err := parseSocksAddr(buf[3:n])
+
+		if err != nil {
+			continue
+		}
+
+		a.mu.Lock()
+		a.client = from
+		a.mu.Unlock()
+
+		pc, err := a.tunnel(host, port)
+
+		if err != nil {
+			a.socks.client.conf.Log.Errf("Failed to dial UDP: %s | error: %s", net.JoinHostPort(host, strconv.Itoa(int(port))), err.Error())
+			continue
+		}
+
+		pc.WriteTo(buf[3+size:n], nil)
+	}
+}
+
+func (a *socksAssoc) tunnel(host string, port uint16) (*PacketConn, error) {
+	key := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	a.mu.Lock()
+	pc, ok := a.tunnels[key]
+	a.mu.Unlock()
+
+	if ok {
+		return pc, nil
+	}
+
+	pc, err := a.socks.client.ListenPacket(&shared.Target{
+		Net:  "udp",
+		Host: host,
+		Port: port,
+		CToB: uint16(a.socks.conf.Timeout / time.Second),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.tunnels[key] = pc
+	a.mu.Unlock()
+
+	head := appendSocksAddr([]byte{0x00, 0x00, 0x00}, host, port)
+
+	go func() {
+		defer func() {
+			a.mu.Lock()
+			delete(a.tunnels, key)
+			a.mu.Unlock()
+			pc.Close()
+		}()
+
+		buf := make([]byte, shared.MAX_DATAGRAM_SIZE)
+
+		for {
+			n, _, err := pc.ReadFrom(buf)
+
+			if err != nil {
+				return
+			}
+
+			a.mu.Lock()
+			client := a.client
+			a.mu.Unlock()
+
+			if _, err := a.pc.WriteTo(append(head[:len(head):len(head)], buf[:n]...), client); err != nil {
+				return
+			}
+		}
+	}()
+
+	return pc, nil
+}
+
+func (a *socksAssoc) close() {
+	a.pc.Close()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, pc := range a.tunnels {
+		pc.Close()
+	}
+}
+
+// socksReply maps a Dial error onto the closest SOCKS5 reply code.
+func socksReply(err error) byte {
+	var se *StatusErr
+
+	if !errors.As(err, &se) {
+		return SOCKS_REP_GENERAL_FAILURE
+	}
+
+	switch se.Status {
+	case shared.CONN_REFUSED:
+		return SOCKS_REP_CONN_REFUSED
+	case shared.RESOLVE_FAILED:
+		return SOCKS_REP_HOST_UNREACHABLE
+	case shared.B_CONNECT_TIMEOUT:
+		return SOCKS_REP_TTL_EXPIRED
+	case shared.INVALID_PROTOCOL, shared.CONN_DENIED, shared.QUOTA_EXCEEDED, shared.SESSION_LIMIT:
+		return SOCKS_REP_NOT_ALLOWED
+	case shared.CONN_RESET, shared.CONN_ERRORED:
+		return SOCKS_REP_NETWORK_UNREACHABLE
+	default:
+		return SOCKS_REP_GENERAL_FAILURE
+	}
+}
+
+func readSocksAddr(r io.Reader, atyp byte) (string, uint16, error) {
+	var size int
+
+	switch atyp {
+	case SOCKS_ATYP_IPV4:
+		size = net.IPv4len
+	case SOCKS_ATYP_IPV6:
+		size = net.IPv6len
+	case SOCKS_ATYP_DOMAIN:
+		buf := make([]byte, 1)
+
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", 0, err
+		}
+
+		size = int(buf[0])
+	default:
+		return "", 0, errSocksAtyp
+	}
+
+	buf := make([]byte, size+2)
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", 0, err
+	}
+
+	host := string(buf[:size])
+
+	if atyp != SOCKS_ATYP_DOMAIN {
+		host = net.IP(buf[:size]).String()
+	}
+
+	return host, binary.BigEndian.Uint16(buf[size:]), nil
+}
+
+// parseSocksAddr parses [ATYP][ADDR][PORT] and returns the number of bytes consumed.
+func parseSocksAddr(b []byte) (string, uint16, int, error) {
+	r := bytes.NewReader(b)
+
+	if len(b) < 1 {
+		return "", 0, 0, io.ErrUnexpectedEOF
+	}
+
+	r.ReadByte()
+
+	host, port, err := readSocksAddr(r, b[0])
+
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	return host, port, len(b) - r.Len(), nil
+}
+
+func appendSocksAddr(b []byte, host string, port uint16) []byte {
+	ip := net.ParseIP(host)
+
+	switch {
+	case ip == nil:
+		b = append(b, SOCKS_ATYP_DOMAIN, byte(len(host)))
+		b = append(b, host...)
+	case ip.To4() != nil:
+		b = append(b, SOCKS_ATYP_IPV4)
+		b = append(b, ip.To4()...)
+	default:
+		b = append(b, SOCKS_ATYP_IPV6)
+		b = append(b, ip.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, port)
+}
+
+func writeSocksReply(conn net.Conn, rep byte, addr net.Addr) error {
+	host, port := "0.0.0.0", uint16(0)
+
+	if addr != nil {
+		if h, p, err := net.SplitHostPort(addr.String()); err == nil {
+			n, _ := strconv.Atoi(p)
+			host, port = h, uint16(n)
+		}
+	}
+
+	_, err := conn.Write(appendSocksAddr([]byte{SOCKS_VERSION, rep, 0x00}, host, port))
+
+	return err
+}
@@ -0,0 +1,448 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"kriptun/server"
+	"kriptun/shared"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dipakw/logs"
+)
+
+// testClient starts a server on loopback and returns a client of it authenticating as user/pw.
+func testClient(t *testing.T) *Client {
+	return testClientAuth(t, nil)
+}
+
+// testClientAuth is testClient with the handshake parameters of the server, defaults when nil.
+func testClientAuth(t *testing.T, auth *server.AuthConfig) *Client {
+	_, identity, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := logs.New(&logs.Config{Allow: logs.NONE})
+
+	s, err := server.New(&server.Config{
+		Listeners:    []*server.Listener{{Net: "tcp4", Addr: "127.0.0.1:0"}},
+		Log:          log,
+		Identity:     identity,
+		Auth:         auth,
+		AllowPrivate: []string{"127.0.0.0/8"},
+		PwFN: func(id string) ([]byte, error) {
+			if id != "user" {
+				return nil, errors.New("unknown user")
+			}
+
+			return []byte("pw"), nil
+		},
+		ProtoFN: func(id string, proto string) bool { return true },
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		s.Stop()
+		s.Wait()
+	})
+
+	c, err := New(&Config{
+		Server:   &shared.Addr{Net: "tcp", Addr: s.Addr()[0]},
+		Log:      log,
+		Username: "user",
+		Password: "pw",
+		Insecure: true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func testSocks(t *testing.T, c *Client, conf *SocksConfig) string {
+	conf.Bind = "127.0.0.1:0"
+
+	s, err := NewSocks(c, conf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		s.Stop()
+		s.Wait()
+	})
+
+	return s.Addr()
+}
+
+// socksRequest sends a request for addr and returns the reply code and the bound address.
+func socksRequest(t *testing.T, conn net.Conn, cmd byte, addr string) (byte, *net.UDPAddr) {
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, _ := net.LookupPort("tcp", port)
+
+	if _, err := conn.Write(appendSocksAddr([]byte{SOCKS_VERSION, cmd, 0x00}, host, uint16(n))); err != nil {
+		t.Fatal(err)
+	}
+
+	head := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, head); err != nil {
+		t.Fatal(err)
+	}
+
+	bhost, bport, err := readSocksAddr(conn, head[3])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return head[1], &net.UDPAddr{IP: net.ParseIP(bhost), Port: int(bport)}
+}
+
+func socksDial(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return conn
+}
+
+func TestSocksNegotiate(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    *SocksConfig
+		methods []byte
+		auth    []byte // RFC 1929 request, nil when no sub-negotiation is expected
+		reply   []byte
+		ok      bool
+	}{
+		{
+			name:    "no auth",
+			conf:    &SocksConfig{},
+			methods: []byte{SOCKS_METHOD_NONE},
+			reply:   []byte{SOCKS_VERSION, SOCKS_METHOD_NONE},
+			ok:      true,
+		},
+		{
+			name:    "no auth offered only user/pass",
+			conf:    &SocksConfig{},
+			methods: []byte{SOCKS_METHOD_USERPASS},
+			reply:   []byte{SOCKS_VERSION, SOCKS_METHOD_REJECT},
+		},
+		{
+			name:    "user/pass required",
+			conf:    &SocksConfig{Username: "alice", Password: "secret"},
+			methods: []byte{SOCKS_METHOD_NONE},
+			reply:   []byte{SOCKS_VERSION, SOCKS_METHOD_REJECT},
+		},
+		{
+			name:    "user/pass success",
+			conf:    &SocksConfig{Username: "alice", Password: "secret"},
+			methods: []byte{SOCKS_METHOD_NONE, SOCKS_METHOD_USERPASS},
+			auth:    []byte("\x01\x05alice\x06secret"),
+			reply:   []byte{SOCKS_VERSION, SOCKS_METHOD_USERPASS, SOCKS_AUTH_VER, 0x00},
+			ok:      true,
+		},
+		{
+			name:    "user/pass bad password",
+			conf:    &SocksConfig{Username: "alice", Password: "secret"},
+			methods: []byte{SOCKS_METHOD_USERPASS},
+			auth:    []byte("\x01\x05alice\x06wrong!"),
+			reply:   []byte{SOCKS_VERSION, SOCKS_METHOD_USERPASS, SOCKS_AUTH_VER, 0x01},
+		},
+		{
+			name:    "user/pass bad username",
+			conf:    &SocksConfig{Username: "alice", Password: "secret"},
+			methods: []byte{SOCKS_METHOD_USERPASS},
+			auth:    []byte("\x01\x03bob\x06secret"),
+			reply:   []byte{SOCKS_VERSION, SOCKS_METHOD_USERPASS, SOCKS_AUTH_VER, 0x01},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := net.Pipe()
+			defer client.Close()
+
+			s := &Socks{conf: tt.conf}
+			done := make(chan error, 1)
+
+			go func() {
+				done <- s.negotiate(conn)
+				conn.Close()
+			}()
+
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+
+			req := append([]byte{SOCKS_VERSION, byte(len(tt.methods))}, tt.methods...)
+
+			if _, err := client.Write(req); err != nil {
+				t.Fatal(err)
+			}
+
+			reply := make([]byte, len(tt.reply))
+
+			if _, err := io.ReadFull(client, reply[:2]); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.auth != nil {
+				if _, err := client.Write(tt.auth); err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := io.ReadFull(client, reply[2:]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !bytes.Equal(reply, tt.reply) {
+				t.Fatalf("expected reply %x, got %x", tt.reply, reply)
+			}
+
+			if err := <-done; (err == nil) != tt.ok {
+				t.Fatalf("expected ok %v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestSocksConnect(t *testing.T) {
+	echo, err := net.Listen("tcp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// Nothing listens on a closed listener's port.
+	closed, err := net.Listen("tcp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed.Close()
+
+	addr := testSocks(t, testClient(t), &SocksConfig{Username: "alice", Password: "secret"})
+
+	conn := socksDial(t, addr)
+
+	if _, err := conn.Write([]byte("\x05\x01\x02\x01\x05alice\x06secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, []byte{0x05, 0x02, 0x01, 0x00}) {
+		t.Fatalf("expected user/pass to succeed, got %x %v", buf, err)
+	}
+
+	if rep, _ := socksRequest(t, conn, SOCKS_CMD_CONNECT, echo.Addr().String()); rep != SOCKS_REP_SUCCEEDED {
+		t.Fatalf("expected the connect to succeed, got %d", rep)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected the echo, got %q %v", buf, err)
+	}
+
+	conn = socksDial(t, addr)
+
+	if _, err := conn.Write([]byte("\x05\x01\x02\x01\x05alice\x06secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if rep, _ := socksRequest(t, conn, SOCKS_CMD_CONNECT, closed.Addr().String()); rep != SOCKS_REP_CONN_REFUSED {
+		t.Fatalf("expected the connect to be refused, got %d", rep)
+	}
+}
+
+func TestSocksAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer echo.Close()
+
+	go func() {
+		buf := make([]byte, 1500)
+
+		for {
+			n, from, err := echo.ReadFrom(buf)
+
+			if err != nil {
+				return
+			}
+
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	conn := socksDial(t, testSocks(t, testClient(t), &SocksConfig{}))
+
+	if _, err := conn.Write([]byte{SOCKS_VERSION, 0x01, SOCKS_METHOD_NONE}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, relay := socksRequest(t, conn, SOCKS_CMD_ASSOCIATE, "0.0.0.0:0")
+
+	if rep != SOCKS_REP_SUCCEEDED || relay.Port == 0 {
+		t.Fatalf("expected the associate to succeed, got %d %s", rep, relay)
+	}
+
+	pc, err := net.DialUDP("udp", nil, relay)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pc.Close()
+
+	eaddr := echo.LocalAddr().(*net.UDPAddr)
+	head := appendSocksAddr([]byte{0x00, 0x00, 0x00}, eaddr.IP.String(), uint16(eaddr.Port))
+
+	if _, err := pc.Write(append(head, "ping"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	reply := make([]byte, 1500)
+	n, err := pc.Read(reply)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(reply[:n], append(head, "ping"...)) {
+		t.Fatalf("expected the echo from %s, got %x", eaddr, reply[:n])
+	}
+}
+
+func TestSocksReply(t *testing.T) {
+	tests := map[uint8]byte{
+		shared.INVALID_PROTOCOL:  SOCKS_REP_NOT_ALLOWED,
+		shared.RESOLVE_FAILED:    SOCKS_REP_HOST_UNREACHABLE,
+		shared.MALFORMED_REQUEST: SOCKS_REP_GENERAL_FAILURE,
+		shared.CONN_EOF:          SOCKS_REP_GENERAL_FAILURE,
+		shared.CONN_REFUSED:      SOCKS_REP_CONN_REFUSED,
+		shared.CONN_RESET:        SOCKS_REP_NETWORK_UNREACHABLE,
+		shared.CONN_ERRORED:      SOCKS_REP_NETWORK_UNREACHABLE,
+		shared.A_READ_TIMEOUT:    SOCKS_REP_GENERAL_FAILURE,
+		shared.B_READ_TIMEOUT:    SOCKS_REP_GENERAL_FAILURE,
+		shared.A_WRITE_TIMEOUT:   SOCKS_REP_GENERAL_FAILURE,
+		shared.B_WRITE_TIMEOUT:   SOCKS_REP_GENERAL_FAILURE,
+		shared.A_CONNECT_TIMEOUT: SOCKS_REP_GENERAL_FAILURE,
+		shared.B_CONNECT_TIMEOUT: SOCKS_REP_TTL_EXPIRED,
+		shared.CONN_DENIED:       SOCKS_REP_NOT_ALLOWED,
+		shared.QUOTA_EXCEEDED:    SOCKS_REP_NOT_ALLOWED,
+		shared.SESSION_LIMIT:     SOCKS_REP_NOT_ALLOWED,
+	}
+
+	for status := range shared.STATUS_NAMES {
+		if _, ok := tests[status]; !ok && status != shared.CONN_OPENED {
+			t.Errorf("no expected reply for status %s", shared.STATUS_NAMES[status])
+		}
+	}
+
+	for status, rep := range tests {
+		if got := socksReply(&StatusErr{Status: status}); got != rep {
+			t.Errorf("status %s: expected reply %d, got %d", shared.STATUS_NAMES[status], rep, got)
+		}
+	}
+
+	if got := socksReply(errors.New("dial failed")); got != SOCKS_REP_GENERAL_FAILURE {
+		t.Errorf("expected a general failure for other errors, got %d", got)
+	}
+}
+
+func TestSocksStopUnstarted(t *testing.T) {
+	taken, err := net.Listen("tcp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer taken.Close()
+
+	s, err := NewSocks(testClient(t), &SocksConfig{Bind: taken.Addr().String()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Start(); err == nil {
+		t.Fatal("expected Start to fail on a taken address")
+	}
+
+	// Stop after a failed Start must not panic.
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Wait()
+}
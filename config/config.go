@@ -0,0 +1,428 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kriptun/acl"
+	"kriptun/auth"
+	"kriptun/limit"
+	"kriptun/proxyproto"
+	"kriptun/shared"
+	"kriptun/transport"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default returns the configuration used when no file is given.
+func Default() *Config {
+	return &Config{
+		Listeners: []*Listener{
+			{
+				Net:  "tcp",
+				Addr: "[::]:8890",
+			},
+		},
+
+		Identity: "kriptun.key",
+
+		Auth: &Auth{
+			Bits:          768,
+			Timeout:       "5s",
+			MinSigSize:    32,
+			MaxSigSize:    auth.MAX_CLIENT_SIG_SIZE,
+			MinIdMetaSize: 2,
+			MaxIdMetaSize: 256,
+			DelayOnAuth:   "0s",
+			Hybrid:        true,
+		},
+
+		Timeouts: &Timeouts{
+			Request:  "5s",
+			Shutdown: "30s",
+		},
+
+		Rekey: &Rekey{
+			Bytes:    shared.REKEY_BYTES,
+			Interval: "1h",
+		},
+
+		Log: &Log{
+			Level: "info",
+			Color: true,
+		},
+
+		Users: &Users{
+			File: "users.json",
+		},
+
+		Policies: &Policies{
+			Protocols:    []string{},
+			Default:      acl.ALLOW,
+			Rules:        []*acl.Rule{},
+			AllowPrivate: []string{},
+		},
+
+		Accounting: &Accounting{
+			Interval: "1m",
+		},
+
+		Limits: &Limits{
+			Defaults: &limit.Limits{},
+			State:    "quota.json",
+		},
+
+		Sessions: &Sessions{
+			OnLimit: "reject",
+		},
+
+		Metrics: &Metrics{},
+
+		Admin: &Admin{},
+	}
+}
+
+// Load reads the file at path on top of the defaults and validates it.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conf := Default()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(conf); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, decodeErr(data, err))
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// Validate checks every field and reports all errors at once.
+func (c *Config) Validate() error {
+	var errs Errors
+
+	add := func(path string, format string, a ...any) {
+		errs = append(errs, &FieldErr{Path: path, Msg: fmt.Sprintf(format, a...)})
+	}
+
+	if len(c.Listeners) == 0 {
+		add("listeners", "at least one listener is required")
+	}
+
+	seen := map[string]int{}
+
+	for i, l := range c.Listeners {
+		path := fmt.Sprintf("listeners[%d]", i)
+
+		if l == nil {
+			add(path, "must not be null")
+			continue
+		}
+
+		switch l.Net {
+		case "tcp", "tcp4", "tcp6":
+			if err := validHostPort(l.Addr); err != nil {
+				add(path+".addr", "%s", err.Error())
+			}
+
+			if l.Mode != "" {
+				add(path+".mode", "only applies to unix sockets")
+			}
+
+			if d, err := time.ParseDuration(string(l.KeepAlive)); l.KeepAlive != "" && (err != nil || d < 0) {
+				add(path+".keep_alive", "must be a duration such as \"30s\", got %q", l.KeepAlive)
+			}
+
+			for j, cidr := range l.ProxyProtocol {
+				if _, err := proxyproto.ParseTrusted([]string{cidr}); err != nil {
+					add(fmt.Sprintf("%s.proxy_protocol[%d]", path, j), "invalid CIDR %q", cidr)
+				}
+			}
+		case "unix":
+			if l.Addr == "" {
+				add(path+".addr", "unix socket path is required")
+			}
+
+			if m, err := strconv.ParseUint(l.Mode, 8, 32); l.Mode != "" && (err != nil || m == 0 || m > 0777) {
+				add(path+".mode", "must be an octal permission such as \"0660\", got %q", l.Mode)
+			}
+
+			if l.KeepAlive != "" {
+				add(path+".keep_alive", "only applies to tcp listeners")
+			}
+
+			if len(l.ProxyProtocol) > 0 {
+				add(path+".proxy_protocol", "only applies to tcp listeners")
+			}
+		default:
+			add(path+".net", "unsupported network %q, must be tcp, tcp4, tcp6 or unix", l.Net)
+		}
+
+		switch l.Transport {
+		case "", transport.TCP:
+			if l.Cert != "" || l.Key != "" {
+				add(path+".cert", "only applies to the tls and wss transports")
+			}
+		case transport.TLS, transport.WSS:
+			if l.Cert == "" || l.Key == "" {
+				add(path+".cert", "cert and key are required for the %s transport", l.Transport)
+			}
+		default:
+			add(path+".transport", "unsupported transport %q, must be tcp, tls or wss", l.Transport)
+		}
+
+		if l.Path != "" && l.Transport != transport.WSS {
+			add(path+".path", "only applies to the wss transport")
+		} else if l.Path != "" && !strings.HasPrefix(l.Path, "/") {
+			add(path+".path", "must start with /, got %q", l.Path)
+		}
+
+		if j, ok := seen[l.Addr]; ok {
+			add(path+".addr", "%q is already used by listeners[%d]", l.Addr, j)
+		} else {
+			seen[l.Addr] = i
+		}
+	}
+
+	if c.Identity == "" {
+		add("identity", "identity key file is required")
+	}
+
+	if a := c.Auth; a == nil {
+		add("auth", "must not be null")
+	} else {
+		if a.Bits != 768 && a.Bits != 1024 {
+			add("auth.bits", "must be 768 or 1024, got %d", a.Bits)
+		}
+
+		if d, err := time.ParseDuration(string(a.Timeout)); err != nil || d <= 0 {
+			add("auth.timeout", "must be a positive duration such as \"5s\", got %q", a.Timeout)
+		}
+
+		if a.MaxSigSize == 0 {
+			add("auth.max_sig_size", "must be greater than zero")
+		}
+
+		if a.MinSigSize > a.MaxSigSize {
+			add("auth.min_sig_size", "must not exceed max_sig_size (%d)", a.MaxSigSize)
+		}
+
+		if a.MinIdMetaSize < 2 {
+			add("auth.min_id_meta_size", "must be at least 2")
+		}
+
+		if a.MinIdMetaSize > a.MaxIdMetaSize {
+			add("auth.min_id_meta_size", "must not exceed max_id_meta_size (%d)", a.MaxIdMetaSize)
+		}
+
+		if d, err := time.ParseDuration(string(a.DelayOnAuth)); a.DelayOnAuth != "" && (err != nil || d < 0) {
+			add("auth.delay_on_auth", "must be a duration such as \"100ms\", got %q", a.DelayOnAuth)
+		}
+	}
+
+	if t := c.Timeouts; t == nil {
+		add("timeouts", "must not be null")
+	} else {
+		if d, err := time.ParseDuration(string(t.Request)); err != nil || d <= 0 {
+			add("timeouts.request", "must be a positive duration such as \"5s\", got %q", t.Request)
+		}
+
+		if d, err := time.ParseDuration(string(t.Shutdown)); err != nil || d < 0 {
+			add("timeouts.shutdown", "must be a duration such as \"30s\", got %q", t.Shutdown)
+		}
+	}
+
+	if r := c.Rekey; r == nil {
+		add("rekey", "must not be null")
+	} else if d, err := time.ParseDuration(string(r.Interval)); r.Interval != "" && (err != nil || d < 0) {
+		add("rekey.interval", "must be a duration such as \"1h\", got %q", r.Interval)
+	}
+
+	if c.Log == nil {
+		add("log", "must not be null")
+	} else if _, ok := LOG_LEVELS[c.Log.Level]; !ok {
+		add("log.level", "unknown level %q, must be info, warn, error or none", c.Log.Level)
+	}
+
+	if c.Users == nil || c.Users.File == "" {
+		add("users.file", "users file is required")
+	}
+
+	if c.Policies == nil {
+		add("policies", "must not be null")
+	} else {
+		for i, proto := range c.Policies.Protocols {
+			if proto != "tcp" && proto != "udp" {
+				add(fmt.Sprintf("policies.protocols[%d]", i), "unsupported protocol %q, must be tcp or udp", proto)
+			}
+		}
+
+		if d := c.Policies.Default; d != acl.ALLOW && d != acl.DENY {
+			add("policies.default", "must be allow or deny, got %q", d)
+		}
+
+		for i, rule := range c.Policies.Rules {
+			path := fmt.Sprintf("policies.rules[%d]", i)
+
+			if rule == nil {
+				add(path, "must not be null")
+				continue
+			}
+
+			for _, err := range rule.Validate() {
+				add(path+"."+err.Field, "%s", err.Msg)
+			}
+		}
+
+		for i, cidr := range c.Policies.AllowPrivate {
+			if _, err := acl.NewGuard([]string{cidr}); err != nil {
+				add(fmt.Sprintf("policies.allow_private[%d]", i), "invalid CIDR %q", cidr)
+			}
+		}
+	}
+
+	if c.Accounting == nil {
+		add("accounting", "must not be null")
+	} else if d, err := time.ParseDuration(string(c.Accounting.Interval)); err != nil || d <= 0 {
+		add("accounting.interval", "must be a positive duration such as \"1m\", got %q", c.Accounting.Interval)
+	}
+
+	if c.Limits == nil {
+		add("limits", "must not be null")
+	}
+
+	if s := c.Sessions; s == nil {
+		add("sessions", "must not be null")
+	} else {
+		if s.MaxPerUser < 0 {
+			add("sessions.max_per_user", "must not be negative")
+		}
+
+		if s.MaxTotal < 0 {
+			add("sessions.max_total", "must not be negative")
+		}
+
+		if s.OnLimit != "reject" && s.OnLimit != "evict" {
+			add("sessions.on_limit", "must be reject or evict, got %q", s.OnLimit)
+		}
+	}
+
+	if c.Metrics == nil {
+		add("metrics", "must not be null")
+	} else if c.Metrics.Addr != "" {
+		if err := validHostPort(c.Metrics.Addr); err != nil {
+			add("metrics.addr", "%s", err.Error())
+		}
+	}
+
+	if a := c.Admin; a == nil {
+		add("admin", "must not be null")
+	} else if path, ok := strings.CutPrefix(a.Addr, "unix:"); ok {
+		if path == "" {
+			add("admin.addr", "unix socket path is required")
+		}
+	} else if a.Addr != "" {
+		if err := validHostPort(a.Addr); err != nil {
+			add("admin.addr", "%s", err.Error())
+		} else if host, _, _ := net.SplitHostPort(a.Addr); host != "localhost" && !net.ParseIP(host).IsLoopback() {
+			add("admin.addr", "must be a loopback address or a unix socket, got %q", a.Addr)
+		}
+
+		if a.Token == "" {
+			add("admin.token", "required when the admin API listens on TCP")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// FileMode returns the parsed socket permission, zero when empty or invalid.
+func (l *Listener) FileMode() os.FileMode {
+	m, _ := strconv.ParseUint(l.Mode, 8, 32)
+	return os.FileMode(m)
+}
+
+// Value returns the parsed duration, invalid values are reported by Validate.
+func (d Duration) Value() time.Duration {
+	v, _ := time.ParseDuration(string(d))
+	return v
+}
+
+func (e *FieldErr) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+func (e Errors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+
+	lines := make([]string, len(e))
+
+	for i, err := range e {
+		lines[i] = "  - " + err.Error()
+	}
+
+	return fmt.Sprintf("%d config errors:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+func validHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return err
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+
+	return nil
+}
+
+// decodeErr adds a line and column, or a field path, to JSON decoding errors.
+func decodeErr(data []byte, err error) error {
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &syntax):
+		line, col := position(data, syntax.Offset)
+		return fmt.Errorf("line %d, column %d: %s", line, col, syntax.Error())
+	case errors.As(err, &typ):
+		return &FieldErr{Path: typ.Field, Msg: fmt.Sprintf("expected %s, got JSON %s", typ.Type, typ.Value)}
+	default:
+		return err
+	}
+}
+
+func position(data []byte, offset int64) (int, int) {
+	line, col := 1, 1
+
+	for i := int64(0); i < offset && i < int64(len(data)); i++ {
+		if data[i] == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+
+	return line, col
+}
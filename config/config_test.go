@@ -0,0 +1,90 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadReportsFieldPaths(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kriptun.json")
+
+	data := `{
+		"listeners": [{"net": "tcp", "addr": "127.0.0.1:99999"}],
+		"auth": {"bits": 512, "timeout": "soon"},
+		"rekey": {"interval": "-1m"}
+	}`
+
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Load(path)
+
+	var errs Errors
+
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected config errors, got %v", err)
+	}
+
+	want := []string{"listeners[0].addr", "auth.bits", "auth.timeout", "rekey.interval"}
+
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), err)
+	}
+
+	for i, path := range want {
+		if errs[i].Path != path {
+			t.Fatalf("expected error %d at %s, got %s", i, path, errs[i].Path)
+		}
+	}
+}
+
+func TestLoadUnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kriptun.json")
+
+	if err := os.WriteFile(path, []byte(`{"listen": []}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "listen") {
+		t.Fatalf("expected unknown field error, got %v", err)
+	}
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateListeners(t *testing.T) {
+	c := Default()
+
+	c.Listeners = []*Listener{
+		{Net: "tcp", Addr: "127.0.0.1:8890", KeepAlive: "30s"},
+		{Net: "unix", Addr: "/run/kriptun.sock", Mode: "0660"},
+		{Net: "unix", Addr: "/run/kriptun.sock", Mode: "rw"},
+		{Net: "tcp", Addr: "127.0.0.1:8891", Mode: "0600"},
+	}
+
+	var errs Errors
+
+	if !errors.As(c.Validate(), &errs) {
+		t.Fatal("expected config errors")
+	}
+
+	want := []string{"listeners[2].mode", "listeners[2].addr", "listeners[3].mode"}
+
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), errs)
+	}
+
+	for i, path := range want {
+		if errs[i].Path != path {
+			t.Fatalf("expected error %d at %s, got %s", i, path, errs[i].Path)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"kriptun/acl"
+	"kriptun/limit"
+
+	"github.com/dipakw/logs"
+)
+
+// Config is the server configuration file.
+type Config struct {
+	Listeners  []*Listener `json:"listeners"`
+	Identity   string      `json:"identity"`
+	Auth       *Auth       `json:"auth"`
+	Timeouts   *Timeouts   `json:"timeouts"`
+	Rekey      *Rekey      `json:"rekey"`
+	Log        *Log        `json:"log"`
+	Users      *Users      `json:"users"`
+	Policies   *Policies   `json:"policies"`
+	Accounting *Accounting `json:"accounting"`
+	Limits     *Limits     `json:"limits"`
+	Sessions   *Sessions   `json:"sessions"`
+	Metrics    *Metrics    `json:"metrics"`
+	Admin      *Admin      `json:"admin"`
+}
+
+type Listener struct {
+	Net  string `json:"net"`  // tcp, tcp4, tcp6 or unix
+	Addr string `json:"addr"` // host:port, or the socket path for unix
+
+	// Mode is the octal permission of a unix socket such as "0660", "0600" when empty.
+	Mode string `json:"mode,omitempty"`
+
+	// KeepAlive is the TCP keep-alive period, "0s" disables it and empty uses the system default.
+	KeepAlive Duration `json:"keep_alive,omitempty"`
+
+	// ProxyProtocol lists the load balancers, as CIDRs or IPs, whose connections start with a
+	// PROXY protocol v1 or v2 header. The client address in it is then used everywhere.
+	ProxyProtocol []string `json:"proxy_protocol,omitempty"`
+
+	// Transport is tcp, tls or wss (WebSocket over TLS), tcp when empty.
+	Transport string `json:"transport,omitempty"`
+
+	// Cert and Key are PEM files, required for tls and wss.
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+
+	// Path is the WebSocket request path, "/" when empty.
+	Path string `json:"path,omitempty"`
+}
+
+// Auth mirrors the tunable parts of auth.ServerOpts.
+type Auth struct {
+	Bits          uint16   `json:"bits"`
+	Timeout       Duration `json:"timeout"`
+	MinSigSize    uint16   `json:"min_sig_size"`
+	MaxSigSize    uint16   `json:"max_sig_size"`
+	MinIdMetaSize uint16   `json:"min_id_meta_size"`
+	MaxIdMetaSize uint16   `json:"max_id_meta_size"`
+	DelayOnAuth   Duration `json:"delay_on_auth"`
+
+	// Hybrid offers clients an X25519 + ML-KEM key exchange, older clients keep using ML-KEM alone.
+	Hybrid bool `json:"hybrid"`
+}
+
+// Rekey moves session traffic to fresh keys after either threshold, zero disables that threshold.
+// Clients that predate rekeying keep one key for the whole session.
+type Rekey struct {
+	Bytes    uint64   `json:"bytes"`
+	Interval Duration `json:"interval"`
+}
+
+type Timeouts struct {
+	// Request is how long the server waits for the target after authentication.
+	Request Duration `json:"request"`
+
+	// Shutdown is how long active relays may keep running after SIGINT or SIGTERM.
+	Shutdown Duration `json:"shutdown"`
+}
+
+type Log struct {
+	Level string `json:"level"` // info, warn, error or none
+	File  string `json:"file"`
+	Color bool   `json:"color"`
+}
+
+type Users struct {
+	File string `json:"file"`
+}
+
+type Policies struct {
+	// Protocols allowed for users that do not list their own, empty allows all.
+	Protocols []string `json:"protocols"`
+
+	// Default is the action when no rule matches, allow or deny.
+	Default string `json:"default"`
+
+	// Rules are evaluated in order against every destination, the first match wins.
+	Rules []*acl.Rule `json:"rules"`
+
+	// AllowPrivate lists the private, loopback or link-local networks that may be dialed.
+	AllowPrivate []string `json:"allow_private"`
+}
+
+type Accounting struct {
+	// File receives per-user usage as JSON lines, nothing is written when empty.
+	File     string   `json:"file"`
+	Interval Duration `json:"interval"`
+}
+
+type Limits struct {
+	// Defaults apply to every user, the limits in the users file override them field by field.
+	Defaults *limit.Limits `json:"defaults"`
+
+	// State keeps daily and monthly quota usage across restarts.
+	State string `json:"state"`
+}
+
+type Sessions struct {
+	MaxPerUser int `json:"max_per_user"` // 0 is unlimited
+	MaxTotal   int `json:"max_total"`    // 0 is unlimited
+
+	// OnLimit is reject, refusing the new session, or evict, closing the oldest one.
+	OnLimit string `json:"on_limit"`
+}
+
+type Metrics struct {
+	// Addr serves Prometheus metrics on /metrics, disabled when empty.
+	Addr string `json:"addr"`
+}
+
+type Admin struct {
+	// Addr is a loopback host:port or unix:/path/to/socket, disabled when empty.
+	Addr string `json:"addr"`
+
+	// Token is sent as "Authorization: Bearer <token>", required unless Addr is a unix socket.
+	Token string `json:"token"`
+}
+
+// Duration is a time.Duration written as a string such as "5s" or "1m30s".
+type Duration string
+
+// FieldErr is a validation error for a single field.
+type FieldErr struct {
+	Path string
+	Msg  string
+}
+
+// Errors collects every validation error found in a file.
+type Errors []*FieldErr
+
+var LOG_LEVELS = map[string]uint8{
+	"info":  logs.ALL,
+	"warn":  logs.WARN | logs.ERROR,
+	"error": logs.ERROR,
+	"none":  logs.NONE,
+}
@@ -7,12 +7,12 @@ toolchain go1.24.5
 require (
 	github.com/dipakw/logs v1.3.0
 	github.com/dipakw/uconn v1.1.2
+	golang.org/x/crypto v0.40.0
 )
 
 require (
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mgutz/ansi v0.0.0-20200706080929-d51e80ef957d // indirect
-	golang.org/x/crypto v0.40.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
 )
@@ -0,0 +1,59 @@
+package limit
+
+import (
+	"context"
+	"time"
+)
+
+// NewBucket returns nil for a zero rate, a nil bucket never waits.
+func NewBucket(rate uint64) *Bucket {
+	if rate == 0 {
+		return nil
+	}
+
+	return &Bucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Wait takes n tokens, going into debt if needed, and sleeps until the debt is paid.
+// Reads larger than the burst are therefore delayed instead of rejected.
+func (b *Bucket) Wait(ctx context.Context, n int) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+func (b *Bucket) Rate() uint64 {
+	if b == nil {
+		return 0
+	}
+
+	return uint64(b.rate)
+}
@@ -0,0 +1,89 @@
+package limit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("traffic quota exceeded")
+)
+
+// Directions passed to Conn.Wait, matching the relay sides.
+const (
+	UP   uint8 = 0 // read from the client
+	DOWN uint8 = 1 // read from the target
+)
+
+const (
+	SAVE_INTERVAL = time.Minute
+
+	// UNLIMITED in the limits of a user lifts the server default, where zero keeps it.
+	UNLIMITED = math.MaxUint64
+)
+
+// Limits of a single user, rates are in bytes per second and quotas in bytes.
+// Zero means unlimited.
+type Limits struct {
+	UpRate       uint64 `json:"up_rate,omitempty"`
+	DownRate     uint64 `json:"down_rate,omitempty"`
+	ConnUpRate   uint64 `json:"conn_up_rate,omitempty"`
+	ConnDownRate uint64 `json:"conn_down_rate,omitempty"`
+	Daily        uint64 `json:"daily,omitempty"`
+	Monthly      uint64 `json:"monthly,omitempty"`
+}
+
+type Config struct {
+	// LimitsFN returns the limits of a user, nil means unlimited.
+	LimitsFN func(id string) *Limits
+
+	// State keeps quota usage across restarts, usage only lives in memory when empty.
+	State string
+}
+
+// Limiter enforces rates and quotas for every user.
+type Limiter struct {
+	conf  *Config
+	mu    sync.Mutex
+	users map[string]*user
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Usage is the traffic of a user in the current day and month, in local time.
+type Usage struct {
+	Day        string `json:"day"`
+	DayBytes   uint64 `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes uint64 `json:"month_bytes"`
+}
+
+type user struct {
+	mu     sync.Mutex
+	limits Limits
+	up     *Bucket
+	down   *Bucket
+	usage  Usage
+	conns  map[*Conn]struct{}
+}
+
+// Conn limits a single relayed connection, its context is canceled once the user runs out of quota.
+type Conn struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	user   *user
+	up     *Bucket
+	down   *Bucket
+}
+
+// Bucket is a token bucket holding up to one second of traffic.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
@@ -0,0 +1,313 @@
+package limit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// New loads the quota state file, when configured and present.
+func New(conf *Config) (*Limiter, error) {
+	if conf == nil {
+		conf = &Config{}
+	}
+
+	l := &Limiter{
+		conf:  conf,
+		users: map[string]*user{},
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	if conf.State == "" {
+		return l, nil
+	}
+
+	data, err := os.ReadFile(conf.State)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	state := map[string]Usage{}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	for id, usage := range state {
+		l.users[id] = &user{
+			usage: usage,
+			conns: map[*Conn]struct{}{},
+		}
+	}
+
+	return l, nil
+}
+
+// Open refuses users without quota left and returns the limits for a new connection.
+func (l *Limiter) Open(ctx context.Context, id string) (*Conn, error) {
+	limits := &Limits{}
+
+	if l.conf.LimitsFN != nil {
+		if fn := l.conf.LimitsFN(id); fn != nil {
+			limits = fn
+		}
+	}
+
+	l.mu.Lock()
+
+	u, ok := l.users[id]
+
+	if !ok {
+		u = &user{
+			conns: map[*Conn]struct{}{},
+		}
+
+		l.users[id] = u
+	}
+
+	l.mu.Unlock()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// Rebuild the buckets only when the rates changed, so the current budget is kept otherwise.
+	if u.limits.UpRate != limits.UpRate || u.up == nil && limits.UpRate != 0 {
+		u.up = NewBucket(limits.UpRate)
+	}
+
+	if u.limits.DownRate != limits.DownRate || u.down == nil && limits.DownRate != 0 {
+		u.down = NewBucket(limits.DownRate)
+	}
+
+	u.limits = *limits
+	u.roll(time.Now())
+
+	if u.exceeded() {
+		return nil, ErrQuotaExceeded
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	c := &Conn{
+		ctx:    ctx,
+		cancel: cancel,
+		user:   u,
+		up:     NewBucket(limits.ConnUpRate),
+		down:   NewBucket(limits.ConnDownRate),
+	}
+
+	u.conns[c] = struct{}{}
+
+	return c, nil
+}
+
+// Usage returns the current usage of a user.
+func (l *Limiter) Usage(id string) Usage {
+	l.mu.Lock()
+	u, ok := l.users[id]
+	l.mu.Unlock()
+
+	if !ok {
+		return Usage{}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.roll(time.Now())
+
+	return u.usage
+}
+
+// Save writes the quota usage of every user to the state file.
+func (l *Limiter) Save() error {
+	if l.conf.State == "" {
+		return nil
+	}
+
+	state := map[string]Usage{}
+
+	l.mu.Lock()
+
+	for id, u := range l.users {
+		u.mu.Lock()
+		state[id] = u.usage
+		u.mu.Unlock()
+	}
+
+	l.mu.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.conf.State), ".quota-*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), l.conf.State)
+}
+
+// Start saves the state periodically until Stop is called.
+func (l *Limiter) Start() error {
+	go func() {
+		defer close(l.done)
+
+		ticker := time.NewTicker(SAVE_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				l.Save()
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop ends the periodic saves and writes the final state.
+func (l *Limiter) Stop() error {
+	l.once.Do(func() {
+		close(l.stop)
+	})
+
+	return l.Save()
+}
+
+func (l *Limiter) Wait() {
+	<-l.done
+}
+
+// Ctx is canceled with ErrQuotaExceeded once the user runs out of quota.
+func (c *Conn) Ctx() context.Context {
+	return c.ctx
+}
+
+// Wait counts n bytes read from the given direction against the quotas,
+// then blocks until both the connection and the user rate allow them.
+func (c *Conn) Wait(dir uint8, n int) error {
+	if err := c.user.count(uint64(n)); err != nil {
+		return err
+	}
+
+	c.user.mu.Lock()
+	conn, user := c.up, c.user.up
+
+	if dir == DOWN {
+		conn, user = c.down, c.user.down
+	}
+
+	c.user.mu.Unlock()
+
+	if err := conn.Wait(c.ctx, n); err != nil {
+		return err
+	}
+
+	return user.Wait(c.ctx, n)
+}
+
+func (c *Conn) Close() {
+	c.user.mu.Lock()
+	delete(c.user.conns, c)
+	c.user.mu.Unlock()
+
+	c.cancel(context.Canceled)
+}
+
+// count adds n bytes and terminates every connection of the user once a quota is exhausted.
+func (u *user) count(n uint64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.roll(time.Now())
+	u.usage.DayBytes += n
+	u.usage.MonthBytes += n
+
+	if !u.exceeded() {
+		return nil
+	}
+
+	for c := range u.conns {
+		c.cancel(ErrQuotaExceeded)
+	}
+
+	return ErrQuotaExceeded
+}
+
+// roll resets the counters when a new day or month has started.
+func (u *user) roll(now time.Time) {
+	if day := now.Format(time.DateOnly); u.usage.Day != day {
+		u.usage.Day = day
+		u.usage.DayBytes = 0
+	}
+
+	if month := now.Format("2006-01"); u.usage.Month != month {
+		u.usage.Month = month
+		u.usage.MonthBytes = 0
+	}
+}
+
+func (u *user) exceeded() bool {
+	return u.limits.Daily > 0 && u.usage.DayBytes >= u.limits.Daily ||
+		u.limits.Monthly > 0 && u.usage.MonthBytes >= u.limits.Monthly
+}
+
+// Merge returns l with the non-zero fields of o applied on top, UNLIMITED fields become zero.
+func (l *Limits) Merge(o *Limits) *Limits {
+	m := &Limits{}
+
+	if l != nil {
+		*m = *l
+	}
+
+	if o == nil {
+		o = &Limits{}
+	}
+
+	for _, f := range []struct{ dst, src *uint64 }{
+		{&m.UpRate, &o.UpRate},
+		{&m.DownRate, &o.DownRate},
+		{&m.ConnUpRate, &o.ConnUpRate},
+		{&m.ConnDownRate, &o.ConnDownRate},
+		{&m.Daily, &o.Daily},
+		{&m.Monthly, &o.Monthly},
+	} {
+		if *f.src != 0 {
+			*f.dst = *f.src
+		}
+
+		if *f.dst == UNLIMITED {
+			*f.dst = 0
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,110 @@
+package limit
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBucketRate(t *testing.T) {
+	b := NewBucket(100000)
+	start := time.Now()
+
+	// The first 100K are the burst, the next 50K take half a second.
+	for i := 0; i < 15; i++ {
+		if err := b.Wait(context.Background(), 10000); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d := time.Since(start); d < 400*time.Millisecond || d > 800*time.Millisecond {
+		t.Fatalf("expected about 500ms, took %s", d)
+	}
+}
+
+func TestQuotaTerminates(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "quota.json")
+
+	l, err := New(&Config{
+		State: state,
+
+		LimitsFN: func(id string) *Limits {
+			return &Limits{Daily: 1000}
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idle, err := l.Open(context.Background(), "alice")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	busy, err := l.Open(context.Background(), "alice")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := busy.Wait(UP, 600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := busy.Wait(DOWN, 600); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected quota exceeded, got %v", err)
+	}
+
+	select {
+	case <-idle.Ctx().Done():
+		if !errors.Is(context.Cause(idle.Ctx()), ErrQuotaExceeded) {
+			t.Fatalf("unexpected cause: %v", context.Cause(idle.Ctx()))
+		}
+	default:
+		t.Fatal("expected the idle connection to be terminated")
+	}
+
+	if err := l.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The usage survives a restart.
+	l, err = New(&Config{
+		State: state,
+
+		LimitsFN: func(id string) *Limits {
+			return &Limits{Daily: 1000}
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Open(context.Background(), "alice"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected quota exceeded after restart, got %v", err)
+	}
+
+	if u := l.Usage("alice"); u.DayBytes != 1200 {
+		t.Fatalf("expected 1200 bytes used, got %d", u.DayBytes)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	m := (&Limits{UpRate: 10, Daily: 100}).Merge(&Limits{Daily: 50, Monthly: 500})
+
+	if *m != (Limits{UpRate: 10, Daily: 50, Monthly: 500}) {
+		t.Fatalf("unexpected merge: %+v", m)
+	}
+
+	// UNLIMITED lifts a default, zero keeps it.
+	m = (&Limits{UpRate: 10, Daily: 100}).Merge(&Limits{Daily: UNLIMITED})
+
+	if *m != (Limits{UpRate: 10}) {
+		t.Fatalf("expected the daily quota to be lifted, got %+v", m)
+	}
+}
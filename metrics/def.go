@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dipakw/logs"
+)
+
+const (
+	CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// DEFAULT_BUCKETS suit latencies in seconds, from 5ms to 10s.
+var DEFAULT_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and writes them in the Prometheus text exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Sample is a single labeled value reported by a func metric.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+type metric interface {
+	write(b *writer)
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	desc
+
+	mu     sync.RWMutex
+	series map[string]*Counter
+}
+
+type Counter struct {
+	values []string
+	n      atomic.Uint64
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	desc
+
+	buckets []float64
+	mu      sync.RWMutex
+	series  map[string]*Histogram
+}
+
+type Histogram struct {
+	values  []string
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// funcMetric reads its samples when written, for values owned by other packages.
+type funcMetric struct {
+	desc
+
+	fn func() []Sample
+}
+
+// Server serves the registry on /metrics.
+type Server struct {
+	reg      *Registry
+	addr     string
+	log      logs.Log
+	server   *http.Server
+	listener net.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"io"
+	"slices"
+	"strings"
+)
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Counter registers a counter with the given label names.
+func (r *Registry) Counter(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		series: map[string]*Counter{},
+	}
+
+	r.add(c)
+
+	return c
+}
+
+// Histogram registers a histogram, DEFAULT_BUCKETS are used when buckets is nil.
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DEFAULT_BUCKETS
+	}
+
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: slices.Sorted(slices.Values(buckets)),
+		series:  map[string]*Histogram{},
+	}
+
+	r.add(h)
+
+	return h
+}
+
+// GaugeFunc registers a gauge whose samples are read from fn on every scrape.
+func (r *Registry) GaugeFunc(name string, help string, fn func() []Sample, labels ...string) {
+	r.add(&funcMetric{
+		desc: desc{name: name, help: help, typ: "gauge", labels: labels},
+		fn:   fn,
+	})
+}
+
+// CounterFunc registers a counter whose samples are read from fn on every scrape.
+func (r *Registry) CounterFunc(name string, help string, fn func() []Sample, labels ...string) {
+	r.add(&funcMetric{
+		desc: desc{name: name, help: help, typ: "counter", labels: labels},
+		fn:   fn,
+	})
+}
+
+// WriteTo writes every metric in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	list := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	b := &writer{}
+
+	for _, m := range list {
+		m.write(b)
+	}
+
+	n, err := w.Write(b.buf.Bytes())
+
+	return int64(n), err
+}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// With returns the counter for the label values, in the order of the label names.
+func (c *CounterVec) With(values ...string) *Counter {
+	key := strings.Join(values, "\xff")
+
+	c.mu.RLock()
+	s, ok := c.series[key]
+	c.mu.RUnlock()
+
+	if ok {
+		return s
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s, ok = c.series[key]; !ok {
+		s = &Counter{values: slices.Clone(values)}
+		c.series[key] = s
+	}
+
+	return s
+}
+
+func (c *Counter) Inc() {
+	c.n.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.n.Add(n)
+}
+
+// With returns the histogram for the label values, in the order of the label names.
+func (h *HistogramVec) With(values ...string) *Histogram {
+	key := strings.Join(values, "\xff")
+
+	h.mu.RLock()
+	s, ok := h.series[key]
+	h.mu.RUnlock()
+
+	if ok {
+		return s
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, ok = h.series[key]; !ok {
+		s = &Histogram{
+			values:  slices.Clone(values),
+			buckets: h.buckets,
+			counts:  make([]uint64, len(h.buckets)),
+		}
+
+		h.series[key] = s
+	}
+
+	return s
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.counts) {
+		h.counts[i]++
+	}
+
+	h.count++
+	h.sum += v
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+
+	dials := r.Counter("kriptun_dials_total", "Dials by protocol and status.", "proto", "status")
+	dials.With("tcp", "conn_opened").Add(2)
+	dials.With("udp", "resolve_failed").Inc()
+
+	latency := r.Histogram("kriptun_dial_seconds", "Dial latency.", []float64{0.1, 1}, "proto")
+	latency.With("tcp").Observe(0.05)
+	latency.With("tcp").Observe(0.1)
+	latency.With("tcp").Observe(3)
+
+	r.GaugeFunc("kriptun_sessions", "Active sessions.", func() []Sample {
+		return []Sample{{Value: 4}}
+	})
+
+	r.CounterFunc("kriptun_bytes_total", "Bytes.", func() []Sample {
+		return []Sample{{Labels: []string{"a\"b\n"}, Value: 1e6}}
+	}, "user")
+
+	out := &bytes.Buffer{}
+
+	if _, err := r.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.TrimLeft(`
+# HELP kriptun_dials_total Dials by protocol and status.
+# TYPE kriptun_dials_total counter
+kriptun_dials_total{proto="tcp",status="conn_opened"} 2
+kriptun_dials_total{proto="udp",status="resolve_failed"} 1
+# HELP kriptun_dial_seconds Dial latency.
+# TYPE kriptun_dial_seconds histogram
+kriptun_dial_seconds_bucket{proto="tcp",le="0.1"} 2
+kriptun_dial_seconds_bucket{proto="tcp",le="1"} 2
+kriptun_dial_seconds_bucket{proto="tcp",le="+Inf"} 3
+kriptun_dial_seconds_sum{proto="tcp"} 3.15
+kriptun_dial_seconds_count{proto="tcp"} 3
+# HELP kriptun_sessions Active sessions.
+# TYPE kriptun_sessions gauge
+kriptun_sessions 4
+# HELP kriptun_bytes_total Bytes.
+# TYPE kriptun_bytes_total counter
+kriptun_bytes_total{user="a\"b\n"} 1e+06
+`, "\n")
+
+	if out.String() != want {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/dipakw/logs"
+)
+
+func NewServer(addr string, reg *Registry, log logs.Log) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Server{
+		reg:    reg,
+		addr:   addr,
+		log:    log,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", s)
+
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	s.reg.WriteTo(w)
+}
+
+func (s *Server) Start() error {
+	var err error
+
+	if s.listener, err = net.Listen("tcp", s.addr); err != nil {
+		s.log.Errf("Failed to start metrics endpoint: %s", err.Error())
+		return err
+	}
+
+	go func() {
+		defer s.cancel()
+
+		if err := s.server.Serve(s.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Errf("Metrics endpoint stopped: %s", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) Stop() error {
+	return s.server.Close()
+}
+
+func (s *Server) Wait() {
+	<-s.ctx.Done()
+}
+
+func (s *Server) Addr() string {
+	if s.listener != nil {
+		return s.listener.Addr().String()
+	}
+
+	return s.addr
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"bytes"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type writer struct {
+	buf bytes.Buffer
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func (b *writer) header(d *desc) {
+	b.buf.WriteString("# HELP " + d.name + " " + helpEscaper.Replace(d.help) + "\n")
+	b.buf.WriteString("# TYPE " + d.name + " " + d.typ + "\n")
+}
+
+// sample writes one line, extra is an additional label such as le for histogram buckets.
+func (b *writer) sample(name string, names []string, values []string, extra string, extraValue string, v float64) {
+	b.buf.WriteString(name)
+
+	if len(names) > 0 || extra != "" {
+		b.buf.WriteByte('{')
+
+		for i, label := range names {
+			if i > 0 {
+				b.buf.WriteByte(',')
+			}
+
+			value := ""
+
+			if i < len(values) {
+				value = values[i]
+			}
+
+			b.buf.WriteString(label + `="` + labelEscaper.Replace(value) + `"`)
+		}
+
+		if extra != "" {
+			if len(names) > 0 {
+				b.buf.WriteByte(',')
+			}
+
+			b.buf.WriteString(extra + `="` + extraValue + `"`)
+		}
+
+		b.buf.WriteByte('}')
+	}
+
+	b.buf.WriteByte(' ')
+	b.buf.WriteString(formatFloat(v))
+	b.buf.WriteByte('\n')
+}
+
+func (c *CounterVec) write(b *writer) {
+	b.header(&c.desc)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, key := range slices.Sorted(maps.Keys(c.series)) {
+		s := c.series[key]
+		b.sample(c.name, c.labels, s.values, "", "", float64(s.n.Load()))
+	}
+}
+
+func (h *HistogramVec) write(b *writer) {
+	b.header(&h.desc)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, key := range slices.Sorted(maps.Keys(h.series)) {
+		s := h.series[key]
+
+		s.mu.Lock()
+		cumulative := uint64(0)
+
+		for i, le := range s.buckets {
+			cumulative += s.counts[i]
+			b.sample(h.name+"_bucket", h.labels, s.values, "le", formatFloat(le), float64(cumulative))
+		}
+
+		b.sample(h.name+"_bucket", h.labels, s.values, "le", "+Inf", float64(s.count))
+		b.sample(h.name+"_sum", h.labels, s.values, "", "", s.sum)
+		b.sample(h.name+"_count", h.labels, s.values, "", "", float64(s.count))
+		s.mu.Unlock()
+	}
+}
+
+func (f *funcMetric) write(b *writer) {
+	b.header(&f.desc)
+
+	for _, s := range f.fn() {
+		b.sample(f.name, f.labels, s.Labels, "", "", s.Value)
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,78 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	VERSION = 1
+
+	// Frame format: [type:uint8][stream:uint32][length:uint16][payload]
+	HEADER_SIZE = 1 + 4 + 2
+	MAX_PAYLOAD = 16 * 1024
+
+	// Bytes a stream may send before the receiver grants more credit.
+	INITIAL_WINDOW = 256 * 1024
+	ACCEPT_BACKLOG = 128
+
+	// Control frames waiting to be written, a peer that lets more pile up is not reading.
+	CONTROL_BACKLOG = 1024
+)
+
+const (
+	FRAME_OPEN uint8 = iota + 1
+	FRAME_DATA
+	FRAME_WINDOW
+	FRAME_CLOSE
+	FRAME_RESET
+)
+
+var (
+	ErrSessionClosed  = errors.New("mux: session closed")
+	ErrStreamReset    = errors.New("mux: stream reset by peer")
+	ErrTooManyStreams = errors.New("mux: too many streams")
+	ErrProtocol       = errors.New("mux: protocol error")
+)
+
+type Config struct {
+	// MaxStreams caps the number of concurrently open streams, 0 means no limit.
+	MaxStreams int
+}
+
+// Session carries many independent streams over a single connection.
+type Session struct {
+	conn    net.Conn
+	conf    *Config
+	nextID  uint32
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	accept  chan *Stream
+	ctrl    chan []byte
+	wmu     sync.Mutex
+	done    chan struct{}
+	once    sync.Once
+	err     error
+}
+
+// Stream is a single logical connection within a session, it implements net.Conn.
+type Stream struct {
+	id       uint32
+	sess     *Session
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	credit   int
+	consumed int
+	readable chan struct{}
+	writable chan struct{}
+
+	localClosed  bool
+	remoteClosed bool
+	reset        bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
@@ -0,0 +1,177 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func pair(t *testing.T) (*Session, *Session) {
+	a, b := net.Pipe()
+
+	client := Client(a, nil)
+	server := Server(b, nil)
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+func TestStreamsEcho(t *testing.T) {
+	client, server := pair(t)
+
+	go func() {
+		for {
+			st, err := server.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer st.Close()
+				io.Copy(st, st)
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	// Each stream sends more than the window to exercise flow control.
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			st, err := client.Open()
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			defer st.Close()
+
+			data := make([]byte, 3*INITIAL_WINDOW+123)
+			rand.Read(data)
+
+			go st.Write(data)
+
+			got := make([]byte, len(data))
+
+			if _, err := io.ReadFull(st, got); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if !bytes.Equal(got, data) {
+				t.Error("data mismatch")
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server := pair(t)
+
+	st, err := client.Open()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := server.Accept()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st.Write([]byte("bye"))
+	st.Close()
+
+	got, err := io.ReadAll(peer)
+
+	if err != nil || string(got) != "bye" {
+		t.Fatalf("expected bye and EOF, got %q, %v", got, err)
+	}
+
+	if _, err := peer.Write([]byte("x")); err == nil {
+		t.Fatal("expected write to a closed stream to fail")
+	}
+
+	peer.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	if client.NumStreams() != 0 || server.NumStreams() != 0 {
+		t.Fatalf("streams not released: %d, %d", client.NumStreams(), server.NumStreams())
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	client, server := pair(t)
+
+	st, err := client.Open()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+
+	st.SetReadDeadline(time.Time{})
+	server.Close()
+
+	if _, err := st.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected read on a closed session to fail")
+	}
+}
+
+func TestRecvNotBlockedByWrites(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	server := Server(b, &Config{MaxStreams: 1})
+	defer server.Close()
+
+	// The raw peer never reads, so the reset of the refused stream can not be written.
+	go func() {
+		a.Write(frame(FRAME_OPEN, 1, nil))
+		a.Write(frame(FRAME_OPEN, 3, nil))
+		a.Write(frame(FRAME_DATA, 1, []byte("ping")))
+	}()
+
+	st, err := server.Accept()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st.SetReadDeadline(time.Now().Add(time.Second))
+
+	buf := make([]byte, 4)
+
+	if _, err := io.ReadFull(st, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected the data behind the refused stream, got %q %v", buf, err)
+	}
+}
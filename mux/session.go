@@ -0,0 +1,275 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// Client starts the session on the side that opens streams.
+func Client(conn net.Conn, conf *Config) *Session {
+	return newSession(conn, conf, 1)
+}
+
+// Server starts the session on the side that accepts streams.
+func Server(conn net.Conn, conf *Config) *Session {
+	return newSession(conn, conf, 2)
+}
+
+func newSession(conn net.Conn, conf *Config, firstID uint32) *Session {
+	if conf == nil {
+		conf = &Config{}
+	}
+
+	s := &Session{
+		conn:    conn,
+		conf:    conf,
+		nextID:  firstID,
+		streams: map[uint32]*Stream{},
+		accept:  make(chan *Stream, ACCEPT_BACKLOG),
+		ctrl:    make(chan []byte, CONTROL_BACKLOG),
+		done:    make(chan struct{}),
+	}
+
+	go s.recvLoop()
+	go s.sendLoop()
+
+	return s
+}
+
+// Open starts a new stream.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+
+	if s.conf.MaxStreams > 0 && len(s.streams) >= s.conf.MaxStreams {
+		s.mu.Unlock()
+		return nil, ErrTooManyStreams
+	}
+
+	st := newStream(s.nextID, s)
+	s.streams[st.id] = st
+	s.nextID += 2
+	s.mu.Unlock()
+
+	if err := s.writeFrame(FRAME_OPEN, st.id, nil); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Accept waits for the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+func (s *Session) Close() error {
+	s.closeWith(ErrSessionClosed)
+	return nil
+}
+
+// Done is closed once the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.streams)
+}
+
+func (s *Session) closeWith(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.streams[id]
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.streams, id)
+}
+
+func frame(typ uint8, id uint32, payload []byte) []byte {
+	buf := make([]byte, HEADER_SIZE+len(payload))
+
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], id)
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(payload)))
+	copy(buf[HEADER_SIZE:], payload)
+
+	return buf
+}
+
+func (s *Session) writeFrame(typ uint8, id uint32, payload []byte) error {
+	return s.write(frame(typ, id, payload))
+}
+
+// queueFrame hands a control frame to sendLoop, so that reads never wait behind a slow write.
+// Without wait a full queue closes the session instead of blocking.
+func (s *Session) queueFrame(typ uint8, id uint32, payload []byte, wait bool) error {
+	buf := frame(typ, id, payload)
+
+	if !wait {
+		select {
+		case s.ctrl <- buf:
+			return nil
+		default:
+			return ErrProtocol
+		}
+	}
+
+	select {
+	case s.ctrl <- buf:
+		return nil
+	case <-s.done:
+		return s.err
+	}
+}
+
+func (s *Session) sendLoop() {
+	for {
+		select {
+		case buf := <-s.ctrl:
+			if err := s.write(buf); err != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Session) write(buf []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if s.IsClosed() {
+		return s.err
+	}
+
+	if _, err := s.conn.Write(buf); err != nil {
+		s.closeWith(err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	head := make([]byte, HEADER_SIZE)
+
+	for {
+		if _, err := io.ReadFull(s.conn, head); err != nil {
+			s.closeWith(err)
+			return
+		}
+
+		typ := head[0]
+		id := binary.BigEndian.Uint32(head[1:])
+		size := int(binary.BigEndian.Uint16(head[5:]))
+
+		if size > MAX_PAYLOAD {
+			s.closeWith(ErrProtocol)
+			return
+		}
+
+		payload := make([]byte, size)
+
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.closeWith(err)
+			return
+		}
+
+		if err := s.handleFrame(typ, id, payload); err != nil {
+			s.closeWith(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(typ uint8, id uint32, payload []byte) error {
+	if typ == FRAME_OPEN {
+		s.mu.Lock()
+
+		if _, ok := s.streams[id]; ok {
+			s.mu.Unlock()
+			return ErrProtocol
+		}
+
+		if s.conf.MaxStreams > 0 && len(s.streams) >= s.conf.MaxStreams {
+			s.mu.Unlock()
+			return s.queueFrame(FRAME_RESET, id, nil, false)
+		}
+
+		st := newStream(id, s)
+		s.streams[id] = st
+		s.mu.Unlock()
+
+		select {
+		case s.accept <- st:
+			return nil
+		default:
+			s.remove(id)
+			return s.queueFrame(FRAME_RESET, id, nil, false)
+		}
+	}
+
+	st := s.stream(id)
+
+	// Frames for streams that are already gone are dropped.
+	if st == nil {
+		return nil
+	}
+
+	switch typ {
+	case FRAME_DATA:
+		return st.push(payload)
+	case FRAME_WINDOW:
+		if len(payload) != 4 {
+			return ErrProtocol
+		}
+
+		st.grant(int(binary.BigEndian.Uint32(payload)))
+	case FRAME_CLOSE:
+		st.remoteClose(false)
+	case FRAME_RESET:
+		st.remoteClose(true)
+	default:
+		return ErrProtocol
+	}
+
+	return nil
+}
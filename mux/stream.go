@@ -0,0 +1,266 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:       id,
+		sess:     sess,
+		credit:   INITIAL_WINDOW,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			grant := 0
+			st.consumed += n
+
+			// Return credit once half of the window has been consumed.
+			if st.consumed >= INITIAL_WINDOW/2 && !st.remoteClosed {
+				grant = st.consumed
+				st.consumed = 0
+			}
+
+			st.mu.Unlock()
+
+			if grant > 0 {
+				st.sess.queueFrame(FRAME_WINDOW, st.id, binary.BigEndian.AppendUint32(nil, uint32(grant)), true)
+			}
+
+			return n, nil
+		}
+
+		if err := st.closedErr(io.EOF); err != nil {
+			st.mu.Unlock()
+			return 0, err
+		}
+
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	total := 0
+
+	for len(p) > 0 {
+		st.mu.Lock()
+
+		if err := st.closedErr(io.ErrClosedPipe); err != nil {
+			st.mu.Unlock()
+			return total, err
+		}
+
+		if st.credit == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+
+			if err := st.wait(st.writable, deadline); err != nil {
+				return total, err
+			}
+
+			continue
+		}
+
+		n := min(len(p), st.credit, MAX_PAYLOAD)
+		st.credit -= n
+		st.mu.Unlock()
+
+		if err := st.sess.writeFrame(FRAME_DATA, st.id, p[:n]); err != nil {
+			return total, err
+		}
+
+		total += n
+		p = p[n:]
+	}
+
+	return total, nil
+}
+
+// Close closes the stream in both directions, the peer reads io.EOF once it has drained its buffer.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+
+	st.localClosed = true
+	st.buf.Reset()
+	reset := st.reset
+	done := st.remoteClosed || st.reset
+	st.mu.Unlock()
+
+	st.wake()
+
+	if done {
+		st.sess.remove(st.id)
+	}
+
+	if reset {
+		return nil
+	}
+
+	return st.sess.writeFrame(FRAME_CLOSE, st.id, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.writeDeadline = t
+	st.mu.Unlock()
+
+	st.wake()
+
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+
+	st.wake()
+
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+
+	st.wake()
+
+	return nil
+}
+
+// closedErr reports why the stream can not be used, eof is returned when the peer closed it.
+// Must be called with st.mu held.
+func (st *Stream) closedErr(eof error) error {
+	switch {
+	case st.localClosed:
+		return net.ErrClosed
+	case st.reset:
+		return ErrStreamReset
+	case st.remoteClosed:
+		return eof
+	default:
+		return nil
+	}
+}
+
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.sess.done:
+		return st.sess.err
+	}
+}
+
+func (st *Stream) wake() {
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func (st *Stream) push(p []byte) error {
+	st.mu.Lock()
+
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+
+	if st.buf.Len()+len(p) > INITIAL_WINDOW {
+		st.mu.Unlock()
+		return ErrProtocol
+	}
+
+	st.buf.Write(p)
+	st.mu.Unlock()
+
+	notify(st.readable)
+
+	return nil
+}
+
+func (st *Stream) grant(n int) {
+	st.mu.Lock()
+	st.credit += n
+	st.mu.Unlock()
+
+	notify(st.writable)
+}
+
+func (st *Stream) remoteClose(reset bool) {
+	st.mu.Lock()
+
+	if reset {
+		st.reset = true
+	} else {
+		st.remoteClosed = true
+	}
+
+	done := st.localClosed
+	st.mu.Unlock()
+
+	st.wake()
+
+	if done {
+		st.sess.remove(st.id)
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,69 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Longest v1 line, "PROXY TCP6 <ip> <ip> <port> <port>\r\n".
+	V1_MAX_LEN = 107
+
+	// Both versions are at least this long, so it can be read before knowing which one it is.
+	MIN_LEN = 12
+
+	V2_VERSION = 0x20
+	V2_LOCAL   = 0x00
+	V2_PROXY   = 0x01
+
+	V2_TCP4 = 0x11
+	V2_TCP6 = 0x21
+
+	HEADER_TIMEOUT = 5 * time.Second
+)
+
+var V2_SIGNATURE = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	ErrInvalid   = errors.New("invalid PROXY protocol header")
+	ErrUntrusted = errors.New("untrusted PROXY protocol source")
+)
+
+type Config struct {
+	// Only connections from these networks are expected to start with a header,
+	// others are passed through untouched and can not spoof their address.
+	Trusted []*net.IPNet
+
+	// How long a trusted source has to send the header, HEADER_TIMEOUT when zero.
+	Timeout time.Duration
+
+	// Called for connections dropped because of a missing or invalid header.
+	ErrFN func(conn net.Conn, err error)
+}
+
+// Header holds the addresses of the original connection, both are nil for
+// LOCAL and UNKNOWN headers, in which case the proxy's own addresses stand.
+type Header struct {
+	Version int
+	Src     *net.TCPAddr
+	Dst     *net.TCPAddr
+}
+
+// Listener reads the headers in the background so a slow source can not hold up Accept.
+type Listener struct {
+	net.Listener
+	conf  *Config
+	conns chan net.Conn
+	err   chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Conn reports the addresses from the header instead of the proxy's.
+type Conn struct {
+	net.Conn
+	src net.Addr
+	dst net.Addr
+}
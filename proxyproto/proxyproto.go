@@ -0,0 +1,268 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseTrusted parses CIDRs, a bare IP is a single address network.
+func ParseTrusted(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// Listen wraps ln, connections from trusted sources must start with a v1 or v2 header.
+func Listen(ln net.Listener, conf *Config) net.Listener {
+	if conf.Timeout == 0 {
+		conf.Timeout = HEADER_TIMEOUT
+	}
+
+	l := &Listener{
+		Listener: ln,
+		conf:     conf,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+
+	go l.accept()
+
+	return l
+}
+
+func (l *Listener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			l.err <- err
+			return
+		}
+
+		go l.serve(conn)
+	}
+}
+
+func (l *Listener) serve(conn net.Conn) {
+	if l.trusted(conn.RemoteAddr()) {
+		c, err := l.read(conn)
+
+		if err != nil {
+			if l.conf.ErrFN != nil {
+				l.conf.ErrFN(conn, err)
+			}
+
+			conn.Close()
+			return
+		}
+
+		conn = c
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *Listener) read(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(l.conf.Timeout))
+	h, err := ReadHeader(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		Conn: conn,
+		src:  conn.RemoteAddr(),
+		dst:  conn.LocalAddr(),
+	}
+
+	if h.Src != nil {
+		c.src, c.dst = h.Src, h.Dst
+	}
+
+	return c, nil
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+
+	return ok && slices.ContainsFunc(l.conf.Trusted, func(n *net.IPNet) bool {
+		return n.Contains(tcp.IP)
+	})
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.err:
+		// Keep reporting it to later calls.
+		l.err <- err
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	err := net.ErrClosed
+
+	l.once.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+
+	return err
+}
+
+// ReadHeader reads exactly one v1 or v2 header and nothing past it.
+func ReadHeader(r io.Reader) (*Header, error) {
+	buf := make([]byte, MIN_LEN, V1_MAX_LEN)
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(buf, V2_SIGNATURE) {
+		return readV2(r)
+	}
+
+	if !bytes.HasPrefix(buf, []byte("PROXY ")) {
+		return nil, ErrInvalid
+	}
+
+	// Byte by byte, whatever follows the line belongs to the proxied stream.
+	one := make([]byte, 1)
+
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) == V1_MAX_LEN {
+			return nil, fmt.Errorf("%w: v1 line too long", ErrInvalid)
+		}
+
+		if _, err := io.ReadFull(r, one); err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, one[0])
+	}
+
+	return parseV1(string(buf[:len(buf)-2]))
+}
+
+func parseV1(line string) (*Header, error) {
+	f := strings.Split(line, " ")
+	h := &Header{Version: 1}
+
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return h, nil
+	}
+
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalid, line)
+	}
+
+	src, dst := net.ParseIP(f[2]), net.ParseIP(f[3])
+	sport, err1 := strconv.ParseUint(f[4], 10, 16)
+	dport, err2 := strconv.ParseUint(f[5], 10, 16)
+
+	if src == nil || dst == nil || err1 != nil || err2 != nil || (src.To4() != nil) != (f[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalid, line)
+	}
+
+	h.Src = &net.TCPAddr{IP: src, Port: int(sport)}
+	h.Dst = &net.TCPAddr{IP: dst, Port: int(dport)}
+
+	return h, nil
+}
+
+func readV2(r io.Reader) (*Header, error) {
+	var head [4]byte
+
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+
+	if head[0]&0xf0 != V2_VERSION || head[0]&0x0f > V2_PROXY {
+		return nil, fmt.Errorf("%w: version and command 0x%02x", ErrInvalid, head[0])
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(head[2:]))
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+
+	// LOCAL is sent by the proxy itself, e.g. health checks, and other
+	// families carry nothing we can use, the proxy's addresses stand.
+	if head[0]&0x0f == V2_LOCAL {
+		return h, nil
+	}
+
+	var size int
+
+	switch head[1] {
+	case V2_TCP4:
+		size = net.IPv4len
+	case V2_TCP6:
+		size = net.IPv6len
+	default:
+		return h, nil
+	}
+
+	if len(body) < 2*size+4 {
+		return nil, fmt.Errorf("%w: short address block", ErrInvalid)
+	}
+
+	h.Src = &net.TCPAddr{
+		IP:   net.IP(slices.Clone(body[:size])),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+
+	h.Dst = &net.TCPAddr{
+		IP:   net.IP(slices.Clone(body[size : 2*size])),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+
+	return h, nil
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.src
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.dst
+}
@@ -0,0 +1,138 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func v2(cmd byte, fam byte, addrs []byte) []byte {
+	b := append([]byte{}, V2_SIGNATURE...)
+	b = append(b, V2_VERSION|cmd, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+
+	return append(b, addrs...)
+}
+
+func TestReadHeader(t *testing.T) {
+	tcp4 := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0x30, 0x39, 0x01, 0xbb}
+
+	tests := []struct {
+		name string
+		in   []byte
+		src  string
+		err  bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 12345 443\r\n"), "192.0.2.1:12345", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), "[2001:db8::1]:12345", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 1 2\r\n"), "", true},
+		{"v1 without crlf", append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 120)...), "", true},
+		{"v2 tcp4", v2(V2_PROXY, V2_TCP4, tcp4), "192.0.2.1:12345", false},
+		{"v2 tlvs", v2(V2_PROXY, V2_TCP4, append(tcp4, 0x04, 0x00, 0x01, 0xff)), "192.0.2.1:12345", false},
+		{"v2 local", v2(V2_LOCAL, 0x00, nil), "", false},
+		{"v2 short", v2(V2_PROXY, V2_TCP6, tcp4), "", true},
+		{"plain", []byte("GET / HTTP/1.1\r\n\r\n"), "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(append(tt.in, "rest"...))
+			h, err := ReadHeader(r)
+
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if src := ""; h.Src != nil {
+				src = h.Src.String()
+
+				if src != tt.src {
+					t.Fatalf("expected source %s, got %s", tt.src, src)
+				}
+			} else if tt.src != "" {
+				t.Fatalf("expected source %s, got none", tt.src)
+			}
+
+			// Nothing past the header is consumed.
+			if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+				t.Fatalf("expected the stream to follow, got %q", rest)
+			}
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := make(chan error, 1)
+
+	ln := Listen(inner, &Config{
+		Trusted: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}},
+		Timeout: 200 * time.Millisecond,
+		ErrFN:   func(conn net.Conn, err error) { dropped <- err },
+	})
+
+	defer ln.Close()
+
+	// A stalled source does not hold up the next one.
+	stalled, err := net.Dial("tcp", inner.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stalled.Close()
+
+	conn, err := net.Dial("tcp", inner.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.7 12345 443\r\nhello"))
+
+	got, err := ln.Accept()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.RemoteAddr().String() != "192.0.2.1:12345" || got.LocalAddr().String() != "198.51.100.7:443" {
+		t.Fatalf("unexpected addresses: %s -> %s", got.RemoteAddr(), got.LocalAddr())
+	}
+
+	buf := make([]byte, 5)
+
+	if _, err := io.ReadFull(got, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected the payload, got %q %v", buf, err)
+	}
+
+	if err := <-dropped; err == nil {
+		t.Fatal("expected the stalled connection to be dropped")
+	}
+
+	ln.Close()
+
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected a closed listener, got %v", err)
+	}
+}
@@ -2,32 +2,186 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
+	"kriptun/acct"
+	"kriptun/acl"
 	"kriptun/auth"
+	"kriptun/limit"
+	"kriptun/metrics"
+	"kriptun/proxyproto"
 	"kriptun/shared"
+	"kriptun/transport"
+	"kriptun/users"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dipakw/logs"
 )
 
+const (
+	MAX_STREAMS = 1024
+	DRAIN_POLL  = 100 * time.Millisecond
+)
+
+var (
+	errUnknownUser  = errors.New("unknown user")
+	errInactiveUser = errors.New("user is disabled or expired")
+	errSessionLimit = errors.New("too many sessions")
+)
+
 type Config struct {
-	Bind *shared.Addr
-	Log  logs.Log
+	// Listeners are bound together by Start, at least one is required.
+	Listeners []*Listener
+
+	Log      logs.Log
+	Identity ed25519.PrivateKey
+
+	// Handshake parameters, defaults are used when nil.
+	Auth *AuthConfig
+
+	// How long to wait for the target request after authentication.
+	RequestTimeout time.Duration
+
+	// Rekey thresholds of the session traffic, defaults are used when nil.
+	Rekey *shared.Rekey
+
+	// Users backs PwFN and ProtoFN when they are not set.
+	Users *users.Store
+
+	// Protocols allowed for users that do not list their own, empty allows all.
+	Protocols []string
+
+	// Policy decides which destinations users may reach, nil allows all.
+	// It can be replaced later together with Protocols and AllowPrivate, see SetPolicies.
+	Policy *acl.Policy
+
+	// Private networks are never dialed unless listed here, e.g. "10.0.0.0/8" or "::1".
+	AllowPrivate []string
+
+	// Acct counts relayed bytes, a private accountant without a sink is used when nil.
+	Acct *acct.Accountant
+
+	// Limiter enforces rates and quotas, the limits of Users are used when nil.
+	Limiter *limit.Limiter
+
+	// Sessions tracks authenticated sessions, an unlimited registry is used when nil.
+	// Share it between servers for the global limit to span all of them.
+	Sessions *Sessions
+
+	// Metrics are not recorded when nil.
+	Metrics *Metrics
 
 	PwFN    func(id string) ([]byte, error)
 	ProtoFN func(id string, proto string) bool
+
+	// KeyFN returns the public key of users who sign with a private key, nil for password users.
+	KeyFN func(id string) (*auth.PublicKey, error)
+
+	// VerifierFN returns the password verifier of the user, nil falls back to PwFN.
+	VerifierFN func(id string) (*auth.Verifier, error)
+}
+
+type Listener struct {
+	Net  string // tcp, tcp4, tcp6 or unix
+	Addr string // host:port, or the socket path for unix
+
+	// Permissions of the unix socket, 0600 when zero.
+	Mode os.FileMode
+
+	// TCP keep-alive period, zero uses the system default and a negative value disables it.
+	KeepAlive time.Duration
+
+	// PROXY protocol headers are read from the trusted sources, disabled when nil.
+	Proxy *proxyproto.Config
+
+	// Transport wrapping the connections, raw when nil.
+	Transport *transport.ServerConfig
+}
+
+type AuthConfig struct {
+	Bits          uint16
+	Timeout       time.Duration
+	MinSigSize    uint16
+	MaxSigSize    uint16
+	MinIdMetaSize uint16
+	MaxIdMetaSize uint16
+	DelayOnAuth   time.Duration
+	Hybrid        bool
 }
 
 type Server struct {
-	conf     *Config
-	ctx      context.Context
-	cancel   context.CancelFunc
-	listener net.Listener
-	wg       sync.WaitGroup
+	conf      *Config
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners []net.Listener
+	wg        sync.WaitGroup
+	rules     atomic.Pointer[rules]
+
+	// Closed by Shutdown, sessions then refuse new streams and close once idle.
+	drain     chan struct{}
+	drainOnce sync.Once
+}
+
+// Metrics are the server collectors registered by NewMetrics.
+type Metrics struct {
+	handshakes  *metrics.CounterVec
+	dials       *metrics.CounterVec
+	dialTime    *metrics.HistogramVec
+	relayErrors *metrics.CounterVec
+}
+
+// Policies are the destination rules that can be replaced while the server runs.
+type Policies struct {
+	Protocols    []string
+	Policy       *acl.Policy
+	AllowPrivate []string
+}
+
+type rules struct {
+	protocols []string
+	policy    *acl.Policy
+	guard     *acl.Guard
+}
+
+type SessionsConfig struct {
+	MaxPerUser int // Zero is unlimited
+	MaxTotal   int // Zero is unlimited
+
+	// Evict closes the oldest session instead of rejecting the new one.
+	Evict bool
+}
+
+// Sessions is the registry of authenticated users and their live sessions.
+type Sessions struct {
+	conf   *SessionsConfig
+	mu     sync.Mutex
+	users  map[string]*User
+	total  int
+	nextID uint64
+}
+
+// Session is a single authenticated connection, legacy or multiplexed.
+// Its context is the parent of every connection relayed through it.
+type Session struct {
+	acct.Counters
+
+	ID      uint64
+	User    string
+	Remote  string
+	IP      net.IP // Client address, nil for unix socket clients
+	Started time.Time
+	Auth    *auth.Auth
+
+	conn   net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 type User struct {
-	id    string
-	mu    sync.RWMutex
-	auths []*auth.Auth
+	id       string
+	sessions []*Session
 }
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"kriptun/acl"
+	"kriptun/shared"
+	"net"
+	"syscall"
+	"time"
+)
+
+// dialer checks every resolved address against the private network guard and the policy
+// right before connecting, so a name cannot be rebound to a denied address after resolution.
+func (s *Server) dialer(sess *Session, target *shared.Target, timeout time.Duration) *net.Dialer {
+	rules := s.rules.Load()
+
+	return &net.Dialer{
+		Timeout: timeout,
+
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+
+			if ip == nil {
+				return acl.ErrDenied
+			}
+
+			if err := rules.guard.Check(ip); err != nil {
+				return err
+			}
+
+			req := s.aclRequest(sess, target)
+			req.IP = ip
+
+			if !rules.policy.Allowed(req) {
+				return acl.ErrDenied
+			}
+
+			return nil
+		},
+	}
+}
+
+func (s *Server) aclRequest(sess *Session, target *shared.Target) *acl.Request {
+	return &acl.Request{
+		User:   sess.User,
+		Proto:  target.Net,
+		Host:   target.Host,
+		Port:   target.Port,
+		Source: sess.IP,
+	}
+}
@@ -3,31 +3,81 @@ package server
 import (
 	"bytes"
 	"kriptun/auth"
+	"kriptun/mux"
 	"kriptun/shared"
 	"net"
+	"strconv"
+	"sync"
 	"time"
-
-	"github.com/dipakw/uconn"
 )
 
 func (s *Server) handle(conn net.Conn) {
 	defer conn.Close()
 
+	// Looked up once for the parameters sent with the challenge, then used to verify it.
+	var verifier *auth.Verifier
+	var verifierErr error
+
+	// TLS and WebSocket handshakes run on the first Write, which auth.Server does not bound.
+	conn.SetDeadline(time.Now().Add(s.conf.Auth.Timeout))
+
 	authUser := auth.Server(conn, &auth.ServerOpts{
-		Bits:          768,
-		Timeout:       5 * time.Second,
-		MinSigSize:    32,
-		MaxSigSize:    32,
-		MinIdMetaSize: 2,
-		MaxIdMetaSize: 256,
+		Bits:          s.conf.Auth.Bits,
+		Timeout:       s.conf.Auth.Timeout,
+		MinSigSize:    s.conf.Auth.MinSigSize,
+		MaxSigSize:    s.conf.Auth.MaxSigSize,
+		MinIdMetaSize: s.conf.Auth.MinIdMetaSize,
+		MaxIdMetaSize: s.conf.Auth.MaxIdMetaSize,
+		DelayOnAuth:   s.conf.Auth.DelayOnAuth,
+		Identity:      s.conf.Identity,
+		Hybrid:        s.conf.Auth.Hybrid,
 
-		VerifySig: func(auth *auth.Auth, msg []byte, sig []byte) (bool, error) {
-			pw, err := s.conf.PwFN(string(auth.ID))
+		Params: func(a *auth.Auth) (*auth.KDFParams, error) {
+			if s.conf.VerifierFN == nil {
+				return nil, nil
+			}
+
+			// Errors are reported by VerifySig, so they are logged like any other failure.
+			if verifier, verifierErr = s.conf.VerifierFN(string(a.ID)); verifier == nil {
+				return nil, nil
+			}
+
+			return verifier.Params, nil
+		},
+
+		VerifySig: func(a *auth.Auth, msg []byte, sig []byte) (bool, error) {
+			if s.conf.KeyFN != nil {
+				key, err := s.conf.KeyFN(string(a.ID))
+
+				if err != nil {
+					return false, err
+				}
+
+				// Key users can not fall back to a password.
+				if key != nil {
+					return key.VerifySig(a, msg, sig)
+				}
+			}
+
+			if verifierErr != nil {
+				return false, verifierErr
+			}
+
+			if verifier != nil {
+				return verifier.VerifySig(a, msg, sig)
+			}
+
+			pw, err := s.conf.PwFN(string(a.ID))
 
 			if err != nil {
 				return false, err
 			}
 
+			// Never verify against an empty key, that would accept anyone who knows the user ID.
+			if len(pw) == 0 {
+				return false, errUnknownUser
+			}
+
 			hash, err := shared.Hamc(pw, msg)
 
 			if err != nil {
@@ -39,60 +89,198 @@ func (s *Server) handle(conn net.Conn) {
 	})
 
 	if !authUser.Ok() {
-		s.conf.Log.Errf("Failed to authenticate: %s : %s : %s", conn.RemoteAddr().String(), authUser.Err().Main().Error(), authUser.Err().Reason())
+		s.conf.Metrics.handshake(authUser.Err().Reason())
+		s.conf.Log.Errf("Failed to authenticate: %s : %s : %s", remote(conn), authUser.Err().Main().Error(), authUser.Err().Reason())
 		return
 	}
 
-	conn, err := uconn.New(conn, &uconn.Opts{
-		Algo: uconn.ALGO_AES256_GCM,
-		Key:  authUser.Key,
-	})
+	conn.SetDeadline(time.Time{})
+
+	s.conf.Metrics.handshake("")
+
+	var rekey *shared.Rekey
+
+	if authUser.Rekey {
+		rekey = s.conf.Rekey
+	}
+
+	conn, err := shared.NewSecureConn(conn, authUser.S2CKey, authUser.C2SKey, rekey)
 
 	userID := string(authUser.ID)
 
 	if err != nil {
-		s.conf.Log.Errf("Failed to create uconn: user: %s | error: %s", userID, err.Error())
+		s.conf.Log.Errf("Failed to create secure conn: user: %s | error: %s", userID, err.Error())
+		return
+	}
+
+	req := s.request(conn, userID)
+
+	if req == nil {
+		return
+	}
+
+	sess, evicted, err := s.conf.Sessions.Add(s.ctx, authUser, conn)
+
+	if err != nil {
+		s.conf.Log.Errf("Session limit reached: user: %s | sessions: %d", userID, s.conf.Sessions.Count(userID))
+		conn.Write([]byte{shared.SESSION_LIMIT})
+		return
+	}
+
+	defer s.conf.Sessions.Remove(sess)
+
+	for _, old := range evicted {
+		s.conf.Log.Wrnf("Evicted oldest session: user: %s | session: %d | remote: %s", old.User, old.ID, old.Remote)
+	}
+
+	// A legacy session carries a single target, a multiplexed one carries many streams.
+	if len(req) == 2 && req[0] == shared.SESSION_MUX {
+		s.multiplex(conn, sess, req[1])
+		return
+	}
+
+	s.open(conn, sess, req)
+}
+
+func (s *Server) multiplex(conn net.Conn, sess *Session, version uint8) {
+	userID := sess.User
+
+	if version != mux.VERSION {
+		s.conf.Log.Errf("Unsupported mux version: user: %s | version: %d", userID, version)
+		conn.Write([]byte{shared.MALFORMED_REQUEST})
 		return
 	}
 
-	s.connect(conn, userID)
+	if _, err := conn.Write([]byte{shared.SESSION_MUX}); err != nil {
+		s.conf.Log.Errf("Failed to confirm mux session: user: %s | error: %s", userID, err.Error())
+		return
+	}
+
+	msess := mux.Server(conn, &mux.Config{
+		MaxStreams: MAX_STREAMS,
+	})
+
+	defer msess.Close()
+
+	go func() {
+		select {
+		case <-sess.Ctx().Done():
+			msess.Close()
+			return
+		case <-msess.Done():
+			return
+		case <-s.drain:
+		}
+
+		// Draining, close the session once its last stream is done.
+		ticker := time.NewTicker(DRAIN_POLL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if msess.NumStreams() == 0 {
+					msess.Close()
+					return
+				}
+			case <-sess.Ctx().Done():
+				msess.Close()
+				return
+			case <-msess.Done():
+				return
+			}
+		}
+	}()
+
+	var streams sync.WaitGroup
+
+	defer streams.Wait()
+
+	for {
+		stream, err := msess.Accept()
+
+		if err != nil {
+			return
+		}
+
+		if s.draining() {
+			stream.Close()
+			continue
+		}
+
+		streams.Add(1)
+
+		go func() {
+			defer streams.Done()
+			s.connect(stream, sess)
+		}()
+	}
+}
+
+func (s *Server) connect(conn net.Conn, sess *Session) {
+	defer conn.Close()
+
+	if req := s.request(conn, sess.User); req != nil {
+		s.open(conn, sess, req)
+	}
 }
 
-func (s *Server) connect(conn net.Conn, userID string) {
+func (s *Server) request(conn net.Conn, userID string) []byte {
 	req := shared.Read(&shared.ReadConn{
 		Conn:    conn,
 		Buf:     make([]byte, shared.MAX_TARGET_SIZE),
-		Timeout: 5 * time.Second,
+		Timeout: s.conf.RequestTimeout,
 		Full:    false,
 	})
 
 	if req.Err() != nil {
 		s.conf.Log.Errf("Failed to read request: user: %s | error: %s", userID, req.Err().Error())
-		return
+		return nil
 	}
 
-	target, err := (&shared.Target{}).Unpack(req.Bytes())
+	return req.Bytes()
+}
+
+func (s *Server) open(conn net.Conn, sess *Session, req []byte) {
+	userID := sess.User
+	target, err := (&shared.Target{}).Unpack(req)
 
 	if err != nil {
 		s.conf.Log.Errf("Failed to unpack target: user: %s | error: %s", userID, err.Error())
-		conn.Write([]byte{shared.MALFORMED_REQUEST})
+		s.reply(conn, "", shared.MALFORMED_REQUEST)
 		return
 	}
 
 	if !s.conf.ProtoFN(userID, target.Net) {
 		s.conf.Log.Errf("Requested unsupported protocol: user: %s | protocol: %s", userID, target.Net)
-		conn.Write([]byte{shared.INVALID_PROTOCOL})
+		s.reply(conn, target.Net, shared.INVALID_PROTOCOL)
+		return
+	}
+
+	if allow, decided := s.rules.Load().policy.Check(s.aclRequest(sess, target)); decided && !allow {
+		s.conf.Log.Errf("Destination denied: user: %s | target: %s", userID, net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		s.reply(conn, target.Net, shared.CONN_DENIED)
+		return
+	}
+
+	lim, err := s.conf.Limiter.Open(sess.Ctx(), userID)
+
+	if err != nil {
+		s.conf.Log.Errf("Quota exceeded: user: %s | error: %s", userID, err.Error())
+		s.reply(conn, target.Net, shared.QUOTA_EXCEEDED)
 		return
 	}
 
+	defer lim.Close()
+
 	switch target.Net {
 	case "tcp":
-		s.tcp(userID, target, conn)
+		s.tcp(sess, target, conn, lim)
 	case "udp":
-		s.udp(userID, target, conn)
+		s.udp(sess, target, conn, lim)
 	default:
 		s.conf.Log.Errf("Unsupported protocol: user: %s | protocol: %s", userID, target.Net)
-		conn.Write([]byte{shared.INVALID_PROTOCOL})
+		s.reply(conn, target.Net, shared.INVALID_PROTOCOL)
 		return
 	}
 }
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kriptun/proxyproto"
+	"kriptun/shared"
+	"kriptun/transport"
+	"net"
+	"os"
+	"time"
+)
+
+// listen binds l, then reads the PROXY header, if enabled, before the transport handshake.
+func (s *Server) listen(l *Listener) (net.Listener, error) {
+	ln, err := bind(l)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if l.Proxy != nil {
+		if l.Proxy.ErrFN == nil {
+			l.Proxy.ErrFN = func(conn net.Conn, err error) {
+				s.conf.Log.Errf("Invalid PROXY header: %s | error: %s", conn.RemoteAddr().String(), err.Error())
+			}
+		}
+
+		ln = proxyproto.Listen(ln, l.Proxy)
+	}
+
+	tln, err := transport.Listen(ln, l.Transport)
+
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return tln, nil
+}
+
+func bind(l *Listener) (net.Listener, error) {
+	if l.Net != "unix" {
+		lc := &net.ListenConfig{
+			KeepAlive: l.KeepAlive,
+		}
+
+		return lc.Listen(context.Background(), l.Net, l.Addr)
+	}
+
+	if err := removeStale(l.Addr); err != nil {
+		return nil, err
+	}
+
+	mode := l.Mode
+
+	if mode == 0 {
+		mode = 0600
+	}
+
+	return shared.ListenUnix(l.Addr, mode)
+}
+
+// removeStale removes a socket left behind by a previous run, a socket still
+// accepting connections or a file that is not a socket is left alone.
+func removeStale(path string) error {
+	info, err := os.Lstat(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s: exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: socket is in use", path)
+	}
+
+	return os.Remove(path)
+}
+
+func addrString(ln net.Listener) string {
+	if ln.Addr().Network() == "unix" {
+		return "unix:" + ln.Addr().String()
+	}
+
+	return ln.Addr().String()
+}
+
+// remote names the peer in logs and session listings, unix peers are unnamed so the socket is used.
+func remote(conn net.Conn) string {
+	if conn.LocalAddr().Network() == "unix" {
+		return "unix:" + conn.LocalAddr().String()
+	}
+
+	return conn.RemoteAddr().String()
+}
+
+func transportName(l *Listener) string {
+	if l.Transport == nil || l.Transport.Kind == "" {
+		return transport.TCP
+	}
+
+	return l.Transport.Kind
+}
+
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	return nil
+}
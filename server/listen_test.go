@@ -0,0 +1,208 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"kriptun/transport"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dipakw/logs"
+)
+
+func testServer(t *testing.T, listeners ...*Listener) *Server {
+	_, key, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(&Config{
+		Listeners: listeners,
+		Log:       logs.New(&logs.Config{Allow: logs.NONE}),
+		Identity:  key,
+		PwFN:      func(id string) ([]byte, error) { return nil, errUnknownUser },
+		ProtoFN:   func(id string, proto string) bool { return false },
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestStartAllListeners(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "kriptun.sock")
+
+	s := testServer(t,
+		&Listener{Net: "tcp4", Addr: "127.0.0.1:0"},
+		&Listener{Net: "unix", Addr: sock, Mode: 0660},
+	)
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := s.Addr()
+
+	if len(addrs) != 2 || strings.HasSuffix(addrs[0], ":0") || addrs[1] != "unix:"+sock {
+		t.Fatalf("unexpected addresses: %v", addrs)
+	}
+
+	if info, err := os.Stat(sock); err != nil || info.Mode().Perm() != 0660 {
+		t.Fatalf("expected socket mode 0660, got %v", err)
+	}
+
+	for _, addr := range []string{addrs[0], sock} {
+		network := "tcp"
+
+		if addr == sock {
+			network = "unix"
+		}
+
+		conn, err := net.Dial(network, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.Close()
+	}
+
+	s.Stop()
+	s.Wait()
+
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Fatalf("expected the socket to be removed, got %v", err)
+	}
+}
+
+func TestStartIsAtomic(t *testing.T) {
+	busy, err := net.Listen("tcp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer busy.Close()
+
+	sock := filepath.Join(t.TempDir(), "kriptun.sock")
+
+	s := testServer(t,
+		&Listener{Net: "unix", Addr: sock},
+		&Listener{Net: "tcp4", Addr: busy.Addr().String()},
+	)
+
+	if err := s.Start(); err == nil {
+		t.Fatal("expected the second bind to fail")
+	}
+
+	if _, err := net.Dial("unix", sock); err == nil {
+		t.Fatal("expected the first listener to be closed")
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "kriptun.sock")
+
+	if err := os.WriteFile(sock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := testServer(t, &Listener{Net: "unix", Addr: sock}).Start(); err == nil {
+		t.Fatal("expected a regular file to be left alone")
+	}
+
+	os.Remove(sock)
+
+	// A socket nobody accepts on is removed.
+	stale, err := net.Listen("unix", sock)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := testServer(t, &Listener{Net: "unix", Addr: sock})
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Stop()
+	s.Wait()
+}
+
+func testCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSilentClient(t *testing.T) {
+	for _, kind := range []string{transport.TLS, transport.WSS} {
+		t.Run(kind, func(t *testing.T) {
+			s := testServer(t, &Listener{
+				Net:       "tcp4",
+				Addr:      "127.0.0.1:0",
+				Transport: &transport.ServerConfig{Kind: kind, TLS: &tls.Config{Certificates: []tls.Certificate{testCert(t)}}},
+			})
+
+			s.conf.Auth.Timeout = 200 * time.Millisecond
+
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() {
+				s.Stop()
+				s.Wait()
+			}()
+
+			// Connects and never starts the TLS handshake.
+			conn, err := net.Dial("tcp", s.Addr()[0])
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer conn.Close()
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("expected the server to close the connection, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"kriptun/acct"
+	"kriptun/metrics"
+	"kriptun/shared"
+	"net"
+	"time"
+)
+
+// NewMetrics registers the server metrics, sessions and usage are read on every scrape.
+func NewMetrics(reg *metrics.Registry, sessions *Sessions, usage *acct.Accountant) *Metrics {
+	m := &Metrics{
+		handshakes:  reg.Counter("kriptun_handshakes_total", "Handshakes by result and auth error reason.", "result", "reason"),
+		dials:       reg.Counter("kriptun_dials_total", "Target requests by protocol and result status.", "proto", "status"),
+		dialTime:    reg.Histogram("kriptun_dial_duration_seconds", "Time to connect to targets.", nil, "proto"),
+		relayErrors: reg.Counter("kriptun_relay_errors_total", "Relays ended by an error other than EOF.", "proto"),
+	}
+
+	reg.GaugeFunc("kriptun_sessions_active", "Authenticated sessions currently open.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(sessions.Total())}}
+	})
+
+	reg.GaugeFunc("kriptun_connections_active", "Relayed connections currently open.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(len(usage.Conns()))}}
+	})
+
+	reg.CounterFunc("kriptun_relayed_bytes_total", "Bytes relayed per user, up is sent by the client and down delivered to it.", func() []metrics.Sample {
+		samples := []metrics.Sample{}
+
+		for _, u := range usage.Users() {
+			samples = append(samples,
+				metrics.Sample{Labels: []string{u.User, "up"}, Value: float64(u.Up())},
+				metrics.Sample{Labels: []string{u.User, "down"}, Value: float64(u.Down())},
+			)
+		}
+
+		return samples
+	}, "user", "direction")
+
+	return m
+}
+
+func (m *Metrics) handshake(reason string) {
+	if m == nil {
+		return
+	}
+
+	if reason == "" {
+		m.handshakes.With("ok", "").Inc()
+		return
+	}
+
+	m.handshakes.With("error", reason).Inc()
+}
+
+func (m *Metrics) dialed(proto string, start time.Time) {
+	if m != nil {
+		m.dialTime.With(proto).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *Metrics) relayError(proto string) {
+	if m != nil {
+		m.relayErrors.With(proto).Inc()
+	}
+}
+
+// reply sends the status of a target request and counts it.
+func (s *Server) reply(conn net.Conn, proto string, status uint8) error {
+	if m := s.conf.Metrics; m != nil {
+		m.dials.With(proto, shared.StatusText(status)).Inc()
+	}
+
+	_, err := conn.Write([]byte{status})
+
+	return err
+}
@@ -20,7 +20,11 @@ type RelayOptsTCP struct {
 	// s -> 0 = source, 1 = destination
 	// o -> 0 = read, 1 = write
 	// n -> number of bytes
+	// Called inline on every read and write, so it must not block.
 	Report func(s uint8, o uint8, n int)
+
+	// Blocks until n bytes read from s may be forwarded, an error ends the relay.
+	Wait func(s uint8, n int) error
 }
 
 // trackedConn wraps a net.Conn to manage timeouts and track bytes
@@ -29,15 +33,17 @@ type trackedConn struct {
 	readTO  time.Duration
 	writeTO time.Duration
 	report  func(s uint8, d uint8, n int)
+	wait    func(s uint8, n int) error
 	source  uint8 // 0 for source, 1 for destination
 }
 
-func newTrackedConnTCP(conn net.Conn, readTO, writeTO uint16, report func(s uint8, d uint8, n int), source uint8) *trackedConn {
+func newTrackedConnTCP(conn net.Conn, readTO, writeTO uint16, report func(s uint8, d uint8, n int), wait func(s uint8, n int) error, source uint8) *trackedConn {
 	return &trackedConn{
 		conn:    conn,
 		readTO:  time.Duration(readTO) * time.Second,
 		writeTO: time.Duration(writeTO) * time.Second,
 		report:  report,
+		wait:    wait,
 		source:  source,
 	}
 }
@@ -55,8 +61,14 @@ func (tc *trackedConn) Read(b []byte) (n int, err error) {
 			return n, err
 		}
 	}
+	if n > 0 && tc.wait != nil {
+		// Drop the bytes when the limiter ends the relay, they are not counted
+		if werr := tc.wait(tc.source, n); werr != nil {
+			return 0, werr
+		}
+	}
 	if n > 0 && tc.report != nil {
-		go tc.report(tc.source, 0, n) // Report read bytes
+		tc.report(tc.source, 0, n) // Report read bytes
 	}
 	return n, err
 }
@@ -75,7 +87,7 @@ func (tc *trackedConn) Write(b []byte) (n int, err error) {
 		}
 	}
 	if n > 0 && tc.report != nil {
-		go tc.report(tc.source, 1, n) // Report written bytes
+		tc.report(tc.source, 1, n) // Report written bytes
 	}
 	return n, err
 }
@@ -89,8 +101,8 @@ func relayTCP(ctx context.Context, opts *RelayOptsTCP) error {
 	wg.Add(2)
 
 	// Create wrapped connections with timeout and byte counting
-	srcConn := newTrackedConnTCP(opts.Src, opts.RToS, opts.WToS, opts.Report, 0)
-	dstConn := newTrackedConnTCP(opts.Dst, opts.RToD, opts.WToD, opts.Report, 1)
+	srcConn := newTrackedConnTCP(opts.Src, opts.RToS, opts.WToS, opts.Report, opts.Wait, 0)
+	dstConn := newTrackedConnTCP(opts.Dst, opts.RToD, opts.WToD, opts.Report, opts.Wait, 1)
 
 	// Channel to capture errors from copy operations
 	errCh := make(chan error, 2)
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestTrackedConnWait(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go b.Write([]byte("ping"))
+
+	counted := 0
+	errLimit := errors.New("limit reached")
+
+	tc := newTrackedConnTCP(a, 0, 0,
+		func(s uint8, d uint8, n int) { counted += n },
+		func(s uint8, n int) error { return errLimit },
+		0)
+
+	// Bytes dropped by the limiter are not counted.
+	if _, err := tc.Read(make([]byte, 4)); !errors.Is(err, errLimit) || counted != 0 {
+		t.Fatalf("expected the read to be dropped uncounted, got %v and %d bytes", err, counted)
+	}
+}
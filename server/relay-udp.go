@@ -2,12 +2,13 @@ package server
 
 import (
 	"context"
+	"kriptun/shared"
 	"net"
 	"time"
 )
 
 const (
-	MAX_UDP_PACKET_SIZE = 65507
+	MAX_UDP_PACKET_SIZE = shared.MAX_DATAGRAM_SIZE
 	MAX_UDP_TIMEOUT     = 60
 )
 
@@ -23,10 +24,15 @@ type RelayOptsUDP struct {
 	// s -> 0 = source, 1 = destination
 	// o -> 0 = read, 1 = write
 	// n -> number of bytes
+	// Called inline on every read and write, so it must not block.
 	Report func(s uint8, o uint8, n int)
+
+	// Blocks until n bytes read from s may be forwarded, an error ends the relay.
+	Wait func(s uint8, n int) error
 }
 
-// relayUDP relays UDP packets between source and destination with timeouts and bandwidth tracking
+// relayUDP relays UDP packets between source and destination with timeouts and bandwidth tracking.
+// Datagrams are length-prefixed on the source stream to preserve their boundaries.
 func relayUDP(ctx context.Context, opts *RelayOptsUDP) error {
 	if opts == nil || opts.Src == nil || opts.Dst == nil {
 		return net.ErrClosed
@@ -64,7 +70,7 @@ func relayUDP(ctx context.Context, opts *RelayOptsUDP) error {
 					}
 				}
 
-				n, err := opts.Src.Read(buf)
+				n, err := shared.ReadDatagram(opts.Src, buf)
 				if err != nil {
 					errChan <- err
 					return
@@ -72,7 +78,15 @@ func relayUDP(ctx context.Context, opts *RelayOptsUDP) error {
 
 				// Report bytes read from source
 				if opts.Report != nil {
-					go opts.Report(0, 0, n)
+					opts.Report(0, 0, n)
+				}
+
+				// Wait for the rate limits, or end the relay
+				if opts.Wait != nil {
+					if err := opts.Wait(0, n); err != nil {
+						errChan <- err
+						return
+					}
 				}
 
 				// Set write deadline for destination
@@ -91,7 +105,7 @@ func relayUDP(ctx context.Context, opts *RelayOptsUDP) error {
 
 				// Report bytes written to destination
 				if opts.Report != nil {
-					go opts.Report(1, 1, n)
+					opts.Report(1, 1, n)
 				}
 			}
 		}
@@ -124,7 +138,15 @@ func relayUDP(ctx context.Context, opts *RelayOptsUDP) error {
 
 				// Report bytes read from destination
 				if opts.Report != nil {
-					go opts.Report(1, 0, n)
+					opts.Report(1, 0, n)
+				}
+
+				// Wait for the rate limits, or end the relay
+				if opts.Wait != nil {
+					if err := opts.Wait(1, n); err != nil {
+						errChan <- err
+						return
+					}
 				}
 
 				// Set write deadline for source
@@ -135,7 +157,7 @@ func relayUDP(ctx context.Context, opts *RelayOptsUDP) error {
 					}
 				}
 
-				_, err = opts.Src.Write(buf[:n])
+				err = shared.WriteDatagram(opts.Src, buf[:n])
 				if err != nil {
 					errChan <- err
 					return
@@ -143,7 +165,7 @@ func relayUDP(ctx context.Context, opts *RelayOptsUDP) error {
 
 				// Report bytes written to source
 				if opts.Report != nil {
-					go opts.Report(0, 1, n)
+					opts.Report(0, 1, n)
 				}
 			}
 		}
@@ -2,72 +2,340 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"io"
+	"kriptun/acct"
+	"kriptun/acl"
+	"kriptun/auth"
+	"kriptun/limit"
+	"kriptun/shared"
 	"net"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/dipakw/logs"
 )
 
 func New(conf *Config) (*Server, error) {
+	var s *Server
+
+	if conf.Users != nil {
+		if conf.PwFN == nil {
+			conf.PwFN = func(id string) ([]byte, error) {
+				u := conf.Users.Get(id)
+
+				if u == nil {
+					return nil, errUnknownUser
+				}
+
+				if !u.Active() {
+					return nil, errInactiveUser
+				}
+
+				return []byte(u.Secret), nil
+			}
+		}
+
+		if conf.KeyFN == nil {
+			conf.KeyFN = func(id string) (*auth.PublicKey, error) {
+				u := conf.Users.Get(id)
+
+				if u == nil || u.PublicKey == "" {
+					return nil, nil
+				}
+
+				if !u.Active() {
+					return nil, errInactiveUser
+				}
+
+				return auth.ParsePublicKey(u.PublicKey)
+			}
+		}
+
+		if conf.VerifierFN == nil {
+			conf.VerifierFN = func(id string) (*auth.Verifier, error) {
+				u := conf.Users.Get(id)
+
+				if u == nil || u.Verifier == "" {
+					return nil, nil
+				}
+
+				if !u.Active() {
+					return nil, errInactiveUser
+				}
+
+				return auth.ParseVerifier(u.Verifier)
+			}
+		}
+
+		if conf.ProtoFN == nil {
+			conf.ProtoFN = func(id string, proto string) bool {
+				u := conf.Users.Get(id)
+
+				if u == nil || !u.Active() {
+					return false
+				}
+
+				if protocols := s.rules.Load().protocols; len(u.Protocols) == 0 {
+					return len(protocols) == 0 || slices.Contains(protocols, proto)
+				}
+
+				return u.Allows(proto)
+			}
+		}
+	}
+
+	if conf.PwFN == nil || conf.ProtoFN == nil {
+		return nil, errors.New("either users or both PwFN and ProtoFN are required")
+	}
+
+	if conf.Auth == nil {
+		conf.Auth = &AuthConfig{
+			Bits:          768,
+			Timeout:       5 * time.Second,
+			MinSigSize:    32,
+			MaxSigSize:    auth.MAX_CLIENT_SIG_SIZE,
+			MinIdMetaSize: 2,
+			MaxIdMetaSize: 256,
+			Hybrid:        true,
+		}
+	}
+
+	if conf.Limiter == nil {
+		lconf := &limit.Config{}
+
+		if conf.Users != nil {
+			lconf.LimitsFN = func(id string) *limit.Limits {
+				if u := conf.Users.Get(id); u != nil && u.Limits != nil {
+					return u.Limits.Merge(nil)
+				}
+
+				return nil
+			}
+		}
+
+		// Without a state file this can not fail.
+		conf.Limiter, _ = limit.New(lconf)
+	}
+
+	if conf.Sessions == nil {
+		conf.Sessions = NewSessions(nil)
+	}
+
+	if conf.Acct == nil {
+		conf.Acct = acct.New(nil)
+	}
+
+	if conf.Rekey == nil {
+		conf.Rekey = &shared.Rekey{Bytes: shared.REKEY_BYTES, Interval: shared.REKEY_INTERVAL}
+	}
+
+	if conf.RequestTimeout == 0 {
+		conf.RequestTimeout = 5 * time.Second
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
-	s := &Server{
-		conf:     conf,
-		ctx:      ctx,
-		cancel:   cancel,
-		listener: nil,
-		wg:       sync.WaitGroup{},
+	s = &Server{
+		conf:   conf,
+		ctx:    ctx,
+		cancel: cancel,
+		wg:     sync.WaitGroup{},
+		drain:  make(chan struct{}),
+	}
+
+	err := s.SetPolicies(&Policies{
+		Protocols:    conf.Protocols,
+		Policy:       conf.Policy,
+		AllowPrivate: conf.AllowPrivate,
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
 	return s, nil
 }
 
-func (s *Server) Start() error {
-	var err error
+// Validate reports whether SetPolicies would accept p.
+func (p *Policies) Validate() error {
+	_, err := acl.NewGuard(p.AllowPrivate)
+	return err
+}
 
-	s.listener, err = net.Listen(s.conf.Bind.Net, s.conf.Bind.Addr)
+// SetPolicies replaces the destination rules, requests already past their checks are not affected.
+func (s *Server) SetPolicies(p *Policies) error {
+	guard, err := acl.NewGuard(p.AllowPrivate)
 
 	if err != nil {
-		s.conf.Log.Mustf(logs.ERROR, logs.DTAG, "Failed to start server: %s", err.Error())
 		return err
 	}
 
-	s.conf.Log.Mustf(logs.INFO, logs.DTAG, "Server running on: %s", s.Addr())
+	s.rules.Store(&rules{
+		protocols: slices.Clone(p.Protocols),
+		policy:    p.Policy,
+		guard:     guard,
+	})
 
-	s.wg.Add(1)
+	return nil
+}
 
-	go func() {
-		defer s.wg.Done()
-		defer s.listener.Close()
+// Start binds every listener and fails without accepting anything if any bind fails.
+func (s *Server) Start() error {
+	if len(s.conf.Listeners) == 0 {
+		return errors.New("no listeners configured")
+	}
 
-		for {
-			conn, err := s.listener.Accept()
+	listeners := make([]net.Listener, 0, len(s.conf.Listeners))
 
-			if err != nil {
-				if err != io.EOF {
-					s.conf.Log.Err("Failed to accept:", err.Error())
-				}
+	for _, l := range s.conf.Listeners {
+		ln, err := s.listen(l)
 
-				return
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
 			}
 
-			go s.handle(conn)
+			s.conf.Log.Mustf(logs.ERROR, logs.DTAG, "Failed to start server: %s", err.Error())
+			return err
 		}
-	}()
+
+		listeners = append(listeners, ln)
+	}
+
+	s.listeners = listeners
+
+	for i, ln := range s.listeners {
+		s.conf.Log.Mustf(logs.INFO, logs.DTAG, "Server running on: %s | transport: %s", addrString(ln), transportName(s.conf.Listeners[i]))
+	}
+
+	s.conf.Log.Mustf(logs.INFO, logs.DTAG, "Server identity: %s", auth.Fingerprint(s.conf.Identity.Public().(ed25519.PublicKey)))
+
+	for _, ln := range s.listeners {
+		s.wg.Add(1)
+		go s.accept(ln)
+	}
 
 	return nil
 }
 
+func (s *Server) accept(ln net.Listener) {
+	defer s.wg.Done()
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.conf.Log.Err("Failed to accept:", err.Error())
+			}
+
+			return
+		}
+
+		s.wg.Add(1)
+
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// Stop closes the listener and tears down every session immediately.
 func (s *Server) Stop() error {
 	s.cancel()
-	return s.listener.Close()
+	return s.close()
+}
+
+// Shutdown stops accepting, lets active relays finish until ctx is done,
+// then closes whatever is left and waits for every handler to return.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drainOnce.Do(func() {
+		close(s.drain)
+	})
+
+	s.conf.Log.Mustf(logs.INFO, logs.DTAG, "Server draining: %s | sessions: %d", strings.Join(s.Addr(), ", "), s.conf.Sessions.Total())
+
+	err := s.close()
+
+	done := make(chan struct{})
+
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancel()
+		return err
+	case <-ctx.Done():
+		s.conf.Log.Wrnf("Shutdown deadline reached, closing remaining sessions: %s | sessions: %d", strings.Join(s.Addr(), ", "), s.conf.Sessions.Total())
+	}
+
+	s.cancel()
+	<-done
+
+	return ctx.Err()
 }
 
+// Wait returns once the accept loop and every handler have returned.
 func (s *Server) Wait() {
 	s.wg.Wait()
 }
 
-func (s *Server) Addr() string {
-	return s.conf.Bind.Addr
+func (s *Server) draining() bool {
+	select {
+	case <-s.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sessions returns the registry of authenticated sessions.
+func (s *Server) Sessions() *Sessions {
+	return s.conf.Sessions
+}
+
+// Acct returns the byte counters of the relayed connections.
+func (s *Server) Acct() *acct.Accountant {
+	return s.conf.Acct
+}
+
+// Addr returns the bound address of every listener, or the configured ones before Start.
+func (s *Server) Addr() []string {
+	addrs := make([]string, 0, len(s.conf.Listeners))
+
+	if s.listeners == nil {
+		for _, l := range s.conf.Listeners {
+			addrs = append(addrs, l.Addr)
+		}
+
+		return addrs
+	}
+
+	for _, ln := range s.listeners {
+		addrs = append(addrs, addrString(ln))
+	}
+
+	return addrs
+}
+
+// close closes every listener, the ones already closed are ignored.
+func (s *Server) close() error {
+	var errs []error
+
+	for _, ln := range s.listeners {
+		if err := ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
 }
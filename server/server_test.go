@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"kriptun/client"
+	"kriptun/shared"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dipakw/logs"
+)
+
+// testRelay starts a server relaying to an echo listener and returns a connection through it.
+func testRelay(t *testing.T) (*Server, net.Conn) {
+	echo, err := net.Listen("tcp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { echo.Close() })
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	_, identity, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := logs.New(&logs.Config{Allow: logs.NONE})
+
+	s, err := New(&Config{
+		Listeners:    []*Listener{{Net: "tcp4", Addr: "127.0.0.1:0"}},
+		Log:          log,
+		Identity:     identity,
+		AllowPrivate: []string{"127.0.0.0/8"},
+		PwFN:         func(id string) ([]byte, error) { return []byte("pw"), nil },
+		ProtoFN:      func(id string, proto string) bool { return true },
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.conf.Auth.Timeout = time.Second
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		s.Stop()
+		s.Wait()
+	})
+
+	c, err := client.New(&client.Config{
+		Server:   &shared.Addr{Net: "tcp", Addr: s.Addr()[0]},
+		Log:      log,
+		Username: "user",
+		Password: "pw",
+		Insecure: true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+
+	conn, err := c.Dial(&shared.Target{Net: "tcp", Host: "127.0.0.1", Port: uint16(echo.Addr().(*net.TCPAddr).Port)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	buf := make([]byte, 4)
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected the echo, got %q %v", buf, err)
+	}
+
+	return s, conn
+}
+
+func TestShutdownDrains(t *testing.T) {
+	s, conn := testRelay(t)
+
+	// A client that never speaks must not hold up the drain, see handle.
+	silent, err := net.Dial("tcp", s.Addr()[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer silent.Close()
+
+	done := make(chan error, 1)
+	start := time.Now()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		done <- s.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected Shutdown to wait for the open connection, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// The relay keeps working while the server drains.
+	if _, err := conn.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("expected the echo while draining, got %q %v", buf, err)
+	}
+
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected a clean drain, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Shutdown to return once the connection closed, still waiting after %s", time.Since(start))
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s, conn := testRelay(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := s.Shutdown(ctx)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be reached, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("expected Shutdown to wait for the grace period, returned after %s", elapsed)
+	}
+
+	// The session is closed once the grace period is over.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
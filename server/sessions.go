@@ -0,0 +1,243 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"kriptun/auth"
+	"maps"
+	"net"
+	"slices"
+	"time"
+)
+
+func NewSessions(conf *SessionsConfig) *Sessions {
+	if conf == nil {
+		conf = &SessionsConfig{}
+	}
+
+	return &Sessions{
+		conf:  conf,
+		users: map[string]*User{},
+	}
+}
+
+// SetConfig changes the limits, sessions above the new limits are kept.
+func (r *Sessions) SetConfig(conf *SessionsConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.conf = conf
+}
+
+// Add registers a session for the authenticated user. When a limit is reached the
+// oldest session is evicted, or errSessionLimit returned when eviction is disabled.
+func (r *Sessions) Add(ctx context.Context, a *auth.Auth, conn net.Conn) (*Session, []*Session, error) {
+	id := string(a.ID)
+
+	r.mu.Lock()
+
+	u, ok := r.users[id]
+
+	if !ok {
+		u = &User{id: id}
+	}
+
+	userFull := r.conf.MaxPerUser > 0 && len(u.sessions) >= r.conf.MaxPerUser
+	totalFull := r.conf.MaxTotal > 0 && r.total >= r.conf.MaxTotal
+
+	if (userFull || totalFull) && !r.conf.Evict {
+		r.mu.Unlock()
+		return nil, nil, errSessionLimit
+	}
+
+	evicted := []*Session{}
+
+	if userFull {
+		evicted = append(evicted, u.sessions[0])
+		r.remove(u.sessions[0])
+	}
+
+	if totalFull && !userFull {
+		if oldest := r.oldest(); oldest != nil {
+			evicted = append(evicted, oldest)
+			r.remove(oldest)
+		}
+	}
+
+	r.nextID++
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &Session{
+		ID:      r.nextID,
+		User:    id,
+		Remote:  remote(conn),
+		IP:      remoteIP(conn),
+		Started: time.Now(),
+		Auth:    a,
+		conn:    conn,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	u.sessions = append(u.sessions, s)
+	r.users[id] = u
+	r.total++
+
+	r.mu.Unlock()
+
+	for _, old := range evicted {
+		old.conn.Close()
+	}
+
+	return s, evicted, nil
+}
+
+// Remove unregisters a session, removing an evicted session again is a no-op.
+func (r *Sessions) Remove(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.remove(s)
+}
+
+// Kill closes a session and every connection it carries.
+func (r *Sessions) Kill(id uint64) bool {
+	found := r.Get(id)
+
+	if found == nil {
+		return false
+	}
+
+	r.Remove(found)
+	found.conn.Close()
+
+	return true
+}
+
+// KillUser closes every session of a user and returns how many were closed.
+func (r *Sessions) KillUser(id string) int {
+	r.mu.Lock()
+
+	var killed []*Session
+
+	if u, ok := r.users[id]; ok {
+		killed = slices.Clone(u.sessions)
+
+		for _, s := range killed {
+			r.remove(s)
+		}
+	}
+
+	r.mu.Unlock()
+
+	for _, s := range killed {
+		s.conn.Close()
+	}
+
+	return len(killed)
+}
+
+// Prune closes every session of the users keep rejects and returns how many were closed.
+func (r *Sessions) Prune(keep func(id string) bool) int {
+	r.mu.Lock()
+	ids := slices.Collect(maps.Keys(r.users))
+	r.mu.Unlock()
+
+	killed := 0
+
+	for _, id := range ids {
+		if !keep(id) {
+			killed += r.KillUser(id)
+		}
+	}
+
+	return killed
+}
+
+// Get returns a live session by ID.
+func (r *Sessions) Get(id uint64) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, u := range r.users {
+		if i := slices.IndexFunc(u.sessions, func(s *Session) bool { return s.ID == id }); i >= 0 {
+			return u.sessions[i]
+		}
+	}
+
+	return nil
+}
+
+// List returns every live session ordered from oldest to newest.
+func (r *Sessions) List() []*Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]*Session, 0, r.total)
+
+	for _, u := range r.users {
+		list = append(list, u.sessions...)
+	}
+
+	slices.SortFunc(list, func(a, b *Session) int { return cmp.Compare(a.ID, b.ID) })
+
+	return list
+}
+
+// Count returns the number of live sessions of a user.
+func (r *Sessions) Count(id string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if u, ok := r.users[id]; ok {
+		return len(u.sessions)
+	}
+
+	return 0
+}
+
+func (r *Sessions) Total() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.total
+}
+
+func (r *Sessions) remove(s *Session) {
+	u, ok := r.users[s.User]
+
+	if !ok {
+		return
+	}
+
+	i := slices.Index(u.sessions, s)
+
+	if i < 0 {
+		return
+	}
+
+	u.sessions = slices.Delete(u.sessions, i, i+1)
+	r.total--
+	s.cancel()
+
+	if len(u.sessions) == 0 {
+		delete(r.users, s.User)
+	}
+}
+
+// Ctx is canceled once the session is removed, killed or evicted.
+func (s *Session) Ctx() context.Context {
+	return s.ctx
+}
+
+func (r *Sessions) oldest() *Session {
+	var oldest *Session
+
+	for _, u := range r.users {
+		if len(u.sessions) > 0 && (oldest == nil || u.sessions[0].ID < oldest.ID) {
+			oldest = u.sessions[0]
+		}
+	}
+
+	return oldest
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"kriptun/auth"
+	"net"
+	"testing"
+)
+
+func testSession(t *testing.T, r *Sessions, id string) (*Session, []*Session, net.Conn, error) {
+	a, b := net.Pipe()
+
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	s, evicted, err := r.Add(context.Background(), &auth.Auth{ID: []byte(id)}, a)
+
+	return s, evicted, b, err
+}
+
+func TestSessionsReject(t *testing.T) {
+	r := NewSessions(&SessionsConfig{MaxPerUser: 2, MaxTotal: 3})
+
+	s1, _, _, _ := testSession(t, r, "alice")
+	testSession(t, r, "alice")
+
+	if _, _, _, err := testSession(t, r, "alice"); err != errSessionLimit {
+		t.Fatalf("expected per user limit, got %v", err)
+	}
+
+	testSession(t, r, "bob")
+
+	if _, _, _, err := testSession(t, r, "carol"); err != errSessionLimit {
+		t.Fatalf("expected total limit, got %v", err)
+	}
+
+	r.Remove(s1)
+	r.Remove(s1)
+
+	if _, _, _, err := testSession(t, r, "carol"); err != nil || r.Total() != 3 {
+		t.Fatalf("expected a free slot, got %v with %d sessions", err, r.Total())
+	}
+}
+
+func TestSessionsEvict(t *testing.T) {
+	r := NewSessions(&SessionsConfig{MaxPerUser: 2, MaxTotal: 3, Evict: true})
+
+	s1, _, peer1, _ := testSession(t, r, "alice")
+	s2, _, _, _ := testSession(t, r, "bob")
+	testSession(t, r, "alice")
+
+	_, evicted, _, err := testSession(t, r, "alice")
+
+	if err != nil || len(evicted) != 1 || evicted[0] != s1 {
+		t.Fatalf("expected the oldest alice session to be evicted, got %v", err)
+	}
+
+	// The evicted connection is closed.
+	if _, err := peer1.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the evicted connection to be closed")
+	}
+
+	_, evicted, _, _ = testSession(t, r, "carol")
+
+	if len(evicted) != 1 || evicted[0] != s2 || r.Count("alice") != 2 || r.Total() != 3 {
+		t.Fatalf("expected the oldest session overall to be evicted")
+	}
+
+	if !r.Kill(r.List()[0].ID) || r.Total() != 2 {
+		t.Fatal("expected kill to remove the session")
+	}
+}
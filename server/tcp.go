@@ -1,7 +1,11 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"io"
+	"kriptun/acl"
+	"kriptun/limit"
 	"kriptun/shared"
 	"net"
 	"strconv"
@@ -9,69 +13,91 @@ import (
 	"time"
 )
 
-func (s *Server) tcp(userID string, target *shared.Target, conn net.Conn) {
+func (s *Server) tcp(sess *Session, target *shared.Target, conn net.Conn, lim *limit.Conn) {
+	userID := sess.User
+
 	// Dialing target
-	bconn, err := net.DialTimeout(
+	start := time.Now()
+	bconn, err := s.dialer(sess, target, time.Duration(target.CToB)*time.Second).DialContext(
+		lim.Ctx(),
 		target.Net,
 		net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))),
-		time.Duration(target.CToB)*time.Second,
 	)
 
+	s.conf.Metrics.dialed(target.Net, start)
+
 	if err != nil {
+		// Resolved address rejected by the policy
+		if errors.Is(err, acl.ErrDenied) {
+			s.conf.Log.Errf("Destination denied: user: %s | error: %s", userID, err.Error())
+			s.reply(conn, target.Net, shared.CONN_DENIED)
+			return
+		}
+
 		// Detecting conn timeout
 		if e, ok := err.(net.Error); ok && e.Timeout() {
 			s.conf.Log.Errf("Connection timed out: user: %s | error: %s", userID, err.Error())
-			conn.Write([]byte{shared.B_CONNECT_TIMEOUT})
+			s.reply(conn, target.Net, shared.B_CONNECT_TIMEOUT)
 			return
 		}
 
 		// Check if name resolution failed
 		if strings.Contains(err.Error(), "no such host") {
 			s.conf.Log.Errf("Name resolution failed: user: %s | error: %s", userID, err.Error())
-			conn.Write([]byte{shared.RESOLVE_FAILED})
+			s.reply(conn, target.Net, shared.RESOLVE_FAILED)
 			return
 		}
 
 		// Check if connection refused
 		if strings.Contains(err.Error(), "connection refused") {
 			s.conf.Log.Errf("Connection refused: user: %s | error: %s", userID, err.Error())
-			conn.Write([]byte{shared.CONN_REFUSED})
+			s.reply(conn, target.Net, shared.CONN_REFUSED)
 			return
 		}
 
 		// Check if connection reset
 		if strings.Contains(err.Error(), "connection reset by peer") {
 			s.conf.Log.Errf("Connection reset by peer: user: %s | error: %s", userID, err.Error())
-			conn.Write([]byte{shared.CONN_RESET})
+			s.reply(conn, target.Net, shared.CONN_RESET)
 			return
 		}
 
 		// Send connection error
 		s.conf.Log.Errf("Connection error: user: %s | error: %s", userID, err.Error())
-		conn.Write([]byte{shared.CONN_ERRORED})
+		s.reply(conn, target.Net, shared.CONN_ERRORED)
 		return
 	}
 
-	if _, err := conn.Write([]byte{shared.CONN_OPENED}); err != nil {
+	if err := s.reply(conn, target.Net, shared.CONN_OPENED); err != nil {
 		s.conf.Log.Errf("Failed to write conn opened: user: %s | error: %s", userID, err.Error())
 		return
 	}
 
-	err = relayTCP(s.ctx, &RelayOptsTCP{
+	usage := s.conf.Acct.Open(userID, sess.ID, target.Net, net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	defer usage.Close()
+
+	err = relayTCP(lim.Ctx(), &RelayOptsTCP{
 		Src:  conn,
 		Dst:  bconn,
 		RToS: target.RToA,
 		WToS: target.WToA,
 		RToD: target.RToB,
 		WToD: target.WToB,
-
-		// Report: func(sr uint8, dw uint8, n int) {
-		// 	s.conf.Log.Inff("Report: user: %s | sr: %d | dw: %d | n: %d", userID, sr, dw, n)
-		// },
+		Report: func(side uint8, op uint8, n int) {
+			usage.Report(side, op, n)
+			sess.Add(side, op, n)
+		},
+		Wait: lim.Wait,
 	})
 
-	if err != nil && err != io.EOF {
+	if errors.Is(context.Cause(lim.Ctx()), limit.ErrQuotaExceeded) {
+		s.conf.Log.Errf("Quota exceeded, connection terminated: user: %s", userID)
+		return
+	}
+
+	if err != nil && err != io.EOF && !errors.Is(err, net.ErrClosed) && !errors.Is(err, context.Canceled) {
 		s.conf.Log.Errf("Failed to relay: user: %s | error: %s", userID, err.Error())
+		s.conf.Metrics.relayError(target.Net)
 		return
 	}
 }
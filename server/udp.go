@@ -1,49 +1,78 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"io"
+	"kriptun/acl"
+	"kriptun/limit"
 	"kriptun/shared"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 )
 
-func (s *Server) udp(userID string, target *shared.Target, conn net.Conn) {
-	remoteAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+func (s *Server) udp(sess *Session, target *shared.Target, conn net.Conn, lim *limit.Conn) {
+	userID := sess.User
+
+	start := time.Now()
+	dconn, err := s.dialer(sess, target, 0).DialContext(lim.Ctx(), "udp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+
+	s.conf.Metrics.dialed(target.Net, start)
 
 	if err != nil {
-		s.conf.Log.Errf("Failed to resolve UDP address: user: %s | error: %s", userID, err.Error())
-		conn.Write([]byte{shared.RESOLVE_FAILED})
-		return
-	}
+		// Resolved address rejected by the policy
+		if errors.Is(err, acl.ErrDenied) {
+			s.conf.Log.Errf("Destination denied: user: %s | error: %s", userID, err.Error())
+			s.reply(conn, target.Net, shared.CONN_DENIED)
+			return
+		}
 
-	if _, err := conn.Write([]byte{shared.CONN_OPENED}); err != nil {
-		s.conf.Log.Errf("Failed to write conn opened: user: %s | error: %s", userID, err.Error())
+		if strings.Contains(err.Error(), "no such host") {
+			s.conf.Log.Errf("Failed to resolve UDP address: user: %s | error: %s", userID, err.Error())
+			s.reply(conn, target.Net, shared.RESOLVE_FAILED)
+			return
+		}
+
+		s.conf.Log.Errf("Failed to dial UDP: user: %s | error: %s", userID, err.Error())
+		s.reply(conn, target.Net, shared.CONN_ERRORED)
 		return
 	}
 
-	udpConn, err := net.DialUDP("udp", nil, remoteAddr)
+	udpConn := dconn.(*net.UDPConn)
 
-	if err != nil {
-		s.conf.Log.Errf("Failed to dial UDP: user: %s | error: %s", userID, err.Error())
-		conn.Write([]byte{shared.CONN_ERRORED})
+	if err := s.reply(conn, target.Net, shared.CONN_OPENED); err != nil {
+		s.conf.Log.Errf("Failed to write conn opened: user: %s | error: %s", userID, err.Error())
+		udpConn.Close()
 		return
 	}
 
-	err = relayUDP(s.ctx, &RelayOptsUDP{
+	usage := s.conf.Acct.Open(userID, sess.ID, target.Net, net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	defer usage.Close()
+
+	err = relayUDP(lim.Ctx(), &RelayOptsUDP{
 		Src:  conn,
 		Dst:  udpConn,
 		RToS: target.RToA,
 		WToS: target.WToA,
 		RToD: target.RToB,
 		WToD: target.WToB,
-
-		// Report: func(sr uint8, dw uint8, n int) {
-		// 	s.conf.Log.Inff("Report: user: %s | sr: %d | dw: %d | n: %d", userID, sr, dw, n)
-		// },
+		Report: func(side uint8, op uint8, n int) {
+			usage.Report(side, op, n)
+			sess.Add(side, op, n)
+		},
+		Wait: lim.Wait,
 	})
 
-	if err != nil && err != io.EOF {
+	if errors.Is(context.Cause(lim.Ctx()), limit.ErrQuotaExceeded) {
+		s.conf.Log.Errf("Quota exceeded, connection terminated: user: %s", userID)
+		return
+	}
+
+	if err != nil && err != io.EOF && !errors.Is(err, net.ErrClosed) && !errors.Is(err, context.Canceled) {
 		s.conf.Log.Errf("Failed to relay: user: %s | error: %s", userID, err.Error())
+		s.conf.Metrics.relayError(target.Net)
 		return
 	}
 }
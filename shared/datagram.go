@@ -0,0 +1,41 @@
+package shared
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// WriteDatagram writes p as a single length-prefixed datagram.
+// Format: [length:uint16][payload]
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MAX_DATAGRAM_SIZE {
+		return fmt.Errorf("datagram too large: %d", len(p))
+	}
+
+	buf := make([]byte, 2+len(p))
+
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+
+	_, err := w.Write(buf)
+
+	return err
+}
+
+// ReadDatagram reads one length-prefixed datagram into buf and returns its size.
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	head := make([]byte, 2)
+
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, err
+	}
+
+	size := int(binary.BigEndian.Uint16(head))
+
+	if size > MAX_DATAGRAM_SIZE || size > len(buf) {
+		return 0, fmt.Errorf("datagram too large: %d", size)
+	}
+
+	return io.ReadFull(r, buf[:size])
+}
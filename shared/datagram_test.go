@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDatagramBoundaries(t *testing.T) {
+	sizes := []int{0, 1, 40000, 5, MAX_DATAGRAM_SIZE}
+	stream := &bytes.Buffer{}
+
+	for _, size := range sizes {
+		if err := WriteDatagram(stream, bytes.Repeat([]byte{byte(size)}, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := iotest.OneByteReader(stream)
+	buf := make([]byte, MAX_DATAGRAM_SIZE)
+
+	for _, size := range sizes {
+		n, err := ReadDatagram(r, buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != size || !bytes.Equal(buf[:n], bytes.Repeat([]byte{byte(size)}, size)) {
+			t.Fatalf("expected %d bytes, got %d", size, n)
+		}
+	}
+
+	if err := WriteDatagram(stream, make([]byte, MAX_DATAGRAM_SIZE+1)); err == nil {
+		t.Fatal("expected oversized datagram to fail")
+	}
+}
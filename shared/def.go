@@ -2,7 +2,11 @@ package shared
 
 import (
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/dipakw/uconn"
 )
 
 const (
@@ -27,10 +31,47 @@ const (
 	// Connect timeouts
 	A_CONNECT_TIMEOUT
 	B_CONNECT_TIMEOUT
+
+	// Destination rejected by the server policy
+	CONN_DENIED
+
+	// Daily or monthly traffic quota used up
+	QUOTA_EXCEEDED
+
+	// Too many concurrent sessions for the user or the server
+	SESSION_LIMIT
 )
 
+// STATUS_NAMES are used in logs and metrics.
+var STATUS_NAMES = map[uint8]string{
+	INVALID_PROTOCOL:  "invalid_protocol",
+	RESOLVE_FAILED:    "resolve_failed",
+	MALFORMED_REQUEST: "malformed_request",
+	CONN_OPENED:       "conn_opened",
+	CONN_EOF:          "conn_eof",
+	CONN_REFUSED:      "conn_refused",
+	CONN_RESET:        "conn_reset",
+	CONN_ERRORED:      "conn_errored",
+	A_READ_TIMEOUT:    "a_read_timeout",
+	B_READ_TIMEOUT:    "b_read_timeout",
+	A_WRITE_TIMEOUT:   "a_write_timeout",
+	B_WRITE_TIMEOUT:   "b_write_timeout",
+	A_CONNECT_TIMEOUT: "a_connect_timeout",
+	B_CONNECT_TIMEOUT: "b_connect_timeout",
+	CONN_DENIED:       "conn_denied",
+	QUOTA_EXCEEDED:    "quota_exceeded",
+	SESSION_LIMIT:     "session_limit",
+}
+
+// SESSION_MUX opens a multiplexed session when sent instead of a target, followed by the mux version.
+// It can never be mistaken for a packed target, whose first byte is at most 8.
 const (
-	MAX_TARGET_SIZE = 1 + 8 + 1 + 255 + 2 + 2 + 2 + 2 + 2 + 2 + 2
+	SESSION_MUX uint8 = 0xff
+)
+
+const (
+	MAX_TARGET_SIZE   = 1 + 8 + 1 + 255 + 2 + 2 + 2 + 2 + 2 + 2 + 2
+	MAX_DATAGRAM_SIZE = 65507
 )
 
 type Addr struct {
@@ -38,6 +79,52 @@ type Addr struct {
 	Addr string
 }
 
+// Records of a SecureConn with rekeying, carried inside the encrypted stream.
+// Format: [type:uint8][length:uint16][payload]
+const (
+	RECORD_DATA  uint8 = 0
+	RECORD_REKEY uint8 = 1
+
+	RECORD_HEADER_SIZE = 3
+
+	// Largest payload that keeps a record in a single uconn chunk: nonce + GCM tag.
+	MAX_RECORD_SIZE = int(uconn.DEFAULT_CHUNK_SIZE) - 12 - 16 - RECORD_HEADER_SIZE
+
+	REKEY_INFO = "kriptun rekey"
+)
+
+// Default rekey thresholds.
+const (
+	REKEY_BYTES    = 1 << 30
+	REKEY_INTERVAL = time.Hour
+)
+
+// Rekey holds the thresholds after which a SecureConn switches to a fresh send key, zero disables either.
+// The interval is checked when writing, an idle connection has nothing to protect.
+type Rekey struct {
+	Bytes    uint64
+	Interval time.Duration
+}
+
+// SecureConn writes through one uconn and reads through another, so each direction has its own key.
+type SecureConn struct {
+	net.Conn
+
+	rekey  *Rekey
+	rekeys atomic.Uint64
+
+	wmu   sync.Mutex
+	w     uconn.Conn
+	wkey  []byte
+	sent  uint64
+	since time.Time
+
+	rmu    sync.Mutex
+	r      uconn.Conn
+	rkey   []byte
+	remain int
+}
+
 type ReadConn struct {
 	Conn    net.Conn
 	Buf     []byte
@@ -0,0 +1,190 @@
+package shared
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/dipakw/uconn"
+)
+
+// NewSecureConn encrypts what is written to conn with send and decrypts what is read with recv.
+// The peer passes the same keys the other way around.
+//
+// With rekey the stream is split into records. Each side moves its own send direction to the next key
+// once one of its own thresholds is crossed and announces it with RECORD_REKEY, the receiver just follows.
+// Only the use of records is negotiated, the thresholds may differ. Nil keeps the plain stream of older peers.
+func NewSecureConn(conn net.Conn, send []byte, recv []byte, rekey *Rekey) (*SecureConn, error) {
+	c := &SecureConn{
+		Conn:  conn,
+		rekey: rekey,
+		wkey:  send,
+		rkey:  recv,
+		since: time.Now(),
+	}
+
+	var err error
+
+	if c.w, err = newUconn(conn, send); err != nil {
+		return nil, err
+	}
+
+	if c.r, err = newUconn(conn, recv); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *SecureConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.rekey == nil {
+		return c.w.Write(p)
+	}
+
+	n := 0
+
+	for n < len(p) {
+		if c.due() {
+			if err := c.rekeySend(); err != nil {
+				return n, err
+			}
+		}
+
+		size := min(len(p)-n, MAX_RECORD_SIZE)
+
+		// Never seal more than the threshold with one key.
+		if c.rekey.Bytes > 0 {
+			size = int(min(uint64(size), c.rekey.Bytes-c.sent))
+		}
+
+		if err := c.writeRecord(RECORD_DATA, p[n:n+size]); err != nil {
+			return n, err
+		}
+
+		n += size
+		c.sent += uint64(size)
+	}
+
+	return n, nil
+}
+
+func (c *SecureConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if c.rekey == nil {
+		return c.r.Read(p)
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	head := make([]byte, RECORD_HEADER_SIZE)
+
+	for c.remain == 0 {
+		if _, err := io.ReadFull(c.r, head); err != nil {
+			return 0, err
+		}
+
+		size := int(binary.BigEndian.Uint16(head[1:]))
+
+		switch {
+		case head[0] == RECORD_DATA:
+			c.remain = size
+		case head[0] == RECORD_REKEY && size == 0:
+			if err := c.rekeyRecv(); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("invalid record: type %d, %d bytes", head[0], size)
+		}
+	}
+
+	n, err := c.r.Read(p[:min(len(p), c.remain)])
+	c.remain -= n
+
+	return n, err
+}
+
+// Rekeys returns how many times either direction moved to a new key.
+func (c *SecureConn) Rekeys() uint64 {
+	return c.rekeys.Load()
+}
+
+func (c *SecureConn) due() bool {
+	return (c.rekey.Bytes > 0 && c.sent >= c.rekey.Bytes) ||
+		(c.rekey.Interval > 0 && time.Since(c.since) >= c.rekey.Interval)
+}
+
+// rekeySend announces the switch, everything after the rekey record is sealed with the next key.
+func (c *SecureConn) rekeySend() error {
+	if err := c.writeRecord(RECORD_REKEY, nil); err != nil {
+		return err
+	}
+
+	key, w, err := next(c.Conn, c.wkey)
+
+	if err != nil {
+		return err
+	}
+
+	c.w, c.wkey, c.sent, c.since = w, key, 0, time.Now()
+	c.rekeys.Add(1)
+
+	return nil
+}
+
+// rekeyRecv follows the peer, the rekey record was the last one sealed with the old key.
+func (c *SecureConn) rekeyRecv() error {
+	key, r, err := next(c.Conn, c.rkey)
+
+	if err != nil {
+		return err
+	}
+
+	c.r, c.rkey = r, key
+	c.rekeys.Add(1)
+
+	return nil
+}
+
+// writeRecord writes a whole record in one uconn chunk, so a key switch never splits a chunk.
+func (c *SecureConn) writeRecord(kind uint8, payload []byte) error {
+	buf := make([]byte, RECORD_HEADER_SIZE+len(payload))
+
+	buf[0] = kind
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(payload)))
+	copy(buf[RECORD_HEADER_SIZE:], payload)
+
+	_, err := c.w.Write(buf)
+
+	return err
+}
+
+// next ratchets a traffic key forward, the old key can not be recovered from the new one.
+func next(conn net.Conn, key []byte) ([]byte, uconn.Conn, error) {
+	key, err := hkdf.Expand(sha256.New, key, REKEY_INFO, len(key))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u, err := newUconn(conn, key)
+
+	return key, u, err
+}
+
+func newUconn(conn net.Conn, key []byte) (uconn.Conn, error) {
+	return uconn.New(conn, &uconn.Opts{
+		Algo: uconn.ALGO_AES256_GCM,
+		Key:  key,
+	})
+}
@@ -0,0 +1,143 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	testC2S = bytes.Repeat([]byte{1}, 32)
+	testS2C = bytes.Repeat([]byte{2}, 32)
+)
+
+func securePair(t *testing.T, rekey *Rekey) (*SecureConn, *SecureConn) {
+	a, b := net.Pipe()
+
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	client, err := NewSecureConn(a, testC2S, testS2C, rekey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewSecureConn(b, testS2C, testC2S, rekey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, server
+}
+
+func TestSecureConnDirections(t *testing.T) {
+	client, server := securePair(t, nil)
+
+	for _, dir := range []struct{ w, r net.Conn }{{client, server}, {server, client}} {
+		msg := bytes.Repeat([]byte("kriptun"), 10000)
+
+		go dir.w.Write(msg)
+
+		got := make([]byte, len(msg))
+
+		if _, err := io.ReadFull(dir.r, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("expected the message back, got %v", err)
+		}
+	}
+
+	// Reading with the key of the other direction fails.
+	wrong, err := NewSecureConn(server.Conn, testC2S, testS2C, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go client.Write([]byte("hello"))
+
+	if _, err := wrong.Read(make([]byte, 5)); err == nil {
+		t.Fatal("expected data sealed with the client key to be rejected in the other direction")
+	}
+}
+
+// exchange streams size random bytes each way at once, in uneven writes and reads.
+func exchange(t *testing.T, client, server *SecureConn, size int) {
+	errs := make(chan error, 4)
+
+	for _, dir := range []struct{ w, r *SecureConn }{{client, server}, {server, client}} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		go func() {
+			for i, step := 0, 1; i < len(data); i, step = i+step, step*3%50000+1 {
+				if _, err := dir.w.Write(data[i:min(i+step, len(data))]); err != nil {
+					errs <- err
+					return
+				}
+			}
+
+			errs <- nil
+		}()
+
+		go func() {
+			got := make([]byte, 0, size)
+			buf := make([]byte, 7000)
+
+			for len(got) < size {
+				n, err := dir.r.Read(buf)
+
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				got = append(got, buf[:n]...)
+			}
+
+			if !bytes.Equal(got, data) {
+				errs <- io.ErrUnexpectedEOF
+				return
+			}
+
+			errs <- nil
+		}()
+	}
+
+	for range 4 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSecureConnRekeyBytes(t *testing.T) {
+	client, server := securePair(t, &Rekey{Bytes: 4096})
+
+	exchange(t, client, server, 1<<20)
+
+	// Each side rekeys its own direction and follows the other one.
+	if client.Rekeys() < 2*200 || client.Rekeys() != server.Rekeys() {
+		t.Fatalf("expected hundreds of rekeys on both sides, got %d and %d", client.Rekeys(), server.Rekeys())
+	}
+
+	// The keys moved on in step, and away from the handshake keys.
+	if !bytes.Equal(client.wkey, server.rkey) || !bytes.Equal(server.wkey, client.rkey) || bytes.Equal(client.wkey, testC2S) {
+		t.Fatal("expected both ends to hold the same new keys")
+	}
+}
+
+func TestSecureConnRekeyInterval(t *testing.T) {
+	client, server := securePair(t, &Rekey{Interval: time.Nanosecond})
+
+	exchange(t, client, server, 64<<10)
+
+	if client.Rekeys() == 0 || client.Rekeys() != server.Rekeys() {
+		t.Fatalf("expected rekeys on both sides, got %d and %d", client.Rekeys(), server.Rekeys())
+	}
+}
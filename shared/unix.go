@@ -0,0 +1,22 @@
+package shared
+
+import (
+	"net"
+	"os"
+)
+
+// ListenUnix listens on a unix socket that only its owner can reach until it is set to mode.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	ln, err := listenPrivate(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
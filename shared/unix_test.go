@@ -0,0 +1,45 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	before := filepath.Join(dir, "before")
+
+	if err := os.WriteFile(before, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "kriptun.sock")
+	ln, err := ListenUnix(path, 0660)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	info, err := os.Stat(path)
+
+	if err != nil || info.Mode().Perm() != 0660 {
+		t.Fatalf("expected mode 0660, got %v %v", info, err)
+	}
+
+	// The umask of the process is restored.
+	after := filepath.Join(dir, "after")
+
+	if err := os.WriteFile(after, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := os.Stat(before)
+	b, _ := os.Stat(after)
+
+	if a.Mode().Perm() != b.Mode().Perm() {
+		t.Fatalf("expected the umask to be restored, got %v and %v", a.Mode().Perm(), b.Mode().Perm())
+	}
+}
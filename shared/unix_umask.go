@@ -0,0 +1,23 @@
+//go:build unix
+
+package shared
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+var umaskMu sync.Mutex
+
+// listenPrivate creates the socket under a umask that leaves it to the owner, the umask is
+// process wide so files created meanwhile by other goroutines are only ever more private.
+func listenPrivate(path string) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+
+	return net.Listen("unix", path)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"io"
+	"strconv"
 )
 
 func Rand(size int) ([]byte, error) {
@@ -26,3 +27,12 @@ func Hamc(a []byte, b []byte) ([]byte, error) {
 
 	return h.Sum(nil), nil
 }
+
+// StatusText returns the name of a status byte, or its number when unknown.
+func StatusText(status uint8) string {
+	if name, ok := STATUS_NAMES[status]; ok {
+		return name
+	}
+
+	return strconv.Itoa(int(status))
+}
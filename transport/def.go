@@ -0,0 +1,92 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TCP = "tcp" // Raw TCP, or a unix socket
+	TLS = "tls" // TLS
+	WSS = "wss" // WebSocket over TLS
+)
+
+const (
+	WS_GUID    = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	WS_VERSION = "13"
+	WS_PATH    = "/"
+
+	// Upper bound for the upgrade request or response, the payload starts right after it.
+	WS_MAX_HEADER = 8192
+
+	// How long Close waits to send the close frame.
+	WS_CLOSE_TIMEOUT = time.Second
+)
+
+// WebSocket opcodes, RFC 6455 section 5.2.
+const (
+	OP_CONTINUATION = 0x0
+	OP_TEXT         = 0x1
+	OP_BINARY       = 0x2
+	OP_CLOSE        = 0x8
+	OP_PING         = 0x9
+	OP_PONG         = 0xa
+)
+
+var (
+	ErrUnknown   = errors.New("unknown transport")
+	ErrHandshake = errors.New("websocket handshake failed")
+	ErrFrame     = errors.New("invalid websocket frame")
+)
+
+type ServerConfig struct {
+	Kind string // TCP when empty
+
+	// Certificates for TLS and WSS.
+	TLS *tls.Config
+
+	// Request path WSS accepts, anything else gets a 404. WS_PATH when empty.
+	Path string
+}
+
+type ClientConfig struct {
+	Kind string // TCP when empty
+
+	// ServerName defaults to the host of the dialed address.
+	TLS *tls.Config
+
+	// Request path and Host header for WSS, WS_PATH and the dialed address when empty.
+	Path string
+	Host string
+}
+
+type wsListener struct {
+	net.Listener
+	path string
+}
+
+// wsConn carries a byte stream in binary frames, the upgrade happens on first use on the server.
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool // Clients mask their frames and expect unmasked ones
+
+	handshake func() error
+	hsOnce    sync.Once
+	hsErr     error
+	up        atomic.Bool // Upgraded, so Close sends a close frame
+
+	rmu    sync.Mutex
+	remain uint64  // Unread payload of the current frame
+	mask   [4]byte // Mask of the current frame
+	masked bool
+	pos    int
+
+	wmu    sync.Mutex
+	closed bool
+}
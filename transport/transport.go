@@ -0,0 +1,125 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// Listen wraps ln so that Accept returns connections already speaking the transport.
+// TLS and WebSocket handshakes run on the first Read or Write, not in Accept.
+func Listen(ln net.Listener, conf *ServerConfig) (net.Listener, error) {
+	if conf == nil {
+		return ln, nil
+	}
+
+	switch conf.Kind {
+	case "", TCP:
+		return ln, nil
+	case TLS, WSS:
+		if conf.TLS == nil || (len(conf.TLS.Certificates) == 0 && conf.TLS.GetCertificate == nil) {
+			return nil, fmt.Errorf("%s transport requires a certificate", conf.Kind)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknown, conf.Kind)
+	}
+
+	tconf := conf.TLS.Clone()
+
+	if tconf.MinVersion == 0 {
+		tconf.MinVersion = tls.VersionTLS12
+	}
+
+	if len(tconf.NextProtos) == 0 {
+		tconf.NextProtos = []string{"http/1.1"}
+	}
+
+	ln = tls.NewListener(ln, tconf)
+
+	if conf.Kind == TLS {
+		return ln, nil
+	}
+
+	path := conf.Path
+
+	if path == "" {
+		path = WS_PATH
+	}
+
+	return &wsListener{Listener: ln, path: path}, nil
+}
+
+// Dial connects to addr and completes the transport handshakes before returning.
+func Dial(ctx context.Context, network string, addr string, conf *ClientConfig) (net.Conn, error) {
+	if conf == nil {
+		conf = &ClientConfig{}
+	}
+
+	switch conf.Kind {
+	case "", TCP:
+		d := &net.Dialer{}
+		return d.DialContext(ctx, network, addr)
+	case TLS, WSS:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknown, conf.Kind)
+	}
+
+	tconf := &tls.Config{}
+
+	if conf.TLS != nil {
+		tconf = conf.TLS.Clone()
+	}
+
+	if tconf.ServerName == "" && network != "unix" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			tconf.ServerName = host
+		}
+	}
+
+	if len(tconf.NextProtos) == 0 {
+		tconf.NextProtos = []string{"http/1.1"}
+	}
+
+	d := &tls.Dialer{Config: tconf}
+	conn, err := d.DialContext(ctx, network, addr)
+
+	if err != nil || conf.Kind == TLS {
+		return conn, err
+	}
+
+	host := conf.Host
+
+	if host == "" {
+		host = tconf.ServerName
+	}
+
+	if host == "" {
+		host = "localhost"
+	}
+
+	path := conf.Path
+
+	if path == "" {
+		path = WS_PATH
+	}
+
+	ws, err := wsClient(ctx, conn, host, path)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return wsServer(conn, l.path), nil
+}
@@ -0,0 +1,225 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert returns a self-signed certificate for localhost and a pool trusting it.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// echo serves conf on a local port and copies every connection back to itself.
+func echo(t *testing.T, conf *ServerConfig) string {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := Listen(inner, conf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ln.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return inner.Addr().String()
+}
+
+func roundTrip(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	// Large enough for 64 bit frame lengths and several TLS records.
+	data := make([]byte, 200_000)
+	rand.Read(data)
+
+	go conn.Write(data)
+
+	got := make([]byte, len(data))
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatal("echoed data differs")
+	}
+}
+
+func TestTransports(t *testing.T) {
+	cert, pool := testCert(t)
+
+	for _, kind := range []string{TCP, TLS, WSS} {
+		t.Run(kind, func(t *testing.T) {
+			addr := echo(t, &ServerConfig{
+				Kind: kind,
+				TLS:  &tls.Config{Certificates: []tls.Certificate{cert}},
+				Path: "/tunnel",
+			})
+
+			conn, err := Dial(context.Background(), "tcp", addr, &ClientConfig{
+				Kind: kind,
+				TLS:  &tls.Config{RootCAs: pool, ServerName: "localhost"},
+				Path: "/tunnel",
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			roundTrip(t, conn)
+		})
+	}
+}
+
+func TestWebSocketRejectsProbes(t *testing.T) {
+	cert, pool := testCert(t)
+
+	addr := echo(t, &ServerConfig{
+		Kind: WSS,
+		TLS:  &tls.Config{Certificates: []tls.Certificate{cert}},
+		Path: "/tunnel",
+	})
+
+	_, err := Dial(context.Background(), "tcp", addr, &ClientConfig{
+		Kind: WSS,
+		TLS:  &tls.Config{RootCAs: pool, ServerName: "localhost"},
+		Path: "/",
+	})
+
+	if !errors.Is(err, ErrHandshake) || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected a 404 for the wrong path, got %v", err)
+	}
+
+	// A plain HTTPS request is answered like a web server.
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	io.WriteString(conn, "GET /tunnel HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	resp, _ := io.ReadAll(conn)
+
+	if !strings.HasPrefix(string(resp), "HTTP/1.1 404") {
+		t.Fatalf("expected a 404 without the upgrade, got %q", resp)
+	}
+}
+
+func TestWebSocketControlFrames(t *testing.T) {
+	a, b := net.Pipe()
+
+	server := wsServer(a, WS_PATH)
+	server.hsOnce.Do(func() {})
+	server.up.Store(true)
+
+	client := &wsConn{Conn: b, r: bufio.NewReader(b), client: true}
+	client.up.Store(true)
+
+	go func() {
+		client.writeFrame(OP_PING, []byte("hi"))
+		client.Write([]byte("data"))
+	}()
+
+	// The ping is answered while the server reads.
+	pong := make(chan error, 1)
+
+	go func() {
+		var h [4]byte
+
+		if _, err := io.ReadFull(b, h[:]); err != nil || h[0] != 0x80|OP_PONG || string(h[2:]) != "hi" {
+			pong <- errors.New("expected an unmasked pong")
+			return
+		}
+
+		pong <- nil
+	}()
+
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+
+	if err != nil || string(buf[:n]) != "data" {
+		t.Fatalf("expected data after the ping, got %q %v", buf[:n], err)
+	}
+
+	if err := <-pong; err != nil {
+		t.Fatal(err)
+	}
+
+	// Unmasked frames from a client are rejected.
+	go b.Write([]byte{0x80 | OP_BINARY, 1, 'x'})
+
+	if _, err := server.Read(buf); !errors.Is(err, ErrFrame) {
+		t.Fatalf("expected a frame error, got %v", err)
+	}
+}
@@ -0,0 +1,360 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// capReader fails once more than n bytes were read, a negative n lifts the cap.
+// It bounds the upgrade headers, frames are streamed and never buffered whole.
+type capReader struct {
+	r io.Reader
+	n int
+}
+
+func wsServer(conn net.Conn, path string) *wsConn {
+	cr := &capReader{r: conn, n: WS_MAX_HEADER}
+
+	c := &wsConn{
+		Conn: conn,
+		r:    bufio.NewReader(cr),
+	}
+
+	c.handshake = func() error {
+		req, err := http.ReadRequest(c.r)
+
+		if err != nil {
+			return err
+		}
+
+		key := req.Header.Get("Sec-WebSocket-Key")
+
+		upgrade := req.Method == http.MethodGet &&
+			req.URL.Path == path &&
+			headerHas(req.Header, "Connection", "upgrade") &&
+			headerHas(req.Header, "Upgrade", "websocket") &&
+			req.Header.Get("Sec-WebSocket-Version") == WS_VERSION &&
+			key != ""
+
+		// Anything but our upgrade looks like a plain web server.
+		if !upgrade {
+			io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nContent-Type: text/plain\r\nContent-Length: 10\r\nConnection: close\r\n\r\nNot Found\n")
+			return ErrHandshake
+		}
+
+		cr.n = -1
+
+		_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: "+acceptKey(key)+"\r\n\r\n")
+
+		return err
+	}
+
+	return c
+}
+
+func wsClient(ctx context.Context, conn net.Conn, host string, path string) (*wsConn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	_, err := io.WriteString(conn, "GET "+path+" HTTP/1.1\r\n"+
+		"Host: "+host+"\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: "+key+"\r\n"+
+		"Sec-WebSocket-Version: "+WS_VERSION+"\r\n\r\n")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &capReader{r: conn, n: WS_MAX_HEADER}
+	r := bufio.NewReader(cr)
+
+	resp, err := http.ReadResponse(r, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%w: %s", ErrHandshake, resp.Status)
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, fmt.Errorf("%w: bad accept key", ErrHandshake)
+	}
+
+	cr.n = -1
+
+	c := &wsConn{
+		Conn:   conn,
+		r:      r,
+		client: true,
+	}
+
+	c.up.Store(true)
+
+	return c, nil
+}
+
+func (c *wsConn) init() error {
+	if c.handshake == nil {
+		return nil
+	}
+
+	c.hsOnce.Do(func() {
+		if c.hsErr = c.handshake(); c.hsErr == nil {
+			c.up.Store(true)
+		}
+	})
+
+	return c.hsErr
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for c.remain == 0 {
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > c.remain {
+		b = b[:c.remain]
+	}
+
+	n, err := c.r.Read(b)
+	c.unmask(b[:n])
+	c.remain -= uint64(n)
+
+	return n, err
+}
+
+// next reads frame headers, answering control frames, until a data frame starts.
+func (c *wsConn) next() error {
+	var h [8]byte
+
+	if _, err := io.ReadFull(c.r, h[:2]); err != nil {
+		return err
+	}
+
+	fin := h[0]&0x80 != 0
+	op := h[0] & 0x0f
+	masked := h[1]&0x80 != 0
+	size := uint64(h[1] & 0x7f)
+
+	// Extensions are never negotiated and only clients mask.
+	if h[0]&0x70 != 0 || masked == c.client {
+		return ErrFrame
+	}
+
+	switch size {
+	case 126:
+		if _, err := io.ReadFull(c.r, h[:2]); err != nil {
+			return err
+		}
+
+		size = uint64(binary.BigEndian.Uint16(h[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.r, h[:8]); err != nil {
+			return err
+		}
+
+		if size = binary.BigEndian.Uint64(h[:8]); size>>63 != 0 {
+			return ErrFrame
+		}
+	}
+
+	c.masked = masked
+	c.pos = 0
+
+	if masked {
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case OP_BINARY, OP_CONTINUATION:
+		c.remain = size
+		return nil
+	case OP_CLOSE, OP_PING, OP_PONG:
+	default:
+		return ErrFrame
+	}
+
+	if !fin || size > 125 {
+		return ErrFrame
+	}
+
+	payload := make([]byte, size)
+
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	c.unmask(payload)
+
+	switch op {
+	case OP_PING:
+		return c.writeFrame(OP_PONG, payload)
+	case OP_CLOSE:
+		// Echo the status code, then report the end of the stream.
+		c.writeFrame(OP_CLOSE, payload[:min(len(payload), 2)])
+		return io.EOF
+	}
+
+	return nil
+}
+
+func (c *wsConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+
+	for i := range b {
+		b[i] ^= c.mask[c.pos&3]
+		c.pos++
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+
+	if err := c.writeFrame(OP_BINARY, b); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// writeFrame sends payload as a single final frame, masked when sent by a client.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	if op == OP_CLOSE {
+		c.closed = true
+	}
+
+	var bit byte
+
+	if c.client {
+		bit = 0x80
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, bit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, bit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, bit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	start := len(frame)
+
+	if c.client {
+		var key [4]byte
+		rand.Read(key[:])
+		frame = append(frame, key[:]...)
+		start += 4
+	}
+
+	frame = append(frame, payload...)
+
+	if c.client {
+		key := frame[start-4 : start]
+
+		for i := range payload {
+			frame[start+i] ^= key[i&3]
+		}
+	}
+
+	_, err := c.Conn.Write(frame)
+
+	return err
+}
+
+// Close sends a close frame when the connection was upgraded, then closes it.
+func (c *wsConn) Close() error {
+	if c.up.Load() {
+		c.Conn.SetWriteDeadline(time.Now().Add(WS_CLOSE_TIMEOUT))
+		c.writeFrame(OP_CLOSE, []byte{0x03, 0xe8}) // 1000, normal closure
+	}
+
+	return c.Conn.Close()
+}
+
+func (r *capReader) Read(b []byte) (int, error) {
+	if r.n < 0 {
+		return r.r.Read(b)
+	}
+
+	if r.n == 0 {
+		return 0, fmt.Errorf("%w: headers too large", ErrHandshake)
+	}
+
+	if len(b) > r.n {
+		b = b[:r.n]
+	}
+
+	n, err := r.r.Read(b)
+	r.n -= n
+
+	return n, err
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + WS_GUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHas reports whether one of the comma separated values of name is token.
+func headerHas(h http.Header, name string, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
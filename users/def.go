@@ -0,0 +1,49 @@
+package users
+
+import (
+	"errors"
+	"kriptun/limit"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("user not found")
+	ErrExists   = errors.New("user already exists")
+	ErrInvalid  = errors.New("invalid user ID")
+)
+
+type User struct {
+	ID      string `json:"id"`
+	Enabled bool   `json:"enabled"`
+
+	// Verifier is the Argon2id hash of the password, see auth.Verifier.
+	Verifier string `json:"verifier,omitempty"`
+
+	// Secret is a plaintext password, kept working for users created before verifiers.
+	Secret string `json:"secret,omitempty"`
+
+	// PublicKey, "<algo>:<base64>", replaces the secret: the server only keeps the public half.
+	PublicKey string `json:"public_key,omitempty"`
+
+	// Protocols the user may open, an empty list allows all of them.
+	Protocols []string `json:"protocols,omitempty"`
+
+	// Expires disables the user after the given time, zero never expires.
+	Expires time.Time `json:"expires,omitzero"`
+
+	// Limits override the server defaults field by field.
+	Limits *limit.Limits `json:"limits,omitempty"`
+}
+
+// Store is a file-backed user database.
+// Format: {"users": [{"id": "...", "secret": "...", "enabled": true, ...}]}
+type Store struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]*User
+}
+
+type file struct {
+	Users []*User `json:"users"`
+}
@@ -0,0 +1,243 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Open loads the store at path, a missing file yields an empty store.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:  path,
+		users: map[string]*User{},
+	}
+
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	f := &file{}
+
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i, u := range f.Users {
+		if u == nil {
+			return nil, fmt.Errorf("%s: users[%d]: must not be null", path, i)
+		}
+
+		if err := validID(u.ID); err != nil {
+			return nil, fmt.Errorf("%s: users[%d]: %w", path, i, err)
+		}
+
+		if _, ok := s.users[u.ID]; ok {
+			return nil, fmt.Errorf("%s: users[%d]: %w: %s", path, i, ErrExists, u.ID)
+		}
+
+		s.users[u.ID] = u
+	}
+
+	return s, nil
+}
+
+// Reload replaces the users with the current content of the file, keeping them on error.
+func (s *Store) Reload() error {
+	fresh, err := Open(s.path)
+
+	if err != nil {
+		return err
+	}
+
+	s.Replace(fresh)
+
+	return nil
+}
+
+// Replace swaps in the users of fresh, usually a copy of the same file opened ahead of time.
+func (s *Store) Replace(fresh *Store) {
+	fresh.mu.RLock()
+	users := fresh.users
+	fresh.mu.RUnlock()
+
+	s.mu.Lock()
+	s.users = users
+	s.mu.Unlock()
+}
+
+// Save writes the store back to its file atomically.
+func (s *Store) Save() error {
+	f := &file{
+		Users: s.List(),
+	}
+
+	data, err := json.MarshalIndent(f, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".users-*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Get returns a copy of the user, or nil if it does not exist.
+func (s *Store) Get(id string) *User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[id]
+
+	if !ok {
+		return nil
+	}
+
+	return u.clone()
+}
+
+// Active reports whether the user exists and is active, see User.Active.
+func (s *Store) Active(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[id]
+
+	return ok && u.Active()
+}
+
+// List returns copies of all users sorted by ID.
+func (s *Store) List() []*User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*User, 0, len(s.users))
+
+	for _, u := range s.users {
+		list = append(list, u.clone())
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	return list
+}
+
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.users)
+}
+
+func (s *Store) Add(u *User) error {
+	if u == nil {
+		return ErrInvalid
+	}
+
+	if err := validID(u.ID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[u.ID]; ok {
+		return ErrExists
+	}
+
+	s.users[u.ID] = u.clone()
+
+	return nil
+}
+
+func (s *Store) Del(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[id]; !ok {
+		return ErrNotFound
+	}
+
+	delete(s.users, id)
+
+	return nil
+}
+
+// Update applies fn to the stored user.
+func (s *Store) Update(id string, fn func(u *User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+
+	if !ok {
+		return ErrNotFound
+	}
+
+	fn(u)
+
+	return nil
+}
+
+// Active reports whether the user is enabled and not expired.
+func (u *User) Active() bool {
+	return u.Enabled && (u.Expires.IsZero() || time.Now().Before(u.Expires))
+}
+
+func (u *User) Allows(proto string) bool {
+	return len(u.Protocols) == 0 || slices.Contains(u.Protocols, proto)
+}
+
+func (u *User) clone() *User {
+	c := *u
+	c.Protocols = slices.Clone(u.Protocols)
+
+	if u.Limits != nil {
+		l := *u.Limits
+		c.Limits = &l
+	}
+
+	return &c
+}
+
+// The ID is sent as a single length-prefixed byte string in the handshake.
+func validID(id string) error {
+	if id == "" || len(id) > 255 {
+		return ErrInvalid
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package users
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path string, data string) {
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(filepath.Join(dir, "missing.json"))
+
+	if err != nil || s.Len() != 0 {
+		t.Fatalf("expected an empty store for a missing file, got %v", err)
+	}
+
+	path := filepath.Join(dir, "users.json")
+
+	writeFile(t, path, `{"users": [{"id": "bob", "secret": "pw", "enabled": true, "protocols": ["tcp"]}]}`)
+
+	s, err = Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := s.Get("bob")
+
+	if u == nil || u.Secret != "pw" || !u.Active() || !u.Allows("tcp") || u.Allows("udp") {
+		t.Fatalf("unexpected user: %+v", u)
+	}
+
+	// Get returns a copy.
+	u.Protocols[0] = "udp"
+
+	if s.Get("bob").Protocols[0] != "tcp" {
+		t.Fatal("expected the stored user to be unchanged")
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	tests := map[string]string{
+		`{"users": [{"id": "bob"}, null]}`:             "users[1]: must not be null",
+		`{"users": [{"id": ""}]}`:                      "users[0]: " + ErrInvalid.Error(),
+		`{"users": [{"id": "bob"}, {"id": "bob"}]}`:    "users[1]: " + ErrExists.Error(),
+		`{"users": [{"id": "bob", "enabled": "yes"}]}`: "cannot unmarshal",
+	}
+
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	for data, want := range tests {
+		writeFile(t, path, data)
+
+		if _, err := Open(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected %q, got %v", data, want, err)
+		}
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.json")
+
+	s, err := Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Add(&User{ID: "bob", Secret: "pw", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Add(&User{ID: "bob"}); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file holds secrets, the temp file it is renamed from is private.
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected only the users file to be left, got %v %v", entries, err)
+	}
+
+	saved, err := Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u := saved.Get("bob"); u == nil || u.Secret != "pw" || !u.Enabled {
+		t.Fatalf("unexpected saved user: %+v", u)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "users.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Update("bob", func(u *User) {}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if err := s.Add(&User{ID: "bob", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Update("bob", func(u *User) { u.Enabled = false }); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Get("bob").Active() {
+		t.Fatal("expected the update to disable the user")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	writeFile(t, path, `{"users": [{"id": "bob"}]}`)
+
+	s, err := Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, path, `{"users": [{"id": "alice"}]}`)
+
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Get("bob") != nil || s.Get("alice") == nil {
+		t.Fatalf("expected the reloaded users, got %v", s.List())
+	}
+
+	// A broken file keeps the current users.
+	writeFile(t, path, `{"users": [null]}`)
+
+	if err := s.Reload(); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+
+	if s.Get("alice") == nil {
+		t.Fatal("expected the users to be kept")
+	}
+}